@@ -0,0 +1,167 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//AppStreamComponent describes a software component for AppStream, as written
+//into a metainfo file by AddAppStreamComponent(). Only the most common
+//elements are supported.
+type AppStreamComponent struct {
+	//ID is the component ID in reverse-DNS notation (e.g. "org.example.App").
+	//Required.
+	ID string
+	//Type is the component type (e.g. "desktop-application" or "addon").
+	//Required.
+	Type string
+	//Name is the human-readable name of the component. Required.
+	Name string
+	//Summary is a short one-line description.
+	Summary string
+	//Description contains the paragraphs of the long description.
+	Description []string
+	//MetadataLicense is the SPDX license of the metainfo file itself (usually
+	//"CC0-1.0" or "FSFAP").
+	MetadataLicense string
+	//ProjectLicense is the SPDX license expression of the component.
+	ProjectLicense string
+	//Homepage is the URL of the component's website.
+	Homepage string
+	//DesktopID is the ID of the component's desktop entry (e.g.
+	//"org.example.App.desktop"), for components that can be launched.
+	DesktopID string
+}
+
+//appStreamTypes contains the acceptable values for AppStreamComponent.Type.
+var appStreamTypes = map[string]bool{
+	"generic":             true,
+	"desktop-application": true,
+	"console-application": true,
+	"web-application":     true,
+	"service":             true,
+	"addon":               true,
+	"font":                true,
+	"codec":               true,
+	"inputmethod":         true,
+	"firmware":            true,
+	"driver":              true,
+	"localization":        true,
+	"repository":          true,
+	"operating-system":    true,
+	"icon-theme":          true,
+	"runtime":             true,
+}
+
+var appStreamIDRx = regexp.MustCompile(`^[A-Za-z0-9_-]+(?:\.[A-Za-z0-9_-]+)+$`)
+
+//validate checks that the required fields are set.
+func (c AppStreamComponent) validate() error {
+	if !appStreamIDRx.MatchString(c.ID) {
+		return fmt.Errorf("AppStream component ID %q is not acceptable (must be in reverse-DNS notation)", c.ID)
+	}
+	if !appStreamTypes[c.Type] {
+		return fmt.Errorf("AppStream component %s has unknown type %q", c.ID, c.Type)
+	}
+	if c.Name == "" {
+		return fmt.Errorf("AppStream component %s has no name", c.ID)
+	}
+	return nil
+}
+
+//appStreamXML is the XML representation of an AppStreamComponent.
+type appStreamXML struct {
+	XMLName         xml.Name              `xml:"component"`
+	Type            string                `xml:"type,attr"`
+	ID              string                `xml:"id"`
+	MetadataLicense string                `xml:"metadata_license,omitempty"`
+	ProjectLicense  string                `xml:"project_license,omitempty"`
+	Name            string                `xml:"name"`
+	Summary         string                `xml:"summary,omitempty"`
+	Description     *appStreamDescription `xml:"description"`
+	URL             *appStreamTypedValue  `xml:"url"`
+	Launchable      *appStreamTypedValue  `xml:"launchable"`
+}
+
+type appStreamDescription struct {
+	Paragraphs []string `xml:"p"`
+}
+
+//appStreamTypedValue is an element like `<url type="homepage">...</url>`.
+type appStreamTypedValue struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+//MetainfoXML serializes this component into the contents of a metainfo file.
+func (c AppStreamComponent) MetainfoXML() ([]byte, error) {
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	data := appStreamXML{
+		Type:            c.Type,
+		ID:              c.ID,
+		MetadataLicense: c.MetadataLicense,
+		ProjectLicense:  c.ProjectLicense,
+		Name:            c.Name,
+		Summary:         c.Summary,
+	}
+	if len(c.Description) > 0 {
+		data.Description = &appStreamDescription{c.Description}
+	}
+	if c.Homepage != "" {
+		data.URL = &appStreamTypedValue{"homepage", c.Homepage}
+	}
+	if c.DesktopID != "" {
+		data.Launchable = &appStreamTypedValue{"desktop-id", c.DesktopID}
+	}
+
+	result, err := xml.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(result, '\n')...), nil
+}
+
+//AddAppStreamComponent validates the given component, and inserts its
+//metainfo file into the package at /usr/share/metainfo/$ID.metainfo.xml. It
+//also sets RefreshAppStreamCache.
+func (p *Package) AddAppStreamComponent(component AppStreamComponent) error {
+	contents, err := component.MetainfoXML()
+	if err != nil {
+		return err
+	}
+	err = p.InsertFSNode("/usr/share/metainfo/"+component.ID+".metainfo.xml", &filesystem.RegularFile{
+		Content:  string(contents),
+		Metadata: p.FSRoot.GeneratedFileMetadata(),
+	})
+	if err != nil {
+		return err
+	}
+	p.RefreshAppStreamCache = true
+	return nil
+}
@@ -0,0 +1,333 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//Cache is a storage for built packages that can be used with BuildCached()
+//to avoid building identical packages multiple times. It can be implemented
+//e.g. by an in-memory map or by a directory on disk.
+type Cache interface {
+	//Get returns the package stored under the given key, or false if there is
+	//no such package.
+	Get(key string) ([]byte, bool)
+	//Put stores a package under the given key.
+	Put(key string, data []byte) error
+}
+
+//BuildCached is like g.Build(), but if the cache already contains a package
+//that was built by the same type of generator (with the same settings) from
+//an identical package, the cached result is returned instead. Otherwise, the
+//package is built and put into the cache. The package is taken from the
+//generator's field of type *Package (all generators in this module have a
+//Package field).
+//
+//Since generators can only be inspected by reflection, generators with
+//function-typed settings (e.g. pacman's MTREEHook or the RemapOwner field)
+//cannot be cached, because functions cannot be compared across runs. For
+//such generators, and for packages containing file system nodes that
+//ContentHash() does not know, an error is returned without building the
+//package.
+//
+//On a cache hit, g.Build() is not called. Methods that report on the last
+//Build(), like GeneratedControlFiles() or Checksums(), therefore behave as if
+//the package had not been built (e.g. Checksums() returns ErrNotBuilt).
+func BuildCached(g Generator, cache Cache) ([]byte, error) {
+	pkg, err := generatorPackage(g)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cacheKey(g, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := cache.Get(key); ok {
+		return data, nil
+	}
+	data, err := g.Build()
+	if err != nil {
+		return nil, err
+	}
+	return data, cache.Put(key, data)
+}
+
+//generatorPackage returns the package that the given generator builds, i.e.
+//the value of its only field of type *Package.
+func generatorPackage(g Generator) (*Package, error) {
+	var result *Package
+	if v := reflect.Indirect(reflect.ValueOf(g)); v.Kind() == reflect.Struct {
+		for idx := 0; idx < v.NumField(); idx++ {
+			field := v.Field(idx)
+			if field.Type() != reflect.TypeOf(result) || !field.CanInterface() {
+				continue
+			}
+			if result != nil {
+				return nil, fmt.Errorf("cannot cache packages built by %T: generator has multiple fields of type *build.Package", g)
+			}
+			result, _ = field.Interface().(*Package)
+			if result == nil {
+				return nil, fmt.Errorf("cannot cache packages built by %T: generator has no package", g)
+			}
+		}
+	}
+	if result == nil {
+		return nil, fmt.Errorf("cannot cache packages built by %T: generator has no field of type *build.Package", g)
+	}
+	return result, nil
+}
+
+func cacheKey(g Generator, pkg *Package) (string, error) {
+	contentHash, err := pkg.ContentHash()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "generator %T\n", g)
+	//include generator settings (but not the package pointer, which is
+	//covered by the ContentHash below)
+	if v := reflect.Indirect(reflect.ValueOf(g)); v.Kind() == reflect.Struct {
+		for idx := 0; idx < v.NumField(); idx++ {
+			field := v.Field(idx)
+			name := v.Type().Field(idx).Name
+			if field.Type() == reflect.TypeOf(pkg) || !field.CanInterface() {
+				continue
+			}
+			fmt.Fprintf(h, "%s = ", name)
+			err := hashValue(h, field)
+			if err != nil {
+				return "", fmt.Errorf("cannot cache package %s: generator setting %s %s", pkg.Name, name, err.Error())
+			}
+			fmt.Fprintln(h)
+		}
+	}
+	//the RPM generator records SOURCE_DATE_EPOCH as the build time
+	fmt.Fprintf(h, "source-date-epoch %q\n", os.Getenv("SOURCE_DATE_EPOCH"))
+	fmt.Fprintf(h, "package %s\n", contentHash)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//hashValue writes a deterministic encoding of the given value into the hash.
+//Unlike the %#v format, it follows pointers and interfaces instead of
+//printing addresses, and sorts maps by key. Functions, channels and unsafe
+//pointers cannot be encoded; an error is returned for them (unless they are
+//nil).
+func hashValue(h io.Writer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		fmt.Fprint(h, "nil")
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		if !v.IsNil() {
+			return fmt.Errorf("has type %s, which cannot be hashed", v.Type())
+		}
+		fmt.Fprint(h, "nil")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(h, "nil")
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			fmt.Fprintf(h, "%s(", v.Elem().Type())
+		} else {
+			fmt.Fprint(h, "&(")
+		}
+		err := hashValue(h, v.Elem())
+		fmt.Fprint(h, ")")
+		return err
+	case reflect.Struct:
+		fmt.Fprint(h, "{")
+		for idx := 0; idx < v.NumField(); idx++ {
+			field := v.Type().Field(idx)
+			//unexported fields are internal state (e.g. the results of the
+			//last Build()), not settings
+			if field.PkgPath != "" {
+				continue
+			}
+			fmt.Fprintf(h, "%s:", field.Name)
+			err := hashValue(h, v.Field(idx))
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(h, ",")
+		}
+		fmt.Fprint(h, "}")
+	case reflect.Map:
+		if v.IsNil() {
+			fmt.Fprint(h, "nil")
+			return nil
+		}
+		//encode all entries first, then sort them by their encoded key
+		entries := make([][2]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			var key, value bytes.Buffer
+			err := hashValue(&key, iter.Key())
+			if err != nil {
+				return err
+			}
+			err = hashValue(&value, iter.Value())
+			if err != nil {
+				return err
+			}
+			entries = append(entries, [2]string{key.String(), value.String()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i][0] < entries[j][0] })
+		fmt.Fprint(h, "map{")
+		for _, entry := range entries {
+			fmt.Fprintf(h, "%s:%s,", entry[0], entry[1])
+		}
+		fmt.Fprint(h, "}")
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			fmt.Fprint(h, "nil")
+			return nil
+		}
+		fmt.Fprint(h, "[")
+		for idx := 0; idx < v.Len(); idx++ {
+			err := hashValue(h, v.Index(idx))
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(h, ",")
+		}
+		fmt.Fprint(h, "]")
+	case reflect.String:
+		fmt.Fprintf(h, "%q", v.String())
+	default:
+		//booleans and numbers
+		fmt.Fprintf(h, "%v", v)
+	}
+	return nil
+}
+
+//ContentHash returns a SHA-256 digest over all the metadata and file system
+//contents of this package. Two packages with the same ContentHash will result
+//in identical packages when built with the same generator. The hash is stable
+//across runs and systems.
+//
+//An error is returned if the contents of a file cannot be read, or if the
+//file system contains a node (or TemplateFile.Data) that cannot be hashed.
+func (p *Package) ContentHash() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "name %q\nversion %q\nrelease %d\nepoch %d\n", p.Name, p.Version, p.Release, p.Epoch)
+	fmt.Fprintf(h, "description %q\nauthor %q\nsource %q\n", p.Description, p.Author, p.Source)
+	fmt.Fprintf(h, "maintainer %q\nvendor %q\n", p.Maintainer, p.Vendor)
+	fmt.Fprintf(h, "architecture %d %q\n", p.Architecture, p.ArchitectureInput)
+	fmt.Fprintf(h, "force-root-ownership %t\n", p.ForceRootOwnership)
+	fmt.Fprintf(h, "essential %t %t\n", p.Essential, p.BuildEssential)
+	fmt.Fprintf(h, "auto-install-hint %t\n", p.AutoInstallHint)
+	fmt.Fprintf(h, "refresh-appstream-cache %t\n", p.RefreshAppStreamCache)
+	hashRelations(h, "requires", p.Requires)
+	hashRelations(h, "pre-depends", p.PreDepends)
+	hashRelations(h, "provides", p.Provides)
+	hashRelations(h, "conflicts", p.Conflicts)
+	hashRelations(h, "replaces", p.Replaces)
+	for _, soname := range p.ProvidedLibraries {
+		fmt.Fprintf(h, "provided-library %q\n", soname)
+	}
+	for _, prefix := range p.Prefixes {
+		fmt.Fprintf(h, "prefix %q\n", prefix)
+	}
+	for _, trigger := range p.Triggers {
+		fmt.Fprintf(h, "trigger %q %q\n", trigger.Directive, trigger.Name)
+	}
+	for _, trigger := range p.RPMTriggers {
+		fmt.Fprintf(h, "rpm-trigger %d %q %q\n", trigger.Type, trigger.Interpreter, trigger.Content)
+		hashRelations(h, "rpm-trigger-target", []PackageRelation{trigger.Target})
+	}
+	for _, doc := range p.DocFiles {
+		fmt.Fprintf(h, "doc %q license=%t %q\n", doc.Name, doc.License, doc.Content)
+	}
+	for _, action := range p.Actions {
+		fmt.Fprintf(h, "action %d %q %q\n", action.Type, action.Interpreter, action.Content)
+	}
+	if p.FSRoot != nil {
+		//FileDefaults affects the doc files that are inserted during Build()
+		fmt.Fprintf(h, "file-defaults %s\n", hashMetadata(p.FSRoot.GeneratedFileMetadata()))
+		err := p.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+			return hashNode(h, absolutePath, node)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashRelations(h io.Writer, relType string, rels []PackageRelation) {
+	for _, rel := range rels {
+		fmt.Fprintf(h, "%s %q", relType, rel.RelatedPackage)
+		for _, c := range rel.Constraints {
+			fmt.Fprintf(h, " %q %q", c.Relation, c.Version)
+		}
+		fmt.Fprintln(h)
+	}
+}
+
+func hashNode(h hash.Hash, absolutePath string, node filesystem.Node) error {
+	switch n := node.(type) {
+	case *filesystem.Directory:
+		fmt.Fprintf(h, "dir %q implicit=%t %s\n", absolutePath, n.Implicit, hashMetadata(n.Metadata))
+	case *filesystem.RegularFile:
+		fmt.Fprintf(h, "file %q %s sha256=%s\n", absolutePath, hashMetadata(n.Metadata), n.SHA256Digest())
+	case *filesystem.ReaderFile:
+		_, sha256Digest, err := n.Digests()
+		if err != nil {
+			return fmt.Errorf("cannot hash %s: %s", absolutePath, err.Error())
+		}
+		fmt.Fprintf(h, "file %q %s sha256=%s\n", absolutePath, hashMetadata(n.Metadata), sha256Digest)
+	case *filesystem.Symlink:
+		fmt.Fprintf(h, "symlink %q -> %q\n", absolutePath, n.Target)
+	case *filesystem.Hardlink:
+		fmt.Fprintf(h, "hardlink %q -> %q\n", absolutePath, n.Target)
+	case *filesystem.TemplateFile:
+		fmt.Fprintf(h, "template %q %s %q data=", absolutePath, hashMetadata(n.Metadata), n.Template)
+		err := hashValue(h, reflect.ValueOf(&n.Data).Elem())
+		if err != nil {
+			return fmt.Errorf("cannot hash %s: template data %s", absolutePath, err.Error())
+		}
+		fmt.Fprintln(h)
+	default:
+		return fmt.Errorf("cannot hash %s: unknown node type %T", absolutePath, node)
+	}
+	return nil
+}
+
+func hashMetadata(m filesystem.NodeMetadata) string {
+	str := fmt.Sprintf("mode=%o", m.Mode)
+	if m.Owner != nil {
+		str += fmt.Sprintf(" owner=%d/%q", m.Owner.Int, m.Owner.Str)
+	}
+	if m.Group != nil {
+		str += fmt.Sprintf(" group=%d/%q", m.Group.Int, m.Group.Str)
+	}
+	return str
+}
@@ -0,0 +1,89 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+//testGenerator is a Generator that counts how often it builds its package.
+type testGenerator struct {
+	Package *Package
+	Builds  int
+}
+
+func (g *testGenerator) Validate() []error { return nil }
+
+func (g *testGenerator) Build() ([]byte, error) {
+	g.Builds++
+	return []byte(g.Package.Name + "-" + g.Package.Version), nil
+}
+
+func (g *testGenerator) RecommendedFileName() string { return g.Package.Name }
+
+type mapCache map[string][]byte
+
+func (c mapCache) Get(key string) ([]byte, bool) {
+	data, ok := c[key]
+	return data, ok
+}
+
+func (c mapCache) Put(key string, data []byte) error {
+	c[key] = data
+	return nil
+}
+
+func TestBuildCached(t *testing.T) {
+	cache := make(mapCache)
+	g1 := &testGenerator{Package: makeTestPackage()}
+	g2 := &testGenerator{Package: makeTestPackage()}
+	pkg3 := makeTestPackage()
+	pkg3.Version = "2.0"
+	g3 := &testGenerator{Package: pkg3}
+
+	for _, tc := range []struct {
+		Generator *testGenerator
+		Expected  string
+		Builds    int
+	}{
+		{g1, "foo-1.0", 1},
+		//identical package: served from the cache
+		{g2, "foo-1.0", 0},
+		//different package: built again
+		{g3, "foo-2.0", 1},
+	} {
+		data, err := BuildCached(tc.Generator, cache)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != tc.Expected {
+			t.Errorf("expected %q, but got %q", tc.Expected, data)
+		}
+		if tc.Generator.Builds != tc.Builds {
+			t.Errorf("%s: expected %d builds, but got %d", tc.Expected, tc.Builds, tc.Generator.Builds)
+		}
+	}
+
+	_, err := BuildCached(&testGenerator{}, cache)
+	if err == nil || !strings.Contains(err.Error(), "generator has no package") {
+		t.Errorf("expected error for generator without package, but got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//BuildChanges produces a .changes file describing an upload of the package
+//built by this Generator to a Debian archive (e.g. with dput). The `debBytes`
+//must be the result of Build(), and `filename` is the file name under which
+//it will be uploaded (usually the RecommendedFileName()). The package is
+//uploaded to the given `distribution`, e.g. "unstable" or "bookworm-backports".
+//
+//This is a method of Generator (instead of a function taking only the
+//build.Package) since the version depends on Generator.Native. The Date field
+//is taken from the SOURCE_DATE_EPOCH environment variable if set, or the
+//current time otherwise.
+func (g *Generator) BuildChanges(debBytes []byte, filename, distribution string) ([]byte, error) {
+	pkg := g.Package
+	if strings.Contains(filename, "/") {
+		return nil, fmt.Errorf("invalid file name for .changes file: %q", filename)
+	}
+	if distribution == "" || strings.ContainsAny(distribution, " \t\r\n") {
+		return nil, fmt.Errorf("invalid distribution for .changes file: %q", distribution)
+	}
+	timestamp, err := changesTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	version := g.fullVersionString()
+	//reference for this file: https://www.debian.org/doc/debian-policy/ch-controlfields.html#debian-changes-files-changes
+	contents := "Format: 1.8\n"
+	contents += fmt.Sprintf("Date: %s\n", timestamp.UTC().Format(time.RFC1123Z))
+	contents += fmt.Sprintf("Source: %s\n", pkg.Name)
+	contents += fmt.Sprintf("Binary: %s\n", pkg.Name)
+	contents += fmt.Sprintf("Architecture: %s\n", archMap[pkg.Architecture])
+	contents += fmt.Sprintf("Version: %s\n", version)
+	contents += fmt.Sprintf("Distribution: %s\n", distribution)
+	contents += "Urgency: medium\n"
+	contents += fmt.Sprintf("Maintainer: %s\n", pkg.PackagerName())
+	contents += fmt.Sprintf("Changed-By: %s\n", pkg.PackagerName())
+	contents += fmt.Sprintf("Description:\n %s - %s\n", pkg.Name, descriptionSynopsis(pkg))
+	contents += fmt.Sprintf("Changes:\n %s (%s) %s; urgency=medium\n .\n   * Automated build.\n", pkg.Name, version, distribution)
+
+	size := len(debBytes)
+	sha1sum := sha1.Sum(debBytes)
+	sha256sum := sha256.Sum256(debBytes)
+	md5sum := md5.Sum(debBytes)
+	contents += fmt.Sprintf("Checksums-Sha1:\n %s %d %s\n", hex.EncodeToString(sha1sum[:]), size, filename)
+	contents += fmt.Sprintf("Checksums-Sha256:\n %s %d %s\n", hex.EncodeToString(sha256sum[:]), size, filename)
+	contents += fmt.Sprintf("Files:\n %s %d misc optional %s\n", hex.EncodeToString(md5sum[:]), size, filename)
+
+	return []byte(contents), nil
+}
+
+func changesTimestamp() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Now(), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid value for SOURCE_DATE_EPOCH: %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
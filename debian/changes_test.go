@@ -0,0 +1,56 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildChanges(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	g := &Generator{Package: makeTestPackage()}
+	debBytes, err := g.Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	changes, err := g.BuildChanges(debBytes, g.RecommendedFileName(), "bookworm-backports")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, line := range []string{
+		"Date: Fri, 14 Jul 2017 02:40:00 +0000\n",
+		"Version: 1.0-1\n",
+		"Distribution: bookworm-backports\n",
+		" foo (1.0-1) bookworm-backports; urgency=medium\n",
+	} {
+		if !strings.Contains(string(changes), "\n"+line) {
+			t.Errorf("expected line %q in .changes file, but got:\n%s", line, changes)
+		}
+	}
+
+	for _, distribution := range []string{"", "unstable experimental", "unstable\n"} {
+		_, err := g.BuildChanges(debBytes, g.RecommendedFileName(), distribution)
+		if err == nil {
+			t.Errorf("expected error for distribution %q, but got none", distribution)
+		}
+	}
+}
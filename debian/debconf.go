@@ -0,0 +1,144 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//DebconfTemplate describes a debconf question, see debconf-devel(7). Packages
+//using debconf templates should depend on "debconf".
+type DebconfTemplate struct {
+	//Name identifies the template, usually in the form "package/question".
+	Name string
+	//Type is one of "string", "password", "boolean", "select",
+	//"multiselect", "note", "text", "error" or "title".
+	Type string
+	//Choices contains the options for the "select" and "multiselect" types.
+	Choices []string
+	//Default is the optional default answer.
+	Default string
+	//Description contains the question in its first line. Further lines are
+	//the extended description. Empty lines separate paragraphs.
+	Description string
+}
+
+var (
+	debconfTemplateNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*/[A-Za-z0-9_./+-]+$`)
+	debconfTemplateTypes  = map[string]bool{
+		"string": true, "password": true, "boolean": true, "select": true, "multiselect": true,
+		"note": true, "text": true, "error": true, "title": true,
+	}
+)
+
+//validateDebconf checks the debconf templates and config script of the given
+//generator.
+func (g *Generator) validateDebconf() []error {
+	var errs []error
+	for _, t := range g.DebconfTemplates {
+		if !debconfTemplateNameRx.MatchString(t.Name) {
+			errs = append(errs, fmt.Errorf("debconf template name %q is not acceptable", t.Name))
+		}
+		if !debconfTemplateTypes[t.Type] {
+			errs = append(errs, fmt.Errorf("debconf template %s has unknown type %q", t.Name, t.Type))
+		}
+		hasChoices := t.Type == "select" || t.Type == "multiselect"
+		if hasChoices && len(t.Choices) == 0 {
+			errs = append(errs, fmt.Errorf("debconf template %s of type %s requires choices", t.Name, t.Type))
+		}
+		if !hasChoices && len(t.Choices) > 0 {
+			errs = append(errs, fmt.Errorf("debconf template %s of type %s cannot have choices", t.Name, t.Type))
+		}
+		if strings.TrimSpace(t.Description) == "" {
+			errs = append(errs, fmt.Errorf("debconf template %s is missing a description", t.Name))
+		}
+	}
+	if g.DebconfConfigScript != "" && len(g.DebconfTemplates) == 0 {
+		errs = append(errs, errors.New("debconf config script given without any debconf templates"))
+	}
+	return errs
+}
+
+//writeDebconfFiles writes the "templates" and "config" control files.
+func (g *Generator) writeDebconfFiles(controlDir *filesystem.Directory) {
+	if len(g.DebconfTemplates) == 0 {
+		return
+	}
+
+	var paragraphs []string
+	for _, t := range g.DebconfTemplates {
+		p := fmt.Sprintf("Template: %s\nType: %s\n", t.Name, t.Type)
+		if len(t.Choices) > 0 {
+			//commas in choices must be escaped
+			choices := make([]string, len(t.Choices))
+			for idx, choice := range t.Choices {
+				choices[idx] = strings.Replace(choice, ",", `\,`, -1)
+			}
+			p += fmt.Sprintf("Choices: %s\n", strings.Join(choices, ", "))
+		}
+		if t.Default != "" {
+			p += fmt.Sprintf("Default: %s\n", t.Default)
+		}
+		p += "Description: " + formatExtendedField(t.Description)
+		paragraphs = append(paragraphs, p)
+	}
+	controlDir.Entries["templates"] = &filesystem.RegularFile{
+		Content:  strings.Join(paragraphs, "\n"),
+		Metadata: filesystem.NodeMetadata{Mode: 0644},
+	}
+
+	if g.DebconfConfigScript != "" {
+		controlDir.Entries["config"] = &filesystem.RegularFile{
+			Content:  "#!/bin/sh\n" + g.DebconfConfigScript + "\n",
+			Metadata: filesystem.NodeMetadata{Mode: 0755},
+		}
+	}
+}
+
+//formatExtendedField formats a multi-line value for a control field: The
+//first line follows the field name, continuation lines are indented by one
+//space, and empty lines are represented by " .".
+func formatExtendedField(value string) string {
+	lines := strings.SplitN(strings.TrimSpace(value), "\n", 2)
+	result := strings.TrimSpace(lines[0]) + "\n"
+	if len(lines) > 1 {
+		result += formatContinuationLines(lines[1])
+	}
+	return result
+}
+
+//formatContinuationLines formats the given lines as continuation lines of a
+//multi-line control field (see formatExtendedField).
+func formatContinuationLines(value string) string {
+	var result string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			line = "."
+		}
+		result += " " + line + "\n"
+	}
+	return result
+}
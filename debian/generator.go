@@ -24,7 +24,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"regexp"
 	"strings"
+	"sync"
 
 	build "github.com/holocm/libpackagebuild"
 	"github.com/holocm/libpackagebuild/filesystem"
@@ -33,6 +36,46 @@ import (
 //Generator is the build.Generator for Debian packages.
 type Generator struct {
 	Package *build.Package
+	//SizeLimits, if set, cause Build() to fail for oversized packages.
+	build.SizeLimits
+	//ExtraControlFiles are written into control.tar.gz in addition to the
+	//generated files (e.g. a "preinst" or "prerm" maintainer script). Names
+	//must consist of lowercase letters, digits, ".", "_" and "-", and may not
+	//collide with generated control files. Maintainer scripts must have an
+	//executable mode.
+	build.ExtraControlFiles
+	//XZMemoryLimit, if not zero, limits the memory usage of the xz compressor
+	//to the given number of bytes, at the expense of the compression ratio.
+	XZMemoryLimit int
+	//RemapOwner, if not nil, chooses the owners and groups recorded in
+	//data.tar.xz (see filesystem.RemapFunc).
+	RemapOwner func(path string, md filesystem.NodeMetadata) filesystem.NodeMetadata
+	//GenerateShlibs, if true, writes a "shlibs" control file for the shared
+	//libraries in this package, so that dpkg-shlibdeps can compute
+	//dependencies on this package for binaries linking against them. The
+	//Package.ProvidedLibraries are always written into this file.
+	GenerateShlibs bool
+	//DebconfTemplates contains debconf questions that are written into the
+	//"templates" control file.
+	DebconfTemplates []DebconfTemplate
+	//DebconfConfigScript is the body of the "config" maintainer script that
+	//asks the debconf questions. It is run with /bin/sh.
+	DebconfConfigScript string
+	//GenerateSHA256Sums, if true, writes a "sha256sums" control file in the
+	//same format as the "md5sums" control file (which is always written since
+	//dpkg relies on it).
+	GenerateSHA256Sums bool
+	//Native, if true, builds a native package, i.e. one without a Debian
+	//revision: the version is written as "[epoch:]version" instead of
+	//"[epoch:]version-release". Since dpkg treats every version containing a
+	//hyphen as having a revision, Package.Version may not contain hyphens
+	//then, and Package.Release must be left at 1.
+	Native bool
+
+	controlFiles     map[string][]byte
+	checksums        map[string]string
+	installedSize    int64
+	uncompressedSize int64
 }
 
 //GeneratorFactory spawns Generator instances. It satisfies the build.GeneratorFactory type.
@@ -48,133 +91,511 @@ var archMap = map[build.Architecture]string{
 	// build.ArchitectureARMv6h is not supported by Debian
 	build.ArchitectureARMv7h:  "armhf",
 	build.ArchitectureAArch64: "arm64",
+	// build.ArchitectureARMv7 is not supported by Debian (softfloat ARMv7 uses armel)
+	build.ArchitectureMIPS:     "mips",
+	build.ArchitectureMIPS64EL: "mips64el",
+	build.ArchitectureLoong64:  "loong64",
 }
 
 //RecommendedFileName implements the build.Generator interface.
 func (g *Generator) RecommendedFileName() string {
-	//this is called after Build(), so we can assume that package name,
-	//version, etc. were already validated
+	//this only uses the package name, version and architecture, so it can be
+	//called before Build(), but we assume that Validate() was called before
 	pkg := g.Package
-	return fmt.Sprintf("%s_%s_%s.deb", pkg.Name, fullVersionString(pkg), archMap[pkg.Architecture])
+	return fmt.Sprintf("%s_%s_%s.deb", pkg.Name, g.fullVersionString(), archMap[pkg.Architecture])
+}
+
+//GeneratedControlFiles returns the contents of the files in control.tar.gz
+//(e.g. "control", "md5sums" and "postinst"), as generated by the last call to
+//Build(). Before the first Build(), nil is returned.
+func (g *Generator) GeneratedControlFiles() map[string][]byte {
+	return g.controlFiles
+}
+
+//Checksums returns the digests of the package file produced by the last
+//successful call to Build(), as computed by build.ComputeChecksums().
+func (g *Generator) Checksums() (map[string]string, error) {
+	if g.checksums == nil {
+		return nil, build.ErrNotBuilt
+	}
+	return g.checksums, nil
+}
+
+//BuildResult is like Build, but also returns the sizes of the package. The
+//UncompressedSize is the size of the uncompressed data.tar archive (i.e.
+//without the control archive).
+func (g *Generator) BuildResult() (build.BuildResult, error) {
+	data, err := g.Build()
+	if err != nil {
+		return build.BuildResult{}, err
+	}
+	return build.BuildResult{
+		Bytes:               data,
+		RecommendedFileName: g.RecommendedFileName(),
+		CompressedSize:      int64(len(data)),
+		UncompressedSize:    g.uncompressedSize,
+		InstalledSize:       g.installedSize,
+	}, nil
 }
 
 //Validate implements the build.Generator interface.
 func (g *Generator) Validate() []error {
+	errs, _ := g.ValidateWithWarnings()
+	return errs
+}
+
+//ValidateWithWarnings is like Validate, but also returns warnings (see
+//build.Package.ValidateWithWarnings()).
+func (g *Generator) ValidateWithWarnings() (errs []error, warnings []error) {
 	pkg := g.Package
 
 	//reference: https://www.debian.org/doc/debian-policy/ch-controlfields.html
 	var nameRx = `[a-z0-9][a-z0-9+-.]+`
 	var versionRx = `[0-9][A-Za-z0-9.+:~-]*`
-	errs := pkg.ValidateWith(build.RegexSet{
+	//the package's own version may not contain colons since the epoch is
+	//given separately (dpkg would interpret everything up to the first
+	//colon as the epoch); hyphens are okay unless the package is native
+	//(see below) since fullVersionString() appends the Debian revision then
+	var ownVersionRx = `[0-9][A-Za-z0-9.+~-]*`
+	errs, warnings = pkg.ValidateWithWarnings(build.RegexSet{
 		PackageName:    nameRx,
-		PackageVersion: versionRx,
+		PackageVersion: ownVersionRx,
 		RelatedName:    nameRx,
 		RelatedVersion: "(?:[0-9]+:)?" + versionRx + "(?:-[1-9][0-9]*)?", //incl. release/epoch
 		FormatName:     "Debian",
+		MaxPathLength:  maxPathLength,
+		DefaultShell:   "bash",
 	}, archMap)
 
-	if pkg.Author == "" {
-		err := errors.New("The \"package.author\" field is required for Debian packages")
+	//dpkg splits the version at the last hyphen into upstream version and
+	//revision, so native packages can neither contain a hyphen in their
+	//version nor express a release other than the default
+	if g.Native {
+		if strings.Contains(pkg.Version, "-") {
+			err := fmt.Errorf("Package version \"%s\" may not contain hyphens in native Debian packages", pkg.Version)
+			errs = append(errs, err)
+		}
+		if pkg.Release > 1 {
+			err := fmt.Errorf("Package release %d cannot be expressed in native Debian packages (must be 1)", pkg.Release)
+			errs = append(errs, err)
+		}
+	}
+
+	if pkg.PackagerName() == "" {
+		err := errors.New("The \"package.author\" or \"package.maintainer\" field is required for Debian packages")
 		errs = append(errs, err)
 	}
 
-	for _, rel := range pkg.Provides {
-		if len(rel.Constraints) > 0 {
-			err := fmt.Errorf("version constraints on \"Provides: %s\" are not allowed for Debian packages", rel.RelatedPackage)
+	for _, trigger := range pkg.Triggers {
+		switch trigger.Directive {
+		case "interest", "interest-await", "interest-noawait", "activate", "activate-await", "activate-noawait":
+		default:
+			err := fmt.Errorf("trigger directive %q is not acceptable for Debian packages", trigger.Directive)
 			errs = append(errs, err)
 		}
+		if trigger.Name == "" || strings.ContainsAny(trigger.Name, " \t\n") {
+			err := fmt.Errorf("trigger name %q is not acceptable for Debian packages", trigger.Name)
+			errs = append(errs, err)
+		}
+	}
+
+	//essential packages cannot be removed, so they usually need maintainer
+	//scripts to set themselves up (e.g. register alternatives or diversions)
+	if pkg.Essential && !g.hasMaintainerScripts() {
+		warnings = append(warnings, errors.New("package is marked as essential, but has no maintainer scripts"))
+	}
+
+	errs = append(errs, g.validateDataTar()...)
+	errs = append(errs, g.ValidateControlFileNames("Debian", controlFileNameRx.MatchString)...)
+	errs = append(errs, g.validateMaintainerScriptModes()...)
+	return append(errs, g.validateDebconf()...), warnings
+}
+
+//maxPathLength is the maximum length of an absolute path in a Debian
+//package: data.tar.xz stores it as "./" plus the relative path, which must
+//fit into the 155-byte prefix and 100-byte name fields of a USTAR header
+//(see validateDataTar).
+const maxPathLength = 255
+
+//validateDataTar reports files that cannot be stored in data.tar.xz in a way
+//that dpkg can extract. dpkg does not understand the PAX extensions that
+//archive/tar falls back to for entries that do not fit into a USTAR header
+//(e.g. long paths or link targets, or non-ASCII file names), and fails to
+//install those packages.
+func (g *Generator) validateDataTar() []error {
+	if g.Package.FSRoot == nil {
+		return nil
+	}
+	headers, err := g.Package.FSRoot.TarHeaders(g.dataTarOptions())
+	if err != nil {
+		//Build() will report this with more context
+		return nil
+	}
+
+	var (
+		errs     []error
+		reported string
+	)
+	for _, hdr := range headers {
+		absolutePath := strings.TrimPrefix(hdr.Name, ".")
+		if absolutePath != "/" {
+			absolutePath = strings.TrimSuffix(absolutePath, "/")
+		}
+		//overlong paths were already reported by pkg.ValidateWithWarnings(),
+		//and for a directory that is reported here, the entries below it
+		//need not be reported as well
+		if len(absolutePath) > maxPathLength || (reported != "" && strings.HasPrefix(absolutePath, reported+"/")) {
+			continue
+		}
+		err := filesystem.CheckUSTARHeader(&hdr)
+		if err != nil {
+			reported = absolutePath
+			errs = append(errs, fmt.Errorf("Path \"%s\" cannot be stored in Debian packages: %s (dpkg cannot extract PAX headers)", absolutePath, err.Error()))
+		}
 	}
+	return errs
+}
 
+//controlFileNameRx matches the acceptable names for ExtraControlFiles.
+var controlFileNameRx = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+//maintainerScriptNames contains the names of the control files that dpkg
+//executes as maintainer scripts.
+var maintainerScriptNames = []string{"preinst", "postinst", "prerm", "postrm", "config"}
+
+//hasMaintainerScripts returns whether the package will contain at least one
+//maintainer script, either generated from Package.Actions or
+//DebconfConfigScript, or given in ExtraControlFiles.
+func (g *Generator) hasMaintainerScripts() bool {
+	if g.Package.Script(build.SetupAction) != "" || g.Package.Script(build.CleanupAction) != "" || g.DebconfConfigScript != "" {
+		return true
+	}
+	for _, file := range g.ControlFiles {
+		if isMaintainerScript(file.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+//isMaintainerScript returns whether the control file with the given name is
+//a maintainer script.
+func isMaintainerScript(name string) bool {
+	for _, scriptName := range maintainerScriptNames {
+		if name == scriptName {
+			return true
+		}
+	}
+	return false
+}
+
+//validateMaintainerScriptModes reports maintainer scripts in ExtraControlFiles
+//that are not executable, since dpkg refuses to run them.
+func (g *Generator) validateMaintainerScriptModes() []error {
+	var errs []error
+	for _, file := range g.ControlFiles {
+		if isMaintainerScript(file.Name) && file.Mode&0111 == 0 {
+			errs = append(errs, fmt.Errorf("Control file \"%s\" is a maintainer script, but its mode %04o is not executable", file.Name, uint32(file.Mode)))
+		}
+	}
 	return errs
 }
 
-func fullVersionString(pkg *build.Package) string {
-	str := fmt.Sprintf("%s-%d", pkg.Version, pkg.Release)
+//fullVersionString formats the version as "[epoch:]version-release", where
+//the release becomes the Debian revision, or as "[epoch:]version" for native
+//packages.
+func (g *Generator) fullVersionString() string {
+	pkg := g.Package
+	str := pkg.Version
+	if !g.Native {
+		str = fmt.Sprintf("%s-%d", pkg.Version, pkg.Release)
+	}
 	if pkg.Epoch > 0 {
 		str = fmt.Sprintf("%d:%s", pkg.Epoch, str)
 	}
 	return str
 }
 
+//bufferPool holds buffers for intermediate archives, to avoid allocating a
+//new large buffer for each Build() when building many packages in a row.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
 type arArchiveEntry struct {
 	Name string
 	Data []byte
 }
 
+//Preview returns a summary of the package that Build() would produce, without
+//building it. Validation errors and size limit violations are reported like
+//in Validate() and Build(). Since this generator does not declare conffiles,
+//the preview does not list any ConfigFiles. The Package is not modified.
+func (g *Generator) Preview() (build.BuildPreview, error) {
+	errs := g.Validate()
+	if len(errs) > 0 {
+		return build.BuildPreview{}, errors.Join(errs...)
+	}
+	pkg := g.Package.Clone()
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = pkg.InsertDocFiles(build.DocDirectory)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	return build.NewBuildPreview(pkg, nil), nil
+}
+
 //Build implements the build.Generator interface.
 func (g *Generator) Build() ([]byte, error) {
-	pkg := g.Package
-	pkg.PrepareBuild()
-
-	//compress data.tar.xz
-	var dataTar bytes.Buffer
-	err := pkg.FSRoot.ToTarXZArchive(&dataTar, true, false)
+	controlTar, err := g.prepareBuild()
 	if err != nil {
 		return nil, err
 	}
+	pkg := g.Package
 
-	//prepare a directory into which to assemble the metadata files for control.tar.gz
-	controlTar, err := buildControlTar(pkg)
+	//compress data.tar.xz (the buffer can be reused since buildArArchive
+	//copies its contents)
+	dataTar := bufferPool.Get().(*bytes.Buffer)
+	dataTar.Reset()
+	defer bufferPool.Put(dataTar)
+	g.uncompressedSize, err = pkg.FSRoot.ToCompressedTarArchive(dataTar, g.dataCompressor(), g.dataTarOptions())
 	if err != nil {
 		return nil, err
 	}
 
 	//build ar archive
-	return buildArArchive([]arArchiveEntry{
+	result, err := buildArArchive([]arArchiveEntry{
 		{"debian-binary", []byte("2.0\n")},
 		{"control.tar.gz", controlTar},
 		{"data.tar.xz", dataTar.Bytes()},
 	})
+	if err != nil {
+		return nil, err
+	}
+	err = g.CheckCompressedSize(pkg, result)
+	if err != nil {
+		return nil, err
+	}
+	g.checksums = build.ComputeChecksums(result)
+	return result, nil
+}
+
+//BuildReader is like Build, but streams the package file through the
+//returned reader instead of holding it in memory (see build.NewBuildReader).
+//Errors from preparing the package are returned immediately, errors from
+//compressing it are returned by Read(). Checksums() and BuildResult() become
+//available once the reader has been read to the end.
+//
+//Since the ar archive records the size of data.tar.xz before its contents,
+//data.tar.xz is compressed twice: once to find its size, and once more while
+//streaming. BuildReader thus takes longer than Build.
+func (g *Generator) BuildReader() (io.ReadCloser, error) {
+	controlTar, err := g.prepareBuild()
+	if err != nil {
+		return nil, err
+	}
+	pkg := g.Package
+	var dataSize byteCounter
+	uncompressedSize, err := pkg.FSRoot.ToCompressedTarArchive(&dataSize, g.dataCompressor(), g.dataTarOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	g.checksums = nil
+	return build.NewBuildReader(func(w io.Writer) error {
+		pw := g.NewPackageWriter(pkg, w)
+		err := writeArArchiveStart(pw, []arArchiveEntry{
+			{"debian-binary", []byte("2.0\n")},
+			{"control.tar.gz", controlTar},
+		})
+		if err != nil {
+			return err
+		}
+		err = writeArHeader(pw, "data.tar.xz", int64(dataSize))
+		if err != nil {
+			return err
+		}
+		offset := pw.Size()
+		_, err = pkg.FSRoot.ToCompressedTarArchive(pw, g.dataCompressor(), g.dataTarOptions())
+		if err != nil {
+			return err
+		}
+		if pw.Size()-offset != int64(dataSize) {
+			return fmt.Errorf("cannot build package %s: compressing data.tar.xz is not reproducible (got %d bytes instead of %d bytes)",
+				pkg.Name, pw.Size()-offset, dataSize)
+		}
+		err = writeArPadding(pw, int64(dataSize))
+		if err != nil {
+			return err
+		}
+		g.uncompressedSize = uncompressedSize
+		g.checksums = pw.Checksums()
+		return nil
+	}), nil
+}
+
+//dataTarOptions returns the TarOptions for data.tar.xz.
+func (g *Generator) dataTarOptions() filesystem.TarOptions {
+	return filesystem.TarOptions{PathStyle: filesystem.DotSlash, RemapOwner: g.RemapOwner}
+}
+
+//dataCompressor returns the Compressor for data.tar.xz.
+func (g *Generator) dataCompressor() filesystem.Compressor {
+	return filesystem.XZCompressor{MemoryLimit: g.XZMemoryLimit}
 }
 
-func buildControlTar(pkg *build.Package) ([]byte, error) {
+//byteCounter is an io.Writer that discards everything written into it, but
+//counts the number of bytes.
+type byteCounter int64
+
+//Write implements the io.Writer interface.
+func (c *byteCounter) Write(buf []byte) (int, error) {
+	*c += byteCounter(len(buf))
+	return len(buf), nil
+}
+
+//prepareBuild executes all steps of Build() before compressing data.tar.xz,
+//and returns the contents of control.tar.gz.
+func (g *Generator) prepareBuild() ([]byte, error) {
+	pkg := g.Package
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return nil, err
+	}
+	err = pkg.InsertDocFiles(build.DocDirectory)
+	if err != nil {
+		return nil, err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return nil, err
+	}
+	g.installedSize = pkg.FSRoot.InstalledSizeInBytes()
+
+	//prepare a directory into which to assemble the metadata files for control.tar.gz
+	controlDir, err := g.buildControlDir()
+	if err != nil {
+		return nil, err
+	}
+	g.controlFiles = make(map[string][]byte)
+	for name, node := range controlDir.Entries {
+		if file, ok := node.(*filesystem.RegularFile); ok {
+			g.controlFiles[name] = []byte(file.Content)
+		}
+	}
+	var controlTar bytes.Buffer
+	err = controlDir.ToTarGZArchive(&controlTar, filesystem.TarOptions{PathStyle: filesystem.DotSlash})
+	if err != nil {
+		return nil, err
+	}
+	return controlTar.Bytes(), nil
+}
+
+func (g *Generator) buildControlDir() (*filesystem.Directory, error) {
+	pkg := g.Package
 	//prepare a directory into which to put all these files
 	controlDir := filesystem.NewDirectory()
 
 	//place all the required files in there (NOTE: using the conffiles file
 	//does not seem to be appropriate for our use-case, although I'll let more
 	//experienced Debian users judge this one)
-	err := writeControlFile(pkg, controlDir)
+	err := writeControlFile(pkg, g.fullVersionString(), controlDir)
+	if err != nil {
+		return nil, err
+	}
+	err = writeDigestFiles(pkg, controlDir, g.GenerateSHA256Sums)
 	if err != nil {
 		return nil, err
 	}
-	writeMD5SumsFile(pkg, controlDir)
+	writeTriggersFile(pkg, controlDir)
+	g.writeDebconfFiles(controlDir)
+	if g.GenerateShlibs || len(pkg.ProvidedLibraries) > 0 {
+		err = writeShlibsFile(pkg, g.fullVersionString(), controlDir, g.GenerateShlibs)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	//write postinst script if necessary
-	script := pkg.Script(build.SetupAction)
-	if script != "" {
-		script := "#!/bin/bash\n" + script + "\n"
-		controlDir.Entries["postinst"] = &filesystem.RegularFile{
-			Content:  script,
-			Metadata: filesystem.NodeMetadata{Mode: 0755},
-		}
+	err = writeMaintainerScript(pkg, build.SetupAction, "postinst", controlDir)
+	if err != nil {
+		return nil, err
 	}
 
 	//write postrm script if necessary
-	script = pkg.Script(build.CleanupAction)
-	if script != "" {
-		script := "#!/bin/bash\n" + script + "\n"
-		controlDir.Entries["postrm"] = &filesystem.RegularFile{
-			Content:  script,
-			Metadata: filesystem.NodeMetadata{Mode: 0755},
+	err = writeMaintainerScript(pkg, build.CleanupAction, "postrm", controlDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range g.ControlFiles {
+		if _, exists := controlDir.Entries[file.Name]; exists {
+			return nil, fmt.Errorf("cannot add control file %s: file is already generated", file.Name)
+		}
+		controlDir.Entries[file.Name] = &filesystem.RegularFile{
+			Content:  string(file.Content),
+			Metadata: filesystem.NodeMetadata{Mode: file.Mode},
 		}
 	}
 
-	var buf bytes.Buffer
-	err = controlDir.ToTarGZArchive(&buf, true, false)
-	return buf.Bytes(), err
+	return controlDir, nil
 }
 
-func writeControlFile(pkg *build.Package, controlDir *filesystem.Directory) error {
+func writeMaintainerScript(pkg *build.Package, actionType uint, fileName string, controlDir *filesystem.Directory) error {
+	script := pkg.Script(actionType)
+	if script == "" {
+		return nil
+	}
+	interpreter, err := pkg.ScriptInterpreter(actionType)
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %s", fileName, err.Error())
+	}
+	if interpreter == "" {
+		interpreter = "/bin/bash"
+	}
+
+	controlDir.Entries[fileName] = &filesystem.RegularFile{
+		Content:  "#!" + interpreter + "\n" + script + "\n",
+		Metadata: filesystem.NodeMetadata{Mode: 0755},
+	}
+	return nil
+}
+
+func writeControlFile(pkg *build.Package, version string, controlDir *filesystem.Directory) error {
 	//reference for this file:
 	//https://www.debian.org/doc/debian-policy/ch-controlfields.html#s-binarycontrolfiles
 	contents := fmt.Sprintf("Package: %s\n", pkg.Name)
-	contents += fmt.Sprintf("Version: %s\n", fullVersionString(pkg))
+	contents += fmt.Sprintf("Version: %s\n", version)
 	contents += fmt.Sprintf("Architecture: %s\n", archMap[pkg.Architecture])
-	contents += fmt.Sprintf("Maintainer: %s\n", pkg.Author)
-	contents += fmt.Sprintf("Installed-Size: %d\n", int(pkg.FSRoot.InstalledSizeInBytes()/1024)) // convert bytes to KiB
+	contents += fmt.Sprintf("Maintainer: %s\n", pkg.PackagerName())
+	if author := pkg.UpstreamAuthor(); author != "" {
+		contents += fmt.Sprintf("Uploaders: %s\n", author)
+	}
+	if pkg.Vendor != "" {
+		contents += fmt.Sprintf("Origin: %s\n", pkg.Vendor)
+	}
+	if pkg.Source != "" {
+		contents += fmt.Sprintf("X-Source: %s\n", pkg.Source)
+	}
+	if pkg.AutoInstallHint {
+		contents += "X-Install-Reason: dependency\n"
+	}
+	contents += fmt.Sprintf("Installed-Size: %d\n", pkg.FSRoot.InstalledSizeInBytes()/1024) // convert bytes to KiB
 	contents += "Section: misc\n"
 	contents += "Priority: optional\n"
+	if pkg.Essential {
+		contents += "Essential: yes\n"
+	}
+	if pkg.BuildEssential {
+		contents += "Build-Essential: yes\n"
+	}
 
 	//compile relations
 	rels, err := compilePackageRelations("Depends", pkg.Requires)
@@ -183,6 +604,12 @@ func writeControlFile(pkg *build.Package, controlDir *filesystem.Directory) erro
 	}
 	contents += rels
 
+	rels, err = compilePackageRelations("Pre-Depends", pkg.PreDepends)
+	if err != nil {
+		return err
+	}
+	contents += rels
+
 	rels, err = compilePackageRelations("Provides", pkg.Provides)
 	if err != nil {
 		return err
@@ -201,12 +628,15 @@ func writeControlFile(pkg *build.Package, controlDir *filesystem.Directory) erro
 	}
 	contents += rels
 
-	//we have only one description field, which we use both as the synopsis and the extended description
-	desc := strings.TrimSpace(strings.Replace(pkg.Description, "\n", " ", -1))
-	if desc == "" {
-		desc = strings.TrimSpace(pkg.Name) //description field is strictly required
+	//the first line of the description is the synopsis, the other lines are
+	//the extended description (if there is none, we repeat the synopsis)
+	desc := descriptionSynopsis(pkg)
+	contents += fmt.Sprintf("Description: %s\n", desc)
+	if extended := pkg.ExtendedDescription(); extended != "" {
+		contents += formatContinuationLines(extended)
+	} else {
+		contents += fmt.Sprintf(" %s\n", desc)
 	}
-	contents += fmt.Sprintf("Description: %s\n %s\n", desc, desc)
 
 	controlDir.Entries["control"] = &filesystem.RegularFile{
 		Content:  contents,
@@ -215,6 +645,14 @@ func writeControlFile(pkg *build.Package, controlDir *filesystem.Directory) erro
 	return nil
 }
 
+func descriptionSynopsis(pkg *build.Package) string {
+	desc := pkg.DescriptionSynopsis()
+	if desc == "" {
+		desc = strings.TrimSpace(pkg.Name) //description field is strictly required
+	}
+	return desc
+}
+
 func compilePackageRelations(relType string, rels []build.PackageRelation) (string, error) {
 	if len(rels) == 0 {
 		return "", nil
@@ -245,29 +683,104 @@ func compilePackageRelations(relType string, rels []build.PackageRelation) (stri
 	return fmt.Sprintf("%s: %s\n", relType, strings.Join(entries, ", ")), nil
 }
 
-func writeMD5SumsFile(pkg *build.Package, controlDir *filesystem.Directory) {
-	//calculate MD5 sums for all regular files in this package
-	var lines []string
-	pkg.WalkFSWithRelativePaths(func(path string, node filesystem.Node) error {
-		file, ok := node.(*filesystem.RegularFile)
-		if !ok {
+func writeTriggersFile(pkg *build.Package, controlDir *filesystem.Directory) {
+	if len(pkg.Triggers) == 0 {
+		return
+	}
+	var contents string
+	for _, trigger := range pkg.Triggers {
+		contents += fmt.Sprintf("%s %s\n", trigger.Directive, trigger.Name)
+	}
+	controlDir.Entries["triggers"] = &filesystem.RegularFile{
+		Content:  contents,
+		Metadata: filesystem.NodeMetadata{Mode: 0644},
+	}
+}
+
+//writeDigestFiles writes the "md5sums" control file and, if requested, the
+//"sha256sums" control file.
+func writeDigestFiles(pkg *build.Package, controlDir *filesystem.Directory, withSHA256 bool) error {
+	//calculate digests for all regular files in this package
+	var md5Lines, sha256Lines []string
+	err := pkg.WalkFSWithRelativePaths(func(path string, node filesystem.Node) error {
+		//hardlinks are listed with the checksum of their target (like dpkg does)
+		if link, ok := node.(*filesystem.Hardlink); ok {
+			var err error
+			node, err = pkg.FSRoot.ResolveHardlink(link)
+			if err != nil {
+				return err
+			}
+		}
+		var md5Digest, sha256Digest string
+		switch file := node.(type) {
+		case *filesystem.RegularFile:
+			md5Digest, sha256Digest = file.MD5Digest(), file.SHA256Digest()
+		case *filesystem.ReaderFile:
+			var err error
+			md5Digest, sha256Digest, err = file.Digests()
+			if err != nil {
+				return fmt.Errorf("cannot read /%s: %s", path, err.Error())
+			}
+		default:
 			return nil //look only at regular files
 		}
-		lines = append(lines, fmt.Sprintf("%s  %s\n", file.MD5Digest(), path))
+		md5Lines = append(md5Lines, fmt.Sprintf("%s  %s\n", md5Digest, path))
+		sha256Lines = append(sha256Lines, fmt.Sprintf("%s  %s\n", sha256Digest, path))
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	controlDir.Entries["md5sums"] = &filesystem.RegularFile{
-		Content:  strings.Join(lines, ""),
+		Content:  strings.Join(md5Lines, ""),
 		Metadata: filesystem.NodeMetadata{Mode: 0644},
 	}
+	if withSHA256 {
+		controlDir.Entries["sha256sums"] = &filesystem.RegularFile{
+			Content:  strings.Join(sha256Lines, ""),
+			Metadata: filesystem.NodeMetadata{Mode: 0644},
+		}
+	}
+	return nil
 }
 
 func buildArArchive(entries []arArchiveEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeArArchiveStart(&buf, entries)
+	return buf.Bytes(), err
+}
+
+//writeArArchiveStart writes the global header of an ar archive, followed by
+//the given entries. More entries can be appended with writeArHeader() and
+//writeArPadding().
+func writeArArchiveStart(w io.Writer, entries []arArchiveEntry) error {
 	//we only need a very small subset of the ar archive format, so we can
 	//directly construct it without requiring an extra library
-	buf := bytes.NewBuffer([]byte("!<arch>\n"))
+	_, err := io.WriteString(w, "!<arch>\n")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err := writeArHeader(w, entry.Name, int64(len(entry.Data)))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(entry.Data)
+		if err != nil {
+			return err
+		}
+		err = writeArPadding(w, int64(len(entry.Data)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+//writeArHeader writes the header for an ar archive entry with the given name
+//and size.
+func writeArHeader(w io.Writer, name string, size int64) error {
 	//most fields are static
 	headerFormat := "%-16s"
 	headerFormat += "0           " //modification time = UNIX timestamp 0 (for reproducability)
@@ -276,15 +789,16 @@ func buildArArchive(entries []arArchiveEntry) ([]byte, error) {
 	headerFormat += "100644  "     //file mode = regular file, rw-r--r--
 	headerFormat += "%-10d"        //file size in bytes
 	headerFormat += "\x60\n"       //magic header separator
+	_, err := fmt.Fprintf(w, headerFormat, name, size)
+	return err
+}
 
-	for _, entry := range entries {
-		fmt.Fprintf(buf, headerFormat, entry.Name, len(entry.Data))
-		buf.Write(entry.Data)
-		//pad data to 2-byte boundary
-		if len(entry.Data)%2 == 1 {
-			buf.Write([]byte{'\n'})
-		}
+//writeArPadding pads the data of an ar archive entry with the given size to
+//a 2-byte boundary.
+func writeArPadding(w io.Writer, size int64) error {
+	if size%2 == 1 {
+		_, err := w.Write([]byte{'\n'})
+		return err
 	}
-
-	return buf.Bytes(), nil
+	return nil
 }
@@ -0,0 +1,273 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+func makeTestPackage() *build.Package {
+	return &build.Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: build.ArchitectureAny,
+		Author:       "Jane Doe <jane@example.org>",
+		FSRoot:       filesystem.NewDirectory(),
+	}
+}
+
+func TestValidateDataTar(t *testing.T) {
+	testCases := []struct {
+		Path     string
+		Symlink  string
+		Expected string
+	}{
+		//fits into the prefix and name fields of a USTAR header
+		{"/usr/share/" + strings.Repeat("x", 90) + "/" + strings.Repeat("y", 99), "", ""},
+		{"/usr/share/" + strings.Repeat("x", 150) + "/foo", "", "cannot be stored in Debian packages: name is 163 bytes long"},
+		{"/usr/share/" + strings.Repeat("x", 300), "", "is 311 bytes long, but Debian packages allow at most 255 bytes"},
+		{"/usr/share/föö", "", "name contains non-ASCII characters"},
+		{"/usr/share/foo", "/" + strings.Repeat("x", 100), "link target is 101 bytes long"},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage()
+		var err error
+		if tc.Symlink == "" {
+			err = pkg.InsertFSNode(tc.Path, &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0644}})
+		} else {
+			err = pkg.InsertFSNode(tc.Path, &filesystem.Symlink{Target: tc.Symlink, Dangling: true})
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		errs := (&Generator{Package: pkg}).Validate()
+		if tc.Expected == "" {
+			for _, err := range errs {
+				t.Errorf("unexpected error for %s: %s", tc.Path, err.Error())
+			}
+			continue
+		}
+		if len(errs) != 1 {
+			t.Errorf("expected one error for %s, but got %q", tc.Path, errs)
+			continue
+		}
+		if !strings.Contains(errs[0].Error(), tc.Expected) {
+			t.Errorf("expected error for %s to contain %q, but got: %s", tc.Path, tc.Expected, errs[0].Error())
+		}
+	}
+}
+
+func TestProvides(t *testing.T) {
+	pkg := makeTestPackage()
+	pkg.Architecture = build.ArchitectureX86_64
+	pkg.Provides = []build.PackageRelation{{RelatedPackage: "mail-transport-agent"}}
+	pkg.ProvidedLibraries = []string{"libfoo.so.1"}
+	err := pkg.InsertFSNode("/usr/lib/x86_64-linux-gnu/libfoo.so.1", &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0644}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	g := &Generator{Package: pkg}
+	if errs := g.Validate(); len(errs) > 0 {
+		t.Fatalf("unexpected validation errors: %q", errs)
+	}
+	_, err = g.Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the virtual package is provided in the control file, the soname only in
+	//the shlibs file (GenerateShlibs is not needed for that)
+	control := string(g.GeneratedControlFiles()["control"])
+	if !strings.Contains(control, "\nProvides: mail-transport-agent\n") {
+		t.Errorf("expected virtual package in control file, but got:\n%s", control)
+	}
+	if strings.Contains(control, "libfoo") {
+		t.Errorf("expected soname not to appear in control file, but got:\n%s", control)
+	}
+	expected := "libfoo 1 foo (>= 1.0-1)\n"
+	if shlibs := string(g.GeneratedControlFiles()["shlibs"]); shlibs != expected {
+		t.Errorf("expected shlibs file %q, but got %q", expected, shlibs)
+	}
+}
+
+func TestValidateMaintainerScriptModes(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Mode     uint32
+		Expected string
+	}{
+		{"preinst", 0755, ""},
+		{"prerm", 0700, ""},
+		{"config", 0644, `"config" is a maintainer script, but its mode 0644 is not executable`},
+		{"preinst", 0, `"preinst" is a maintainer script, but its mode 0000 is not executable`},
+		//other control files need not be executable
+		{"conffiles", 0644, ""},
+	}
+
+	for _, tc := range testCases {
+		g := &Generator{Package: makeTestPackage()}
+		g.AddControlFile(tc.Name, []byte("#!/bin/sh\n"), os.FileMode(tc.Mode))
+		errs := g.Validate()
+		if tc.Expected == "" {
+			for _, err := range errs {
+				t.Errorf("unexpected error for %s with mode %04o: %s", tc.Name, tc.Mode, err.Error())
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.Expected) {
+			t.Errorf("expected error %q for %s with mode %04o, but got %q", tc.Expected, tc.Name, tc.Mode, errs)
+		}
+	}
+}
+
+func TestVersionFormatting(t *testing.T) {
+	testCases := []struct {
+		Version  string
+		Release  uint
+		Epoch    uint
+		Native   bool
+		Expected string
+	}{
+		//revisioned versions
+		{"1.2.3", 4, 0, false, "1.2.3-4"},
+		{"1.2-rc1", 1, 0, false, "1.2-rc1-1"},
+		{"1.2.3", 4, 2, false, "2:1.2.3-4"},
+		//native versions
+		{"1.2.3", 1, 0, true, "1.2.3"},
+		{"1.2.3", 1, 2, true, "2:1.2.3"},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage()
+		pkg.Version = tc.Version
+		pkg.Release = tc.Release
+		pkg.Epoch = tc.Epoch
+		g := &Generator{Package: pkg, Native: tc.Native}
+		if errs := g.Validate(); len(errs) > 0 {
+			t.Errorf("%s: unexpected validation errors: %q", tc.Expected, errs)
+			continue
+		}
+		_, err := g.Build()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		control := string(g.GeneratedControlFiles()["control"])
+		if !strings.Contains(control, "\nVersion: "+tc.Expected+"\n") {
+			t.Errorf("%s: unexpected control file: %q", tc.Expected, control)
+		}
+		if fileName := g.RecommendedFileName(); fileName != "foo_"+tc.Expected+"_all.deb" {
+			t.Errorf("%s: unexpected file name: %q", tc.Expected, fileName)
+		}
+	}
+}
+
+func TestValidateNativeVersion(t *testing.T) {
+	testCases := []struct {
+		Version  string
+		Release  uint
+		Expected string
+	}{
+		{"1.2-rc1", 1, `Package version "1.2-rc1" may not contain hyphens in native Debian packages`},
+		{"1.2.3", 2, "Package release 2 cannot be expressed in native Debian packages (must be 1)"},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage()
+		pkg.Version = tc.Version
+		pkg.Release = tc.Release
+		errs := (&Generator{Package: pkg, Native: true}).Validate()
+		if len(errs) != 1 || errs[0].Error() != tc.Expected {
+			t.Errorf("expected error %q, got %q", tc.Expected, errs)
+		}
+
+		//the same package is fine when it has a Debian revision
+		if errs := (&Generator{Package: pkg}).Validate(); len(errs) > 0 {
+			t.Errorf("%s-%d: unexpected validation errors: %q", tc.Version, tc.Release, errs)
+		}
+	}
+}
+
+func TestEmptyDirectoryIsExtracted(t *testing.T) {
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		t.Skip("dpkg-deb is not available")
+	}
+	pkg := makeTestPackage()
+	err := pkg.InsertFSNode("/var/lib/foo", &filesystem.Directory{Entries: map[string]filesystem.Node{}, Metadata: filesystem.NodeMetadata{Mode: 0750}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := (&Generator{Package: pkg}).Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tmpDir := t.TempDir()
+	debPath := filepath.Join(tmpDir, "foo.deb")
+	err = os.WriteFile(debPath, data, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	extractDir := filepath.Join(tmpDir, "root")
+	output, err := exec.Command("dpkg-deb", "--extract", debPath, extractDir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("dpkg-deb failed: %s: %s", err.Error(), output)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(extractDir, "var/lib/foo"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) > 0 {
+		t.Errorf("expected /var/lib/foo to be empty, but found %d entries", len(entries))
+	}
+}
+
+func TestEssentialWithoutMaintainerScripts(t *testing.T) {
+	expected := "package is marked as essential, but has no maintainer scripts"
+	pkg := makeTestPackage()
+	pkg.Essential = true
+	_, warnings := (&Generator{Package: pkg}).ValidateWithWarnings()
+	if len(warnings) != 1 || warnings[0].Error() != expected {
+		t.Errorf("expected warning %q, but got %q", expected, warnings)
+	}
+
+	//a debconf config script is a maintainer script as well
+	g := &Generator{
+		Package:             pkg,
+		DebconfTemplates:    []DebconfTemplate{{Name: "foo/question", Type: "boolean", Description: "Really?"}},
+		DebconfConfigScript: "db_input medium foo/question || true",
+	}
+	errs, warnings := g.ValidateWithWarnings()
+	if len(errs) > 0 || len(warnings) > 0 {
+		t.Errorf("unexpected errors %q and warnings %q", errs, warnings)
+	}
+}
@@ -0,0 +1,57 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+
+	build "github.com/holocm/libpackagebuild"
+)
+
+//PackagesEntry produces the stanza for the package built by the last call to
+//Build() in a repository's "Packages" index. The `debBytes` must be the
+//result of that Build(), and `filename` is the path of the package file
+//relative to the repository root (e.g. "pool/main/f/foo/foo_1.0-1_all.deb").
+//
+//The stanza consists of the fields from the package's control file, followed
+//by the Filename, Size and the MD5sum, SHA1 and SHA256 digests of the package
+//file. If Build() has not been called successfully yet, build.ErrNotBuilt is
+//returned.
+func (g *Generator) PackagesEntry(debBytes []byte, filename string) ([]byte, error) {
+	control, exists := g.controlFiles["control"]
+	if !exists {
+		return nil, build.ErrNotBuilt
+	}
+	if strings.ContainsAny(filename, "\r\n") {
+		return nil, fmt.Errorf("invalid file name for Packages index: %q", filename)
+	}
+
+	checksums := build.ComputeChecksums(debBytes)
+	sha1sum := sha1.Sum(debBytes)
+	contents := strings.TrimSuffix(string(control), "\n") + "\n"
+	contents += fmt.Sprintf("Filename: %s\n", filename)
+	contents += fmt.Sprintf("Size: %d\n", len(debBytes))
+	contents += fmt.Sprintf("MD5sum: %s\n", checksums["md5"])
+	contents += fmt.Sprintf("SHA1: %x\n", sha1sum)
+	contents += fmt.Sprintf("SHA256: %s\n", checksums["sha256"])
+	return []byte(contents), nil
+}
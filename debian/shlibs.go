@@ -0,0 +1,103 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package debian
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+var (
+	//matches sonames like "libfoo.so.1" (library name "libfoo", version "1")
+	sonameWithSuffixVersionRx = regexp.MustCompile(`^(.+)\.so\.([^/]+)$`)
+	//matches sonames like "libfoo-1.2.so" (library name "libfoo", version "1.2")
+	sonameWithInfixVersionRx = regexp.MustCompile(`^(.+)-([0-9][^/-]*)\.so$`)
+)
+
+//writeShlibsFile writes the "shlibs" control file that maps the sonames in
+//pkg.ProvidedLibraries to a dependency on this package (in the given full
+//version or newer), see [Debian Policy, 8.6.4]. If findLibraries is true, the
+//same is done for all shared libraries in this package that are in the
+//directories searched by the dynamic linker. No file is written if there are
+//no such libraries.
+func writeShlibsFile(pkg *build.Package, version string, controlDir *filesystem.Directory, findLibraries bool) error {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, soname := range pkg.ProvidedLibraries {
+		name, soversion, ok := build.SplitSoname(soname)
+		if !ok || seen[soname] {
+			continue //invalid sonames are rejected by Validate()
+		}
+		seen[soname] = true
+		lines = append(lines, fmt.Sprintf("%s %s %s (>= %s)\n",
+			name, soversion, pkg.Name, version))
+	}
+
+	var libs []build.SharedLibrary
+	if findLibraries {
+		var err error
+		libs, err = build.FindSharedLibraries(pkg.FSRoot)
+		if err != nil {
+			return err
+		}
+	}
+	for _, lib := range libs {
+		if !isLinkerSearchPath(path.Dir(lib.Path)) || seen[lib.Soname] {
+			continue
+		}
+		seen[lib.Soname] = true
+
+		var match []string
+		if match = sonameWithSuffixVersionRx.FindStringSubmatch(lib.Soname); match == nil {
+			match = sonameWithInfixVersionRx.FindStringSubmatch(lib.Soname)
+		}
+		if match == nil {
+			continue //unversioned libraries cannot be described in shlibs files
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s (>= %s)\n",
+			match[1], match[2], pkg.Name, version))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	controlDir.Entries["shlibs"] = &filesystem.RegularFile{
+		Content:  strings.Join(lines, ""),
+		Metadata: filesystem.NodeMetadata{Mode: 0644},
+	}
+	return nil
+}
+
+//isLinkerSearchPath returns whether the dynamic linker searches the given
+//directory for libraries by default (including multiarch directories like
+//"/usr/lib/x86_64-linux-gnu").
+func isLinkerSearchPath(dir string) bool {
+	switch dir {
+	case "/lib", "/lib64", "/usr/lib", "/usr/lib64":
+		return true
+	}
+	parent, base := path.Split(dir)
+	return (parent == "/lib/" || parent == "/usr/lib/") && strings.Contains(base, "-linux-")
+}
@@ -0,0 +1,219 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//SplitDebugInfo moves the debug information from all ELF binaries in the
+//given package into a separate debug package with the given name (e.g.
+//"foo-debug" or "foo-dbgsym"), following the usual distribution conventions:
+//The binaries in the original package are stripped of their debug sections,
+//and the debug sections are placed in the debug package at
+//"/usr/lib/debug/.build-id/xx/yyyyyyyy.debug", where "xxyyyyyyyy" is the
+//build ID of the binary. Binaries without a build ID or without debug
+//information are left unchanged.
+//
+//The debug package inherits the version, architecture and author of the
+//original package, and requires the exact same version of it. If no debug
+//information was found, nil is returned instead of a debug package.
+//
+//This uses the "objcopy" program from GNU binutils.
+func SplitDebugInfo(pkg *Package, debugPkgName string) (*Package, error) {
+	debugRoot := filesystem.NewDirectory()
+	debugRoot.DirDefaults = pkg.FSRoot.DirDefaults
+	debugRoot.FileDefaults = pkg.FSRoot.FileDefaults
+	found := false
+
+	binaries, err := findELFBinaries(pkg.FSRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, binary := range binaries {
+		relPath := strings.TrimPrefix(binary.Path, "/")
+		node := pkg.FSRoot.Lookup(relPath)
+		var (
+			content  []byte
+			metadata filesystem.NodeMetadata
+		)
+		switch n := node.(type) {
+		case *filesystem.RegularFile:
+			content, metadata = []byte(n.Content), n.Metadata
+		case *filesystem.ReaderFile:
+			content, err = readELFCandidate(n)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %s", binary.Path, err.Error())
+			}
+			metadata = n.Metadata
+		default:
+			continue
+		}
+
+		buildID, hasDebugInfo, err := inspectDebugInfo(content)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %s", binary.Path, err.Error())
+		}
+		if len(buildID) < 3 || !hasDebugInfo {
+			continue
+		}
+
+		stripped, debugInfo, err := splitDebugSections(content)
+		if err != nil {
+			return nil, fmt.Errorf("cannot split debug information from %s: %s", binary.Path, err.Error())
+		}
+		debugPath := fmt.Sprintf("usr/lib/debug/.build-id/%s/%s.debug", buildID[:2], buildID[2:])
+		//two binaries with the same build ID are identical, so ship only one debug file
+		if !debugRoot.Contains(debugPath) {
+			err = debugRoot.AddFile(debugPath, &filesystem.RegularFile{
+				Content:  string(debugInfo),
+				Metadata: debugRoot.GeneratedFileMetadata(),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		parent, _ := pkg.FSRoot.Lookup(path.Dir(relPath)).(*filesystem.Directory)
+		if parent == nil {
+			continue //unreachable, since the binary was found within FSRoot
+		}
+		parent.Entries[path.Base(relPath)] = &filesystem.RegularFile{Content: string(stripped), Metadata: metadata}
+		found = true
+	}
+
+	if !found {
+		return nil, nil
+	}
+	pkg.FSRoot.RecomputeSize()
+
+	version := fmt.Sprintf("%s-%d", pkg.Version, pkg.Release)
+	if pkg.Epoch > 0 {
+		version = fmt.Sprintf("%d:%s", pkg.Epoch, version)
+	}
+	return &Package{
+		Name:              debugPkgName,
+		Version:           pkg.Version,
+		Release:           pkg.Release,
+		Epoch:             pkg.Epoch,
+		Description:       fmt.Sprintf("Debug symbols for %s", pkg.Name),
+		Author:            pkg.Author,
+		Maintainer:        pkg.Maintainer,
+		Vendor:            pkg.Vendor,
+		Source:            pkg.Source,
+		Architecture:      pkg.Architecture,
+		ArchitectureInput: pkg.ArchitectureInput,
+		Requires: []PackageRelation{{
+			RelatedPackage: pkg.Name,
+			Constraints:    []VersionConstraint{{Relation: "=", Version: version}},
+		}},
+		FSRoot:             debugRoot,
+		ForceRootOwnership: pkg.ForceRootOwnership,
+	}, nil
+}
+
+//inspectDebugInfo returns the GNU build ID of the given ELF binary (as a hex
+//string, or empty if there is none), and whether it contains debug sections.
+func inspectDebugInfo(content []byte) (buildID string, hasDebugInfo bool, err error) {
+	f, err := elf.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	for _, section := range f.Sections {
+		if strings.HasPrefix(section.Name, ".debug_") || strings.HasPrefix(section.Name, ".zdebug_") {
+			hasDebugInfo = true
+		}
+	}
+
+	section := f.Section(".note.gnu.build-id")
+	if section == nil {
+		return "", hasDebugInfo, nil
+	}
+	note, err := section.Data()
+	if err != nil {
+		return "", hasDebugInfo, err
+	}
+	//note layout: namesz, descsz, type (4 bytes each), name (padded to 4 bytes), desc
+	if len(note) < 12 {
+		return "", hasDebugInfo, nil
+	}
+	nameSize := int(f.ByteOrder.Uint32(note[0:4]))
+	descSize := int(f.ByteOrder.Uint32(note[4:8]))
+	descOffset := 12 + (nameSize+3)/4*4
+	if len(note) < descOffset+descSize {
+		return "", hasDebugInfo, nil
+	}
+	return hex.EncodeToString(note[descOffset : descOffset+descSize]), hasDebugInfo, nil
+}
+
+//splitDebugSections uses objcopy to produce a copy of the given binary
+//without debug sections, and a separate file containing only the debug
+//sections.
+func splitDebugSections(content []byte) (stripped, debugInfo []byte, err error) {
+	tempDir, err := ioutil.TempDir("", "libpackagebuild-debuginfo-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	binaryPath := filepath.Join(tempDir, "binary")
+	debugPath := filepath.Join(tempDir, "binary.debug")
+	err = ioutil.WriteFile(binaryPath, content, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, args := range [][]string{
+		{"--only-keep-debug", binaryPath, debugPath},
+		{"--strip-debug", binaryPath},
+	} {
+		var stderr bytes.Buffer
+		cmd := exec.Command("objcopy", args...)
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				return nil, nil, fmt.Errorf("objcopy %s failed: %s", args[0], err.Error())
+			}
+			return nil, nil, fmt.Errorf("objcopy %s failed: %s", args[0], strings.Replace(msg, "\n", " ", -1))
+		}
+	}
+
+	stripped, err = ioutil.ReadFile(binaryPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	debugInfo, err = ioutil.ReadFile(debugPath)
+	return stripped, debugInfo, err
+}
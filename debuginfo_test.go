@@ -0,0 +1,40 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestSplitDebugSectionsReportsErrors(t *testing.T) {
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy is not available")
+	}
+	_, _, err := splitDebugSections([]byte("not an ELF file"))
+	if err == nil {
+		t.Fatal("expected error for invalid input, but got none")
+	}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "objcopy --only-keep-debug failed: ") || strings.HasSuffix(msg, "exit status 1") {
+		t.Errorf("expected error to include the output of objcopy, but got: %s", msg)
+	}
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"path"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//DocFile is a documentation or license file in Package.DocFiles.
+type DocFile struct {
+	//Name is the file name (without any directory).
+	Name    string
+	Content string
+	//License is true for license files, and false for other documentation.
+	License bool
+}
+
+//Conventional locations for DocFiles, as accepted by InsertDocFiles().
+const (
+	//DocDirectory is where all package formats install documentation.
+	DocDirectory = "usr/share/doc"
+	//LicenseDirectory is where pacman and RPM install license files. (Debian
+	//installs them in DocDirectory.)
+	LicenseDirectory = "usr/share/licenses"
+)
+
+//AddDoc adds a documentation file (e.g. a README) to the package. It will be
+//installed as /usr/share/doc/$NAME/$FILENAME, where $NAME is the package
+//name at the time of the build, and is marked as %doc in RPM packages.
+func (p *Package) AddDoc(name string, content []byte) {
+	p.DocFiles = append(p.DocFiles, DocFile{Name: name, Content: string(content)})
+}
+
+//AddLicenseFile adds a license file to the package. It will be installed as
+///usr/share/licenses/$NAME/$FILENAME for pacman and RPM (where it is marked
+//as %license), and as /usr/share/doc/$NAME/$FILENAME for Debian.
+func (p *Package) AddLicenseFile(name string, content []byte) {
+	p.DocFiles = append(p.DocFiles, DocFile{Name: name, Content: string(content), License: true})
+}
+
+//DocFilePath returns the path (relative to the FSRoot) where InsertDocFiles()
+//places the given file, for a package format that installs license files
+//below the given licenseDirectory.
+func (p *Package) DocFilePath(doc DocFile, licenseDirectory string) string {
+	dir := DocDirectory
+	if doc.License {
+		dir = licenseDirectory
+	}
+	return path.Join(dir, p.Name, doc.Name)
+}
+
+//InsertDocFiles inserts all DocFiles into the FSRoot (see DocFilePath). This
+//should be called by each generator's Build() implementation after
+//PrepareBuild(). Files that have already been inserted by a previous call (on
+//the same package) are skipped.
+func (p *Package) InsertDocFiles(licenseDirectory string) error {
+	for _, doc := range p.DocFiles {
+		relPath := p.DocFilePath(doc, licenseDirectory)
+		if file, ok := p.FSRoot.Lookup(relPath).(*filesystem.RegularFile); ok && file.Content == doc.Content {
+			continue
+		}
+		err := p.InsertFSNode("/"+relPath, &filesystem.RegularFile{
+			Content:  doc.Content,
+			Metadata: p.FSRoot.GeneratedFileMetadata(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//validateDocFiles checks that all DocFiles have plain file names.
+func (p *Package) validateDocFiles(ec *errorCollector) {
+	for _, doc := range p.DocFiles {
+		if doc.Name == "" || doc.Name == "." || doc.Name == ".." || path.Base(doc.Name) != doc.Name {
+			ec.Addf("Documentation file name \"%s\" is invalid (must be a file name without directory)", doc.Name)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//archNames contains human-readable names for architectures, for use in error
+//messages.
+var archNames = map[Architecture]string{
+	ArchitectureAny:      "any",
+	ArchitectureI386:     "i386",
+	ArchitectureX86_64:   "x86_64",
+	ArchitectureARMv5:    "armv5",
+	ArchitectureARMv6h:   "armv6h",
+	ArchitectureARMv7h:   "armv7h",
+	ArchitectureAArch64:  "aarch64",
+	ArchitectureARMv7:    "armv7",
+	ArchitectureMIPS:     "mips",
+	ArchitectureMIPS64EL: "mips64el",
+	ArchitectureLoong64:  "loong64",
+}
+
+//elfBinary describes an ELF binary found in a package.
+type elfBinary struct {
+	Path string
+	//Machine describes the machine type, e.g. "EM_X86_64 (ELFCLASS64 ELFDATA2LSB)".
+	Machine string
+	//Architectures contains all architectures that the binary can run on.
+	//This can have more than one entry since e.g. ARM sub-architectures are
+	//not distinguished by the ELF header.
+	Architectures []Architecture
+	//Soname is the DT_SONAME of shared libraries, or empty.
+	Soname string
+	//Needed contains the DT_NEEDED entries, i.e. the sonames of the shared
+	//libraries that this binary links against.
+	Needed []string
+}
+
+//SharedLibrary describes a shared library found by FindSharedLibraries().
+type SharedLibrary struct {
+	//Path is the absolute path of the library in the package, e.g.
+	//"/usr/lib/libfoo.so.1.2.3".
+	Path string
+	//Soname is the DT_SONAME of the library, e.g. "libfoo.so.1".
+	Soname string
+}
+
+//versionedSonameRx matches sonames like "libfoo.so.1.2" (see SplitSoname).
+var versionedSonameRx = regexp.MustCompile(`^([^/\s]+)\.so\.([0-9][^/\s]*)$`)
+
+//SplitSoname splits a versioned soname like "libfoo.so.1.2" into the library
+//name ("libfoo") and the version ("1.2"). If the soname does not have this
+//form, ok is false.
+func SplitSoname(soname string) (name, version string, ok bool) {
+	match := versionedSonameRx.FindStringSubmatch(soname)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+//FindSharedLibraries returns all ELF shared libraries below the given
+//directory that declare a soname, sorted by path.
+func FindSharedLibraries(root *filesystem.Directory) ([]SharedLibrary, error) {
+	binaries, err := findELFBinaries(root)
+	if err != nil {
+		return nil, err
+	}
+	var result []SharedLibrary
+	for _, binary := range binaries {
+		if binary.Soname != "" {
+			result = append(result, SharedLibrary{Path: binary.Path, Soname: binary.Soname})
+		}
+	}
+	return result, nil
+}
+
+//DetectArchitecture inspects the ELF binaries (executables, shared libraries
+//and object files) below the given directory, and returns the architecture
+//that they were compiled for. An error is returned if the binaries disagree
+//about the architecture, if the architecture cannot be determined
+//unambiguously, or if there are no ELF binaries at all (in which case
+//ArchitectureAny is probably the right choice).
+func DetectArchitecture(root *filesystem.Directory) (Architecture, error) {
+	binaries, err := findELFBinaries(root)
+	if err != nil {
+		return ArchitectureAny, err
+	}
+	if len(binaries) == 0 {
+		return ArchitectureAny, fmt.Errorf("no ELF binaries found (use architecture %q for packages without compiled binaries)", archNames[ArchitectureAny])
+	}
+
+	//find the architectures that all binaries can run on
+	for _, binary := range binaries {
+		if len(binary.Architectures) == 0 {
+			return ArchitectureAny, fmt.Errorf("%s has unsupported machine type %s", binary.Path, binary.Machine)
+		}
+	}
+	candidates := binaries[0].Architectures
+	for _, binary := range binaries[1:] {
+		var remaining []Architecture
+		for _, arch := range candidates {
+			if binary.canRunOn(arch) {
+				remaining = append(remaining, arch)
+			}
+		}
+		if len(remaining) == 0 {
+			return ArchitectureAny, fmt.Errorf("ELF binaries disagree about architecture: %s is %s, but %s is %s",
+				binaries[0].Path, binaries[0].Machine, binary.Path, binary.Machine)
+		}
+		candidates = remaining
+	}
+
+	if len(candidates) > 1 {
+		names := make([]string, len(candidates))
+		for idx, arch := range candidates {
+			names[idx] = archNames[arch]
+		}
+		return ArchitectureAny, fmt.Errorf("cannot distinguish between architectures %s for %s binaries (set the architecture explicitly)",
+			strings.Join(names, ", "), binaries[0].Machine)
+	}
+	return candidates[0], nil
+}
+
+//Unresolved describes a shared library dependency that could not be resolved
+//by CheckUnresolvedLibraries().
+type Unresolved struct {
+	//Path is the absolute path of the binary in the package.
+	Path string
+	//Soname is the soname of the library that the binary links against.
+	Soname string
+}
+
+//CheckUnresolvedLibraries reads the DT_NEEDED entries of all ELF binaries in
+//the package, and reports those libraries that are provided neither by a
+//shared library within the package nor by the callback. The callback
+//usually resolves sonames against the packages in Requires, e.g. using a
+//repository index. If it is nil, all libraries that are not in the package
+//are reported. The result is sorted by path.
+func CheckUnresolvedLibraries(pkg *Package, providedBy func(soname string) bool) ([]Unresolved, error) {
+	binaries, err := findELFBinaries(pkg.FSRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	provided := make(map[string]bool)
+	for _, binary := range binaries {
+		if binary.Soname != "" {
+			provided[binary.Soname] = true
+		}
+	}
+
+	var result []Unresolved
+	for _, binary := range binaries {
+		for _, soname := range binary.Needed {
+			if provided[soname] || (providedBy != nil && providedBy(soname)) {
+				continue
+			}
+			result = append(result, Unresolved{Path: binary.Path, Soname: soname})
+		}
+	}
+	return result, nil
+}
+
+//validateELFArchitecture checks that all ELF binaries in the package match the
+//declared architecture.
+func (pkg *Package) validateELFArchitecture(ec *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	binaries, err := findELFBinaries(pkg.FSRoot)
+	if err != nil {
+		ec.Add(err)
+		return
+	}
+
+	archName := pkg.ArchitectureInput
+	if archName == "" {
+		archName = archNames[pkg.Architecture]
+	}
+	for _, binary := range binaries {
+		if !binary.canRunOn(pkg.Architecture) {
+			ec.Addf("File \"%s\" is an ELF binary for %s, which does not match the package architecture \"%s\"",
+				binary.Path, binary.Machine, archName)
+		}
+	}
+}
+
+func (b elfBinary) canRunOn(arch Architecture) bool {
+	for _, a := range b.Architectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+//findELFBinaries returns all ELF binaries below the given directory, sorted
+//by path.
+func findELFBinaries(root *filesystem.Directory) ([]elfBinary, error) {
+	var result []elfBinary
+	err := root.Walk("/", func(path string, node filesystem.Node) error {
+		var data []byte
+		switch n := node.(type) {
+		case *filesystem.RegularFile:
+			data = []byte(n.Content)
+		case *filesystem.ReaderFile:
+			var err error
+			data, err = readELFCandidate(n)
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %s", path, err.Error())
+			}
+		default:
+			return nil
+		}
+		if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+			return nil
+		}
+
+		f, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			//not a valid ELF file, even though it looks like one
+			return nil
+		}
+		defer f.Close()
+		binary := elfBinary{
+			Path:          path,
+			Machine:       fmt.Sprintf("%s (%s %s)", f.Machine, f.Class, f.Data),
+			Architectures: elfArchitectures(f, data),
+		}
+		if f.Type == elf.ET_DYN {
+			sonames, err := f.DynString(elf.DT_SONAME)
+			if err == nil && len(sonames) > 0 {
+				binary.Soname = sonames[0]
+			}
+		}
+		if needed, err := f.ImportedLibraries(); err == nil {
+			binary.Needed = needed
+		}
+		result = append(result, binary)
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, err
+}
+
+//readELFCandidate reads the full contents of a ReaderFile only if it starts
+//with the ELF magic number, to avoid loading unrelated large files into
+//memory.
+func readELFCandidate(f *filesystem.ReaderFile) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = io.ReadFull(r, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && string(magic) != elf.ELFMAG) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rest, err := ioutil.ReadAll(r)
+	return append(magic, rest...), err
+}
+
+//elfArchitectures returns the architectures that the given ELF file can run
+//on, or nil if the machine type is not supported.
+func elfArchitectures(f *elf.File, data []byte) []Architecture {
+	is64 := f.Class == elf.ELFCLASS64
+	isLE := f.Data == elf.ELFDATA2LSB
+
+	switch f.Machine {
+	case elf.EM_386:
+		return []Architecture{ArchitectureI386}
+	case elf.EM_X86_64:
+		if is64 {
+			return []Architecture{ArchitectureX86_64}
+		}
+	case elf.EM_AARCH64:
+		if is64 {
+			return []Architecture{ArchitectureAArch64}
+		}
+	case elf.EM_ARM:
+		//the ELF header does not tell us the ARM revision, only the float ABI
+		const efARMABIFloatHard = 0x400
+		if elfFlags(f, data)&efARMABIFloatHard != 0 {
+			return []Architecture{ArchitectureARMv6h, ArchitectureARMv7h}
+		}
+		return []Architecture{ArchitectureARMv5, ArchitectureARMv7}
+	case elf.EM_MIPS:
+		if !is64 && !isLE {
+			return []Architecture{ArchitectureMIPS}
+		}
+		if is64 && isLE {
+			return []Architecture{ArchitectureMIPS64EL}
+		}
+	case elf.EM_LOONGARCH:
+		if is64 {
+			return []Architecture{ArchitectureLoong64}
+		}
+	}
+	return nil
+}
+
+//elfFlags returns the e_flags field of the ELF header, which is not exposed
+//by package debug/elf.
+func elfFlags(f *elf.File, data []byte) uint32 {
+	offset := 36 //for ELFCLASS32
+	if f.Class == elf.ELFCLASS64 {
+		offset = 48
+	}
+	if len(data) < offset+4 {
+		return 0
+	}
+	return f.ByteOrder.Uint32(data[offset : offset+4])
+}
@@ -0,0 +1,66 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+//Clone returns a deep copy of this directory and all its entries, so that
+//the copy can be modified without affecting the original. The only things
+//shared between both copies are the Data of TemplateFile instances and the
+//Open callbacks of ReaderFile instances.
+func (d *Directory) Clone() *Directory {
+	result := &Directory{
+		Entries:         make(map[string]Node, len(d.Entries)),
+		Metadata:        d.Metadata.clone(),
+		Implicit:        d.Implicit,
+		cachedSize:      d.cachedSize,
+		cachedSizeValid: d.cachedSizeValid,
+	}
+	if d.DirDefaults != nil {
+		defaults := d.DirDefaults.clone()
+		result.DirDefaults = &defaults
+	}
+	if d.FileDefaults != nil {
+		defaults := d.FileDefaults.clone()
+		result.FileDefaults = &defaults
+	}
+	for name, entry := range d.Entries {
+		result.Entries[name] = cloneNode(entry)
+	}
+	return result
+}
+
+func cloneNode(node Node) Node {
+	switch n := node.(type) {
+	case *Directory:
+		return n.Clone()
+	case *RegularFile:
+		return &RegularFile{Content: n.Content, Metadata: n.Metadata.clone()}
+	case *ReaderFile:
+		return &ReaderFile{Open: n.Open, Size: n.Size, Metadata: n.Metadata.clone()}
+	case *TemplateFile:
+		return &TemplateFile{Template: n.Template, Data: n.Data, Metadata: n.Metadata.clone()}
+	case *Symlink:
+		return &Symlink{Target: n.Target, Dangling: n.Dangling}
+	case *Hardlink:
+		return &Hardlink{Target: n.Target}
+	default:
+		//unknown node types are assumed to be immutable
+		return node
+	}
+}
@@ -0,0 +1,195 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+//Compressor is a compression format for tar archives (see
+//ToCompressedTarArchive). Besides the implementations in this package,
+//callers can provide their own compressors for other formats.
+type Compressor interface {
+	//Wrap returns a writer that compresses everything written into it, and
+	//writes the compressed data into the given writer. The compressed data is
+	//only complete after Close() has returned without error. Close() must not
+	//close the underlying writer.
+	Wrap(w io.Writer) (io.WriteCloser, error)
+	//Extension returns the file name extension for this format, including
+	//the leading dot (e.g. ".xz").
+	Extension() string
+}
+
+//XZCompressor is a Compressor for the XZ format. Since there is no
+//"compress/xz" package, it uses the "xz" program.
+type XZCompressor struct {
+	//MemoryLimit, if not zero, limits the memory usage of xz to the given
+	//number of bytes (see TarOptions.XZMemoryLimit).
+	MemoryLimit int
+	//Format, if not empty, is passed to xz as --format (e.g. "lzma" for the
+	//legacy LZMA format used by RPM payloads).
+	Format string
+}
+
+//Wrap implements the Compressor interface.
+func (c XZCompressor) Wrap(w io.Writer) (io.WriteCloser, error) {
+	args := []string{"--compress"}
+	if c.Format != "" {
+		args = append(args, "--format="+c.Format)
+	}
+	if c.MemoryLimit > 0 {
+		args = append(args, fmt.Sprintf("--memlimit-compress=%d", c.MemoryLimit))
+	}
+	return startCompressor(w, "xz", args...)
+}
+
+//Extension implements the Compressor interface.
+func (c XZCompressor) Extension() string {
+	return ".xz"
+}
+
+//ZstdCompressor is a Compressor for the Zstandard format. Since there is no
+//"compress/zstd" package, it uses the "zstd" program.
+type ZstdCompressor struct {
+	Options ZstdOptions
+}
+
+//Wrap implements the Compressor interface.
+func (c ZstdCompressor) Wrap(w io.Writer) (io.WriteCloser, error) {
+	args, err := c.Options.args()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--compress", "--quiet", "--stdout")
+	return startCompressor(w, "zstd", args...)
+}
+
+//Extension implements the Compressor interface.
+func (c ZstdCompressor) Extension() string {
+	return ".zst"
+}
+
+//GzipCompressor is a Compressor for the GZip format. It uses NewGzipWriter,
+//so the result does not contain any timestamps.
+type GzipCompressor struct{}
+
+//Wrap implements the Compressor interface.
+func (c GzipCompressor) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return NewGzipWriter(w), nil
+}
+
+//Extension implements the Compressor interface.
+func (c GzipCompressor) Extension() string {
+	return ".gz"
+}
+
+//NoCompressor is a Compressor that does not compress at all.
+type NoCompressor struct{}
+
+//Wrap implements the Compressor interface.
+func (c NoCompressor) Wrap(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+//Extension implements the Compressor interface.
+func (c NoCompressor) Extension() string {
+	return ""
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+//ToCompressedTarArchive is identical to ToTarArchive, but compresses the
+//result with the given compressor. If the compressor is nil, XZCompressor is
+//used with the XZMemoryLimit from the TarOptions. The size of the
+//uncompressed archive is returned.
+func (d *Directory) ToCompressedTarArchive(w io.Writer, c Compressor, opts TarOptions) (int64, error) {
+	if c == nil {
+		c = XZCompressor{MemoryLimit: opts.XZMemoryLimit}
+	}
+	wc, err := c.Wrap(w)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{Writer: wc}
+	err = d.ToTarArchive(cw, opts)
+	closeErr := wc.Close()
+	//when the compressor fails, writing into it fails as well, but the error
+	//from Close() is more useful
+	if closeErr != nil {
+		return 0, closeErr
+	}
+	return cw.Count, err
+}
+
+//commandWriter is the io.WriteCloser returned by startCompressor.
+type commandWriter struct {
+	program string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stderr  bytes.Buffer
+}
+
+//startCompressor starts the given compression program as a filter into the
+//given writer. Its error output is included in the error returned by Close().
+func startCompressor(w io.Writer, program string, args ...string) (io.WriteCloser, error) {
+	cw := &commandWriter{program: program, cmd: exec.Command(program, args...)}
+	cw.cmd.Stdout = w
+	cw.cmd.Stderr = &cw.stderr
+	var err error
+	cw.stdin, err = cw.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cw.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s", program, err.Error())
+	}
+	return cw, nil
+}
+
+//Write implements the io.Writer interface.
+func (cw *commandWriter) Write(buf []byte) (int, error) {
+	return cw.stdin.Write(buf)
+}
+
+//Close implements the io.Closer interface.
+func (cw *commandWriter) Close() error {
+	cw.stdin.Close()
+	err := cw.cmd.Wait()
+	if err != nil {
+		msg := strings.TrimSpace(cw.stderr.String())
+		if msg == "" {
+			return fmt.Errorf("%s failed: %s", cw.program, err.Error())
+		}
+		return fmt.Errorf("%s failed: %s", cw.program, strings.Replace(msg, "\n", " ", -1))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"path"
+	"strings"
+)
+
+//MatchGlob reports whether the given relative path (without leading slash,
+//e.g. "usr/share/doc/foo/README") matches the given pattern. Patterns use
+//the syntax of path.Match() for each path element, and additionally, an
+//element "**" matches any number of path elements (including zero). For
+//example, "usr/share/doc/**" matches "usr/share/doc" and everything below it,
+//and "**/*.a" matches all files with the extension ".a".
+//
+//The only possible returned error is path.ErrBadPattern, when the pattern is
+//malformed.
+func MatchGlob(pattern, relPath string) (bool, error) {
+	return matchGlobElements(
+		strings.Split(strings.Trim(pattern, "/"), "/"),
+		strings.Split(strings.Trim(relPath, "/"), "/"),
+	)
+}
+
+func matchGlobElements(pattern, names []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			//try to match the rest of the pattern at every possible position
+			for idx := 0; idx <= len(names); idx++ {
+				ok, err := matchGlobElements(pattern[1:], names[idx:])
+				if ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], names[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
+
+func matchAnyGlob(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		//malformed patterns do not match anything
+		if ok, _ := MatchGlob(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Select returns the paths (relative to this directory, without leading
+//slash) of all nodes below this directory that match at least one of the
+//given patterns (see MatchGlob for the pattern syntax). Paths are returned in
+//the same order in which Walk() visits them.
+func (d *Directory) Select(patterns ...string) []string {
+	var result []string
+	d.Walk("", func(relPath string, node Node) error {
+		if relPath != "" && matchAnyGlob(patterns, relPath) {
+			result = append(result, relPath)
+		}
+		return nil
+	})
+	return result
+}
+
+//Remove removes all nodes below this directory that match at least one of the
+//given patterns (see MatchGlob for the pattern syntax), including everything
+//below them. Returns the number of nodes that were removed (not including
+//nodes below removed directories).
+func (d *Directory) Remove(patterns ...string) int {
+	return d.Filter(func(relPath string, node Node) bool {
+		return !matchAnyGlob(patterns, relPath)
+	}, false)
+}
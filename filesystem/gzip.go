@@ -0,0 +1,94 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"fmt"
+	"io"
+)
+
+//GzipContent returns a ReaderFile containing the gzip-compressed contents of
+//the given file (which must be a RegularFile or ReaderFile), with the same
+//metadata. The compressed contents are reproducible (see NewGzipWriter).
+//
+//The contents are compressed on the fly whenever the ReaderFile is read (e.g.
+//while the archive is written), so they are never held in memory. Since the
+//compressed size must be known in advance, GzipContent compresses the
+//contents once to determine it. For a ReaderFile, the inner file is thus read
+//once by GzipContent, and once more for each read of the result.
+//
+//This can be used e.g. to ship "foo.1.gz" without having a compressed copy
+//of "foo.1" on disk:
+//
+//    node, err := filesystem.GzipContent(&filesystem.RegularFile{Content: manpage})
+//    err = pkg.InsertFSNode("/usr/share/man/man1/foo.1.gz", node)
+//
+func GzipContent(inner Node) (*ReaderFile, error) {
+	var (
+		write    func(w io.Writer) error
+		metadata NodeMetadata
+	)
+	switch n := inner.(type) {
+	case *RegularFile:
+		content := n.Content
+		write = func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+		metadata = n.Metadata
+	case *ReaderFile:
+		write = func(w io.Writer) error {
+			_, err := n.WriteTo(w)
+			return err
+		}
+		metadata = n.Metadata
+	default:
+		return nil, fmt.Errorf("cannot compress %T (only regular files can be compressed)", inner)
+	}
+
+	compress := func(w io.Writer) error {
+		gzw := NewGzipWriter(w)
+		err := write(gzw)
+		if err != nil {
+			gzw.Close()
+			return err
+		}
+		return gzw.Close()
+	}
+
+	cw := countingWriter{Writer: io.Discard}
+	err := compress(&cw)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderFile{
+		Open: func() (io.ReadCloser, error) {
+			//if the reader is closed early, the next write into the pipe fails
+			//and the goroutine exits
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(compress(pw))
+			}()
+			return pr, nil
+		},
+		Size:     cw.Count,
+		Metadata: metadata,
+	}, nil
+}
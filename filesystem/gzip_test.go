@@ -0,0 +1,142 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGzipContent(t *testing.T) {
+	content := strings.Repeat("foo bar baz\n", 1000)
+	opened := 0
+	inputs := []Node{
+		&RegularFile{Content: content, Metadata: NodeMetadata{Mode: 0644}},
+		&ReaderFile{
+			Open: func() (io.ReadCloser, error) {
+				opened++
+				return io.NopCloser(strings.NewReader(content)), nil
+			},
+			Size:     int64(len(content)),
+			Metadata: NodeMetadata{Mode: 0644},
+		},
+	}
+
+	var results [][]byte
+	for _, input := range inputs {
+		node, err := GzipContent(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Metadata.Mode != 0644 {
+			t.Errorf("expected mode 0644, but got %o", node.Metadata.Mode)
+		}
+
+		//reading twice must yield identical results of the announced size
+		var first, second bytes.Buffer
+		_, err = node.WriteTo(&first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = node.WriteTo(&second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Error("compressed contents are not reproducible")
+		}
+		if int64(first.Len()) != node.Size || node.Size >= int64(len(content)) {
+			t.Errorf("expected %d compressed bytes (less than %d), but got %d", node.Size, len(content), first.Len())
+		}
+
+		gzr, err := gzip.NewReader(&first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(gzr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decompressed) != content {
+			t.Error("decompressed contents differ from input")
+		}
+		results = append(results, second.Bytes())
+	}
+
+	if !bytes.Equal(results[0], results[1]) {
+		t.Error("compressed contents differ between RegularFile and ReaderFile")
+	}
+	//the ReaderFile is read once by GzipContent, and once for each WriteTo
+	if opened != 3 {
+		t.Errorf("expected the ReaderFile to be opened 3 times, but got %d", opened)
+	}
+}
+
+func TestGzipContentEarlyClose(t *testing.T) {
+	node, err := GzipContent(&RegularFile{Content: strings.Repeat("x", 1<<20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := node.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Read(make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGzipContentRejectsNonFiles(t *testing.T) {
+	_, err := GzipContent(&Symlink{Target: "foo"})
+	if err == nil {
+		t.Error("expected error when compressing a symlink, but got none")
+	}
+}
+
+func TestNewGzipWriterIsReproducible(t *testing.T) {
+	var archives [][]byte
+	for idx := 0; idx < 2; idx++ {
+		var buf bytes.Buffer
+		err := makeTestTree(t).ToTarGZArchive(&buf, TarOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, buf.Bytes())
+	}
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Error("compressing the same tree twice yielded different archives")
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(archives[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gzr.ModTime.IsZero() || gzr.OS != 255 || gzr.Name != "" || gzr.Comment != "" {
+		t.Errorf("unexpected gzip header: %#v", gzr.Header)
+	}
+}
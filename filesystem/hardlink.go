@@ -0,0 +1,103 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Hardlink is a type of Node that represents an additional name for a regular
+//file that appears elsewhere in the same directory tree. The Target is the
+//path of that file relative to the root directory (e.g. "usr/bin/foo").
+//
+//The hardlink shares the contents and metadata of its target, so it does not
+//contribute to the installed size. The target must be a RegularFile or
+//ReaderFile that comes before the hardlink in the order of Walk(), since
+//archive formats can only refer back to entries that were already written.
+type Hardlink struct {
+	Target string
+}
+
+//Insert implements the Node interface.
+func (h *Hardlink) Insert(entry Node, relPath []string, location string) error {
+	if len(relPath) == 0 {
+		return errors.New("duplicate entry")
+	}
+	return fmt.Errorf("%s is not a directory", location)
+}
+
+//InstalledSizeInBytes implements the Node interface.
+func (h *Hardlink) InstalledSizeInBytes() int64 {
+	return 0
+}
+
+//InstalledSizeOnDisk implements the Node interface.
+func (h *Hardlink) InstalledSizeOnDisk(blockSize int) int64 {
+	return 0
+}
+
+//FileModeForArchive implements the Node interface. Since the permissions of
+//a hardlink are those of its target, only the file type is reported. Use
+//ResolveHardlink() to obtain the target's permissions.
+func (h *Hardlink) FileModeForArchive(includingFileType bool) uint32 {
+	if includingFileType {
+		return 0100000
+	}
+	return 0
+}
+
+//Walk implements the Node interface.
+func (h *Hardlink) Walk(absolutePath string, callback func(string, Node) error) error {
+	return callback(absolutePath, h)
+}
+
+//PostponeUnmaterializable implements the Node interface.
+func (h *Hardlink) PostponeUnmaterializable(absolutePath string) string {
+	return ""
+}
+
+//ResolveHardlink returns the file that the given hardlink refers to, which is
+//looked up relative to this directory. It is an error if the target does not
+//exist or is not a RegularFile or ReaderFile.
+func (d *Directory) ResolveHardlink(h *Hardlink) (Node, error) {
+	target := strings.Join(splitRelativePath(h.Target), "/")
+	switch n := d.Lookup(target).(type) {
+	case *RegularFile, *ReaderFile:
+		return n, nil
+	case nil:
+		return nil, fmt.Errorf("hardlink target /%s does not exist", target)
+	default:
+		return nil, fmt.Errorf("hardlink target /%s is not a regular file", target)
+	}
+}
+
+//hardlinkMetadata returns the metadata of a node returned by ResolveHardlink.
+func hardlinkMetadata(target Node) NodeMetadata {
+	switch n := target.(type) {
+	case *RegularFile:
+		return n.Metadata
+	case *ReaderFile:
+		return n.Metadata
+	default:
+		return NodeMetadata{}
+	}
+}
@@ -0,0 +1,127 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//FromDirectory imports the directory tree at the given path on the build
+//system into a Directory. Regular files are read into RegularFile nodes,
+//symlinks become Symlink nodes, and directories become explicit Directory
+//nodes. Other file types (device nodes, FIFOs, sockets) are rejected.
+//
+//Permission bits (including setuid, setgid and sticky bits) are taken from
+//the filesystem, but ownership is not: All entries are owned by root:root so
+//that the result does not depend on the user running the build.
+//
+//Files with multiple names in the imported tree (i.e. the same device and
+//inode number) are imported only once: The first name in the order of Walk()
+//becomes a RegularFile, and all further names become Hardlink nodes pointing
+//to it.
+func FromDirectory(rootPath string) (*Directory, error) {
+	root := NewDirectory()
+	seen := make(map[fileID]string)
+
+	err := filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		metadata := NodeMetadata{Mode: importFileMode(fi.Mode())}
+
+		if relPath == "." {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", rootPath)
+			}
+			root.Metadata = metadata
+			return nil
+		}
+
+		var node Node
+		switch {
+		case fi.IsDir():
+			dir := NewDirectory()
+			dir.Metadata = metadata
+			node = dir
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			node = &Symlink{Target: target}
+		case fi.Mode().IsRegular():
+			if id, ok := fileIdentity(fi); ok {
+				if target, exists := seen[id]; exists {
+					node = &Hardlink{Target: target}
+					break
+				}
+				seen[id] = relPath
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			node = &RegularFile{Content: string(content), Metadata: metadata}
+		default:
+			return fmt.Errorf("cannot import %s: unsupported file type %s", path, fi.Mode().Type())
+		}
+
+		err = root.AddFile(relPath, node)
+		if err != nil {
+			return fmt.Errorf("cannot import %s: %s", path, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+//fileID identifies a file on the build system independently of its name.
+type fileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+//importFileMode converts the mode of a file on the build system into the
+//representation used by NodeMetadata.Mode (i.e. with the setuid, setgid and
+//sticky bits in their traditional positions).
+func importFileMode(mode os.FileMode) os.FileMode {
+	result := mode.Perm()
+	if mode&os.ModeSetuid != 0 {
+		result |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		result |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		result |= 01000
+	}
+	return result
+}
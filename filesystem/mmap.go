@@ -0,0 +1,78 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+//NewMappedFile returns a ReaderFile whose contents are read from the file at
+//the given path on the build system. When the contents are needed, the file is
+//memory-mapped (where supported), so that archivers can copy its contents
+//without intermediate buffers. If the file cannot be memory-mapped, it is read
+//through a regular buffered reader instead.
+//
+//The file's size is determined by this function, so the file must not change
+//until the package has been built.
+func NewMappedFile(path string, metadata NodeMetadata) (*ReaderFile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderFile{
+		Open:     func() (io.ReadCloser, error) { return openMapped(path) },
+		Size:     fi.Size(),
+		Metadata: metadata,
+	}, nil
+}
+
+func openMapped(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := mmapFile(f)
+	if err != nil {
+		//fall back to buffered reads
+		return f, nil
+	}
+	//the mapping stays valid after the file is closed
+	f.Close()
+	return &mappedReader{Reader: bytes.NewReader(data), data: data}, nil
+}
+
+//mappedReader reads from a memory-mapped file. Since it implements
+//io.WriterTo, io.Copy() writes the whole mapping at once.
+type mappedReader struct {
+	*bytes.Reader
+	data []byte
+}
+
+//Close implements the io.Closer interface.
+func (r *mappedReader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := munmap(r.data)
+	r.data = nil
+	return err
+}
@@ -27,9 +27,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 )
 
 //Node instances represent an entry in the file system (such as a file or a
@@ -45,7 +48,11 @@ type Node interface {
 	//InstalledSizeInBytes approximates the apparent size of the given
 	//directory and everything in it, as calculated by `du -s --apparent-size`,
 	//but in a filesystem-independent way.
-	InstalledSizeInBytes() int
+	InstalledSizeInBytes() int64
+	//InstalledSizeOnDisk is like InstalledSizeInBytes, but rounds the size of
+	//each node up to a multiple of the given block size, to approximate the
+	//disk usage on a real filesystem (as calculated by `du -s`).
+	InstalledSizeOnDisk(blockSize int) int64
 	//FileModeForArchive returns the file mode of this Node as stored in a
 	//tar or CPIO archive.
 	FileModeForArchive(includingFileType bool) uint32
@@ -87,6 +94,19 @@ type NodeMetadata struct {
 	Group *IntOrString
 }
 
+//clone returns a deep copy of this NodeMetadata.
+func (m NodeMetadata) clone() NodeMetadata {
+	if m.Owner != nil {
+		owner := *m.Owner
+		m.Owner = &owner
+	}
+	if m.Group != nil {
+		group := *m.Group
+		m.Group = &group
+	}
+	return m
+}
+
 //UID returns Owner.Int if it is set.
 func (m *NodeMetadata) UID() uint32 {
 	if m.Owner != nil {
@@ -130,16 +150,49 @@ func (m *NodeMetadata) postponeUnmaterializable(path string) (additionalSetupScr
 	return ""
 }
 
+//roundUpToBlockSize rounds the given size up to the next multiple of
+//blockSize. Non-positive block sizes disable the rounding.
+func roundUpToBlockSize(size int64, blockSize int) int64 {
+	bs := int64(blockSize)
+	if bs <= 0 || size%bs == 0 {
+		return size
+	}
+	return (size/bs + 1) * bs
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Directory
 //
 
 //Directory is a type of Node that represents directories. This Node
 //references the nodes contained in the directory recursively.
+//
+//All generators write an explicit directory entry for each Directory, so
+//empty directories are preserved in the package. (The RPM generator skips
+//Implicit directories like rpmbuild does, but since these are only created
+//as parents of other nodes, they are never empty unless their contents are
+//removed later.)
 type Directory struct {
 	Entries  map[string]Node
 	Metadata NodeMetadata
 	Implicit bool
+	//DirDefaults, if not nil, contains the metadata for directories that are
+	//implicitly created below this directory by Insert() or AddFile(). If nil,
+	//implicitly created directories have mode 0755 and owner root:root.
+	//Implicitly created directories inherit this setting, so it is usually
+	//sufficient to set it on the root directory.
+	DirDefaults *NodeMetadata
+	//FileDefaults, if not nil, contains the metadata for regular files that
+	//are synthesized by helper functions of this library, e.g. documentation
+	//files inserted by Package.InsertDocFiles(). If nil, these files have
+	//mode 0644 and owner root:root. Only the setting on the root directory of
+	//a package is used (see GeneratedFileMetadata()). Package metadata files
+	//generated by the generators are not affected.
+	FileDefaults *NodeMetadata
+
+	//cached result of InstalledSizeInBytes()
+	cachedSize      int64
+	cachedSizeValid bool
 }
 
 //NewDirectory initializes an empty Directory.
@@ -156,6 +209,7 @@ func (d *Directory) Insert(entry Node, relPath []string, location string) error
 		return errors.New("duplicate entry")
 	}
 
+	d.invalidateSize()
 	subname := relPath[0]
 	subentry := d.Entries[subname]
 
@@ -174,6 +228,10 @@ func (d *Directory) Insert(entry Node, relPath []string, location string) error
 			for key, value := range dirOld.Entries {
 				dirNew.Entries[key] = value
 			}
+			dirNew.invalidateSize()
+		}
+		if dir, ok := entry.(*Directory); ok && dir.DirDefaults == nil {
+			dir.DirDefaults = d.DirDefaults
 		}
 		d.Entries[subname] = entry
 		return nil
@@ -182,8 +240,7 @@ func (d *Directory) Insert(entry Node, relPath []string, location string) error
 	//entry is inside a subdirectory of this one -> spawn the next child if
 	//necessary and recurse
 	if subentry == nil {
-		subentry = NewDirectory()
-		subentry.(*Directory).Implicit = true //this node was implicitly created (see above)
+		subentry = d.newImplicitDirectory()
 		d.Entries[subname] = subentry
 	}
 	subdir, ok := subentry.(*Directory)
@@ -193,15 +250,413 @@ func (d *Directory) Insert(entry Node, relPath []string, location string) error
 	return subdir.Insert(entry, relPath[1:], location+"/"+subname)
 }
 
+//AddFile inserts a new node at the given path relative to this directory
+//(e.g. "usr/bin/foo"; a leading slash is ignored). Parent directories that do
+//not exist yet are created implicitly (see DirDefaults).
+func (d *Directory) AddFile(relPath string, entry Node) error {
+	names := splitRelativePath(relPath)
+	if len(names) == 0 {
+		return errors.New("cannot replace root directory")
+	}
+	for _, name := range names {
+		if name == ".." {
+			return fmt.Errorf("path %q may not contain \"..\"", relPath)
+		}
+	}
+	return d.Insert(entry, names, "")
+}
+
+//GeneratedFileMetadata returns the metadata for regular files that are
+//synthesized below this directory (see FileDefaults).
+func (d *Directory) GeneratedFileMetadata() NodeMetadata {
+	if d.FileDefaults == nil {
+		return NodeMetadata{Mode: 0644}
+	}
+	return d.FileDefaults.clone()
+}
+
+//newImplicitDirectory creates a Directory that is marked as Implicit, for use
+//as a parent of an inserted node that was created without an explicit parent.
+//Its metadata is taken from d.DirDefaults.
+func (d *Directory) newImplicitDirectory() *Directory {
+	dir := NewDirectory()
+	dir.Implicit = true
+	if d.DirDefaults != nil {
+		dir.Metadata = d.DirDefaults.clone()
+		dir.DirDefaults = d.DirDefaults
+	}
+	return dir
+}
+
+//Move moves the node at the relative path `from` to the relative path `to`
+//(leading slashes are ignored). Missing parent directories of `to` are
+//created implicitly (see DirDefaults). It is an error if `from` does not
+//exist or if `to` already exists.
+//
+//Symlinks whose target pointed to the moved node (or something below it)
+//are updated to point to the new location, and relative symlinks inside the
+//moved node are updated to point to the same target as before.
+func (d *Directory) Move(from, to string) error {
+	from = path.Clean("/" + from)[1:]
+	to = path.Clean("/" + to)[1:]
+	if from == "" || to == "" {
+		return errors.New("cannot move root directory")
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return fmt.Errorf("cannot move %s into itself", from)
+	}
+
+	parent, ok := d.Lookup(path.Dir(from)).(*Directory)
+	if !ok || parent.Entries[path.Base(from)] == nil {
+		return fmt.Errorf("cannot move %s: no such file or directory", from)
+	}
+	if d.Lookup(to) != nil {
+		return fmt.Errorf("cannot move %s to %s: destination exists", from, to)
+	}
+
+	//remember where all symlinks point to before moving anything
+	type symlinkInfo struct {
+		Link       *Symlink
+		LinkPath   string
+		TargetPath string
+	}
+	var symlinks []symlinkInfo
+	d.Walk("", func(relPath string, node Node) error {
+		link, ok := node.(*Symlink)
+		if !ok || link.Target == "" {
+			return nil
+		}
+		targetPath := path.Join(path.Dir(relPath), link.Target)
+		if strings.HasPrefix(link.Target, "/") {
+			targetPath = strings.TrimPrefix(path.Clean(link.Target), "/")
+		} else if targetPath == ".." || strings.HasPrefix(targetPath, "../") {
+			return nil //points outside of this directory -> cannot fix up
+		}
+		symlinks = append(symlinks, symlinkInfo{link, relPath, targetPath})
+		return nil
+	})
+
+	node := parent.Entries[path.Base(from)]
+	d.invalidateSizeAlong(path.Dir(from))
+	delete(parent.Entries, path.Base(from))
+	err := d.AddFile(to, node)
+	if err != nil {
+		parent.Entries[path.Base(from)] = node //restore previous state
+		return err
+	}
+
+	//fix up symlinks
+	remap := func(p string) string {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			return to + strings.TrimPrefix(p, from)
+		}
+		return p
+	}
+	for _, s := range symlinks {
+		newLinkPath := remap(s.LinkPath)
+		newTargetPath := remap(s.TargetPath)
+		if newLinkPath == s.LinkPath && newTargetPath == s.TargetPath {
+			continue
+		}
+		if strings.HasPrefix(s.Link.Target, "/") {
+			s.Link.Target = "/" + newTargetPath
+		} else {
+			target, err := filepath.Rel("/"+path.Dir(newLinkPath), "/"+newTargetPath)
+			if err == nil {
+				s.Link.Target = filepath.ToSlash(target)
+			}
+		}
+	}
+	return nil
+}
+
+//MakeSymlinksRelative rewrites absolute symlink targets into relative ones,
+//if the target is contained in this directory (which is assumed to be the
+//root directory of the package). For example, a symlink at "/usr/bin/foo"
+//pointing to "/usr/lib/foo/foo" becomes a symlink to "../lib/foo/foo".
+//
+//Symlinks whose absolute targets are not contained in this directory are left
+//unchanged. Their paths are returned so that the caller can log them.
+func (d *Directory) MakeSymlinksRelative() (leftAbsolute []string) {
+	d.Walk("/", func(linkPath string, node Node) error {
+		link, ok := node.(*Symlink)
+		if !ok || !strings.HasPrefix(link.Target, "/") {
+			return nil
+		}
+		targetPath := path.Clean(link.Target)
+		if !d.Contains(strings.TrimPrefix(targetPath, "/")) {
+			leftAbsolute = append(leftAbsolute, linkPath)
+			return nil
+		}
+		target, err := filepath.Rel(path.Dir(linkPath), targetPath)
+		if err != nil {
+			leftAbsolute = append(leftAbsolute, linkPath)
+			return nil
+		}
+		link.Target = filepath.ToSlash(target)
+		return nil
+	})
+	//symlink sizes depend on the length of the target
+	d.RecomputeSize()
+	return leftAbsolute
+}
+
+//Lookup returns the node at the given path relative to this directory (e.g.
+//"usr/bin/foo"), or nil if there is no such node. Symlinks are not followed.
+//The empty path and "." refer to the directory itself.
+func (d *Directory) Lookup(relPath string) Node {
+	var current Node = d
+	for _, name := range splitRelativePath(relPath) {
+		dir, ok := current.(*Directory)
+		if !ok {
+			return nil
+		}
+		current = dir.Entries[name]
+		if current == nil {
+			return nil
+		}
+	}
+	return current
+}
+
+//Contains returns whether the given path relative to this directory exists.
+//If a symlink is encountered before the end of the path, the path is assumed
+//to exist since its resolution may depend on things outside this directory.
+func (d *Directory) Contains(relPath string) bool {
+	var current Node = d
+	for _, name := range splitRelativePath(relPath) {
+		switch n := current.(type) {
+		case *Directory:
+			current = n.Entries[name]
+			if current == nil {
+				return false
+			}
+		case *Symlink:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//ChmodRecursive sets the mode of all regular files (to fileMode) and
+//directories (to dirMode) at or below the given path relative to this
+//directory, like `find $prefix -type f -exec chmod $fileMode` and `find
+//$prefix -type d -exec chmod $dirMode` would. Symlinks are not touched.
+func (d *Directory) ChmodRecursive(prefix string, fileMode, dirMode os.FileMode) error {
+	return d.walkMetadata(prefix, func(m *NodeMetadata, isDir bool) {
+		if isDir {
+			m.Mode = dirMode
+		} else {
+			m.Mode = fileMode
+		}
+	})
+}
+
+//ChownRecursive sets the owner and group of all regular files and directories
+//at or below the given path relative to this directory to the given numeric
+//IDs. Symlinks are not touched. IDs must be between 0 and math.MaxUint32.
+func (d *Directory) ChownRecursive(prefix string, uid, gid int) error {
+	for _, id := range []struct {
+		Kind  string
+		Value int
+	}{{"owner", uid}, {"group", gid}} {
+		if id.Value < 0 || int64(id.Value) > math.MaxUint32 {
+			return fmt.Errorf("invalid %s ID %d (must be between 0 and %d)", id.Kind, id.Value, uint32(math.MaxUint32))
+		}
+	}
+	return d.walkMetadata(prefix, func(m *NodeMetadata, isDir bool) {
+		m.Owner = &IntOrString{Int: uint32(uid)}
+		m.Group = &IntOrString{Int: uint32(gid)}
+	})
+}
+
+//RemapFunc is the type of TarOptions.RemapOwner (and of the RemapOwner fields
+//of the generators). It receives the absolute path of an entry in an archive
+//(with a leading slash) and its metadata, and returns the metadata that shall
+//be recorded in the archive instead. Only the Owner and Group of the result
+//are used, and they must be given by ID, not by name.
+//
+//This can be used e.g. to map placeholder IDs to the users of the target
+//distribution. The generators call it for every entry of the package
+//(including doc files and symlinks) without modifying Package.FSRoot. Owners
+//and groups given by name in the FSRoot have already been moved into the setup
+//script at that point (see Node.PostponeUnmaterializable()) and are not seen
+//by the RemapFunc.
+type RemapFunc func(absolutePath string, m NodeMetadata) NodeMetadata
+
+//ArchiveOwner returns the owner and group IDs that archives record for the
+//given node, which is located at the given absolute path below this
+//directory. Hardlinks are reported with the owner of their target. Symlinks
+//do not have metadata of their own, so they are owned by root unless the
+//RemapFunc says otherwise. The node itself is not modified.
+//
+//If remap is not nil, it is applied to the metadata first (for hardlinks,
+//with the path of their target). An error is returned if its result contains
+//an owner or group name.
+func (d *Directory) ArchiveOwner(absolutePath string, node Node, remap RemapFunc) (uid, gid uint32, err error) {
+	var m NodeMetadata
+	switch n := node.(type) {
+	case *Directory:
+		m = n.Metadata
+	case *RegularFile:
+		m = n.Metadata
+	case *ReaderFile:
+		m = n.Metadata
+	case *TemplateFile:
+		m = n.Metadata
+	case *Hardlink:
+		target, err := d.ResolveHardlink(n)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot write %s: %s", absolutePath, err.Error())
+		}
+		m = hardlinkMetadata(target)
+		absolutePath = "/" + strings.Join(splitRelativePath(n.Target), "/")
+	}
+	if remap != nil {
+		m = remap(absolutePath, m)
+		if (m.Owner != nil && m.Owner.Str != "") || (m.Group != nil && m.Group.Str != "") {
+			return 0, 0, fmt.Errorf("cannot write %s: the remapped owner and group must be given as numeric IDs", absolutePath)
+		}
+	}
+	return m.UID(), m.GID(), nil
+}
+
+//Filter removes all nodes below this directory for which `keep` returns
+//false. When a directory is removed, everything below it is removed as well.
+//The paths given to `keep` are relative to this directory without leading
+//slash (like in `d.Walk("", ...)`); the directory itself is not visited. With
+//`pruneEmptyDirs = true`, directories that become empty because all their
+//entries were removed are removed as well (but directories that were empty
+//to begin with are kept).
+//
+//Returns the number of nodes removed (not including nodes below removed
+//directories).
+func (d *Directory) Filter(keep func(relPath string, node Node) bool, pruneEmptyDirs bool) int {
+	return d.filter("", keep, pruneEmptyDirs)
+}
+
+func (d *Directory) filter(relPath string, keep func(string, Node) bool, pruneEmptyDirs bool) int {
+	removed := 0
+	for _, name := range d.sortedEntryNames() {
+		entry := d.Entries[name]
+		entryPath := name
+		if relPath != "" {
+			entryPath = relPath + "/" + name
+		}
+		if !keep(entryPath, entry) {
+			delete(d.Entries, name)
+			removed++
+			continue
+		}
+		if subdir, ok := entry.(*Directory); ok {
+			subRemoved := subdir.filter(entryPath, keep, pruneEmptyDirs)
+			removed += subRemoved
+			if pruneEmptyDirs && subRemoved > 0 && len(subdir.Entries) == 0 {
+				delete(d.Entries, name)
+				removed++
+			}
+		}
+	}
+	if removed > 0 {
+		d.invalidateSize()
+	}
+	return removed
+}
+
+//walkMetadata calls the callback for the metadata of each directory and
+//regular file at or below the given path.
+func (d *Directory) walkMetadata(prefix string, callback func(m *NodeMetadata, isDir bool)) error {
+	node := d.Lookup(prefix)
+	if node == nil {
+		return fmt.Errorf("%s: no such file or directory", prefix)
+	}
+	return node.Walk(prefix, func(path string, node Node) error {
+		switch n := node.(type) {
+		case *Directory:
+			callback(&n.Metadata, true)
+		case *RegularFile:
+			callback(&n.Metadata, false)
+		case *ReaderFile:
+			callback(&n.Metadata, false)
+		}
+		return nil
+	})
+}
+
+func splitRelativePath(relPath string) []string {
+	var result []string
+	for _, name := range strings.Split(relPath, "/") {
+		if name != "" && name != "." {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
 //InstalledSizeInBytes implements the Node interface.
-func (d *Directory) InstalledSizeInBytes() int {
+//
+//The result is cached. The cache is invalidated when the directory tree is
+//modified through methods like Insert(), AddFile(), Filter() or Move(). When
+//the directory tree is modified in any other way (e.g. by changing the
+//Content of a RegularFile, or writing into Entries directly), RecomputeSize()
+//must be called instead.
+func (d *Directory) InstalledSizeInBytes() int64 {
+	if d.cachedSizeValid {
+		return d.cachedSize
+	}
 	//sum over all entries
-	sum := 0
+	var sum int64
 	for _, entry := range d.Entries {
 		sum += entry.InstalledSizeInBytes()
 	}
 	//contribution from the directory itself
-	return sum + 4096
+	d.cachedSize = sum + 4096
+	d.cachedSizeValid = true
+	return d.cachedSize
+}
+
+//RecomputeSize discards the cached results of InstalledSizeInBytes() for
+//this directory and all directories below it, and returns the freshly
+//computed size.
+func (d *Directory) RecomputeSize() int64 {
+	d.Walk("", func(relPath string, node Node) error {
+		if dir, ok := node.(*Directory); ok {
+			dir.invalidateSize()
+		}
+		return nil
+	})
+	return d.InstalledSizeInBytes()
+}
+
+func (d *Directory) invalidateSize() {
+	d.cachedSizeValid = false
+}
+
+//invalidateSizeAlong invalidates the size cache of this directory and of all
+//directories on the given relative path below it.
+func (d *Directory) invalidateSizeAlong(relPath string) {
+	d.invalidateSize()
+	current := d
+	for _, name := range splitRelativePath(relPath) {
+		next, ok := current.Entries[name].(*Directory)
+		if !ok {
+			return
+		}
+		next.invalidateSize()
+		current = next
+	}
+}
+
+//InstalledSizeOnDisk implements the Node interface.
+func (d *Directory) InstalledSizeOnDisk(blockSize int) int64 {
+	var sum int64
+	for _, entry := range d.Entries {
+		sum += entry.InstalledSizeOnDisk(blockSize)
+	}
+	//a directory occupies at least one block
+	return sum + roundUpToBlockSize(4096, blockSize)
 }
 
 //FileModeForArchive implements the Node interface.
@@ -223,12 +678,7 @@ func (d *Directory) Walk(absolutePath string, callback func(string, Node) error)
 	}
 
 	//walk through entries in reproducible, sorted order
-	names := make([]string, 0, len(d.Entries))
-	for name := range d.Entries {
-		names = append(names, name)
-	}
-	sort.Strings(names)
-	for _, name := range names {
+	for _, name := range d.sortedEntryNames() {
 		entry := d.Entries[name]
 		var nextPath string
 		switch absolutePath {
@@ -247,6 +697,15 @@ func (d *Directory) Walk(absolutePath string, callback func(string, Node) error)
 	return nil
 }
 
+func (d *Directory) sortedEntryNames() []string {
+	names := make([]string, 0, len(d.Entries))
+	for name := range d.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 //PostponeUnmaterializable implements the Node interface.
 func (d *Directory) PostponeUnmaterializable(absolutePath string) string {
 	script := d.Metadata.postponeUnmaterializable(absolutePath)
@@ -280,8 +739,13 @@ func (f *RegularFile) Insert(entry Node, relPath []string, location string) erro
 }
 
 //InstalledSizeInBytes implements the Node interface.
-func (f *RegularFile) InstalledSizeInBytes() int {
-	return len(f.Content)
+func (f *RegularFile) InstalledSizeInBytes() int64 {
+	return int64(len(f.Content))
+}
+
+//InstalledSizeOnDisk implements the Node interface.
+func (f *RegularFile) InstalledSizeOnDisk(blockSize int) int64 {
+	return roundUpToBlockSize(int64(len(f.Content)), blockSize)
 }
 
 //FileModeForArchive implements the Node interface.
@@ -331,6 +795,18 @@ func (f *RegularFile) SHA256Digest() string {
 //Symlink is a type of Node that represents symbolic links,
 type Symlink struct {
 	Target string
+	//Dangling marks symlinks whose target is intentionally not contained in
+	//the package. Validation will not warn about such symlinks.
+	Dangling bool
+}
+
+//NormalizeTarget removes redundant "." and ".." components and duplicate
+//slashes from the symlink target (e.g. "../lib/./foo/../bar" becomes
+//"../lib/bar").
+func (s *Symlink) NormalizeTarget() {
+	if s.Target != "" {
+		s.Target = path.Clean(s.Target)
+	}
 }
 
 //Insert implements the Node interface.
@@ -342,8 +818,13 @@ func (s *Symlink) Insert(entry Node, relPath []string, location string) error {
 }
 
 //InstalledSizeInBytes implements the Node interface.
-func (s *Symlink) InstalledSizeInBytes() int {
-	return len(s.Target)
+func (s *Symlink) InstalledSizeInBytes() int64 {
+	return int64(len(s.Target))
+}
+
+//InstalledSizeOnDisk implements the Node interface.
+func (s *Symlink) InstalledSizeOnDisk(blockSize int) int64 {
+	return roundUpToBlockSize(int64(len(s.Target)), blockSize)
 }
 
 //FileModeForArchive implements the Node interface.
@@ -0,0 +1,67 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"math"
+	"testing"
+)
+
+func TestChownRecursive(t *testing.T) {
+	d := NewDirectory()
+	file := &RegularFile{Content: "foo", Metadata: NodeMetadata{Mode: 0644}}
+	err := d.AddFile("/etc/foo.conf", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.ChownRecursive("etc", 0, math.MaxUint16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Metadata.Owner == nil || file.Metadata.Owner.Int != 0 || file.Metadata.Group == nil || file.Metadata.Group.Int != math.MaxUint16 {
+		t.Errorf("unexpected owner %v and group %v", file.Metadata.Owner, file.Metadata.Group)
+	}
+
+	testCases := []struct {
+		UID, GID int
+		Expected string
+	}{
+		{-1, 0, "invalid owner ID -1 (must be between 0 and 4294967295)"},
+		{0, -1, "invalid group ID -1 (must be between 0 and 4294967295)"},
+	}
+	//on 64-bit platforms, IDs can also be too large
+	if large := int64(math.MaxUint32) + 1; int64(int(large)) == large {
+		testCases = append(testCases, struct {
+			UID, GID int
+			Expected string
+		}{int(large), 0, "invalid owner ID 4294967296 (must be between 0 and 4294967295)"})
+	}
+
+	for _, tc := range testCases {
+		err := d.ChownRecursive("etc", tc.UID, tc.GID)
+		if err == nil || err.Error() != tc.Expected {
+			t.Errorf("expected error %q, but got %v", tc.Expected, err)
+		}
+		if file.Metadata.Owner.Int != 0 || file.Metadata.Group.Int != math.MaxUint16 {
+			t.Errorf("ChownRecursive(%d, %d) changed metadata despite error", tc.UID, tc.GID)
+		}
+	}
+}
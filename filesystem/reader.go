@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//ReaderFile is a type of Node that represents regular files whose contents
+//are not held in memory, but read from an io.Reader whenever they are needed.
+//Since generators may need to read the contents multiple times (e.g. to
+//compute digests before writing the archive), the reader is obtained from
+//the Open callback each time.
+//
+//The Size must be known in advance since it is written into archive headers
+//before the contents. It is an error if Open() yields a different number of
+//bytes.
+type ReaderFile struct {
+	Open     func() (io.ReadCloser, error)
+	Size     int64
+	Metadata NodeMetadata
+}
+
+//Insert implements the Node interface.
+func (f *ReaderFile) Insert(entry Node, relPath []string, location string) error {
+	if len(relPath) == 0 {
+		return errors.New("duplicate entry")
+	}
+	return fmt.Errorf("%s is not a directory", location)
+}
+
+//InstalledSizeInBytes implements the Node interface.
+func (f *ReaderFile) InstalledSizeInBytes() int64 {
+	return f.Size
+}
+
+//InstalledSizeOnDisk implements the Node interface.
+func (f *ReaderFile) InstalledSizeOnDisk(blockSize int) int64 {
+	return roundUpToBlockSize(f.Size, blockSize)
+}
+
+//FileModeForArchive implements the Node interface.
+func (f *ReaderFile) FileModeForArchive(includingFileType bool) uint32 {
+	if includingFileType {
+		return 0100000 | (uint32(f.Metadata.Mode) & 07777)
+	}
+	return uint32(f.Metadata.Mode) & 07777
+}
+
+//Walk implements the Node interface.
+func (f *ReaderFile) Walk(absolutePath string, callback func(string, Node) error) error {
+	return callback(absolutePath, f)
+}
+
+//PostponeUnmaterializable implements the Node interface.
+func (f *ReaderFile) PostponeUnmaterializable(absolutePath string) string {
+	return f.Metadata.postponeUnmaterializable(absolutePath)
+}
+
+//WriteTo writes the file's contents into the given writer, and checks that
+//exactly f.Size bytes were read.
+func (f *ReaderFile) WriteTo(w io.Writer) (int64, error) {
+	r, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	sized, hasSize := r.(interface{ Size() int64 })
+	switch {
+	case hasSize && sized.Size() != f.Size:
+		//readers with a known size (e.g. from NewMappedFile) can be checked
+		//in advance
+		r.Close()
+		return 0, fmt.Errorf("expected %d bytes of content, but got %d bytes", f.Size, sized.Size())
+	case hasSize:
+		//copy without LimitReader, so that an io.WriterTo can write directly
+		n, err = io.Copy(w, r)
+	default:
+		//read one byte more than expected to detect oversized contents
+		n, err = io.Copy(w, io.LimitReader(r, f.Size+1))
+	}
+	closeErr := r.Close()
+	if err != nil {
+		return n, err
+	}
+	if closeErr != nil {
+		return n, closeErr
+	}
+	if n > f.Size {
+		return n, fmt.Errorf("expected %d bytes of content, but got more", f.Size)
+	}
+	if n < f.Size {
+		return n, fmt.Errorf("expected %d bytes of content, but got only %d bytes", f.Size, n)
+	}
+	return n, nil
+}
+
+//Digests returns the MD5 and SHA256 digests of this file's contents.
+func (f *ReaderFile) Digests() (md5Digest, sha256Digest string, err error) {
+	md5sum := md5.New()
+	sha256sum := sha256.New()
+	_, err = f.WriteTo(io.MultiWriter(md5sum, sha256sum))
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5sum.Sum(nil)), hex.EncodeToString(sha256sum.Sum(nil)), nil
+}
@@ -0,0 +1,59 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+//FSStats contains statistics about a directory tree, as returned by
+//Directory.Stats().
+type FSStats struct {
+	Directories int
+	//RegularFiles counts both RegularFile and ReaderFile nodes.
+	RegularFiles int
+	Symlinks     int
+	Hardlinks    int
+	//InstalledSizeInBytes is identical to the result of InstalledSizeInBytes()
+	//on the directory.
+	InstalledSizeInBytes int64
+}
+
+//Stats counts the nodes of each type in this directory tree (including the
+//directory itself), and computes its installed size in the same pass.
+func (d *Directory) Stats() FSStats {
+	var stats FSStats
+	d.Walk("", func(relPath string, node Node) error {
+		switch n := node.(type) {
+		case *Directory:
+			stats.Directories++
+			stats.InstalledSizeInBytes += 4096
+		case *RegularFile:
+			stats.RegularFiles++
+			stats.InstalledSizeInBytes += n.InstalledSizeInBytes()
+		case *ReaderFile:
+			stats.RegularFiles++
+			stats.InstalledSizeInBytes += n.InstalledSizeInBytes()
+		case *Symlink:
+			stats.Symlinks++
+			stats.InstalledSizeInBytes += n.InstalledSizeInBytes()
+		case *Hardlink:
+			stats.Hardlinks++
+		}
+		return nil
+	})
+	return stats
+}
@@ -21,115 +21,428 @@ package filesystem
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
-	"os"
-	"os/exec"
 	"strings"
 	"time"
 )
 
+//PathStyle selects how entry paths are written into archives.
+type PathStyle int
+
+const (
+	//NoPrefix generates entry paths like `foo/bar.conf` (default).
+	NoPrefix PathStyle = iota
+	//DotSlash generates entry paths like `./foo/bar.conf`.
+	DotSlash
+	//LeadingSlash generates entry paths like `/foo/bar.conf`.
+	LeadingSlash
+)
+
+//apply converts a path as reported by Directory.Walk(".", ...) into this
+//style.
+func (s PathStyle) apply(path string) string {
+	switch s {
+	case NoPrefix:
+		return strings.TrimPrefix(path, "./")
+	case LeadingSlash:
+		return strings.TrimPrefix(path, ".")
+	default:
+		return path
+	}
+}
+
+//TarOptions contains options for ToTarArchive and related functions.
+type TarOptions struct {
+	//PathStyle selects the form of the entry paths.
+	PathStyle PathStyle
+	//With `SkipRootDirectory = true`, don't generate an entry for the root
+	//directory in the resulting package.
+	SkipRootDirectory bool
+	//BlockSize, if not zero, causes the uncompressed archive to be padded
+	//with zero bytes until its size is a multiple of BlockSize. This must be a
+	//multiple of 512 (the size of a tar record). If zero, the archive ends
+	//after the standard end-of-archive marker.
+	BlockSize int
+	//XZMemoryLimit, if not zero, limits the memory usage of the xz compressor
+	//in ToTarXZArchive to the given number of bytes. xz reduces its
+	//dictionary size (and thus the compression ratio) to stay within the
+	//limit, and fails if the limit is below the minimum that it needs.
+	XZMemoryLimit int
+	//Zstd contains options for the zstd compressor in ToTarZstdArchive.
+	Zstd ZstdOptions
+	//Format selects the tar format. If zero, each entry is written in the
+	//USTAR format if possible, and as a PAX entry otherwise (e.g. for paths or
+	//symlink targets that are too long for USTAR). If tar.FormatUSTAR is
+	//given, entries that cannot be represented in USTAR cause an error
+	//instead. tar.FormatPAX and tar.FormatGNU are also accepted.
+	Format tar.Format
+	//RemapOwner, if not nil, is called for each entry to choose the owner and
+	//group recorded in the archive (see Directory.ArchiveOwner()).
+	RemapOwner RemapFunc
+}
+
+const (
+	//sizes of the name, prefix and linkname fields in USTAR headers
+	maxUSTARName     = 100
+	maxUSTARPrefix   = 155
+	maxUSTARLinkname = 100
+	//largest values that fit into the octal size and uid/gid fields of USTAR
+	//headers
+	maxUSTARSize = 1<<33 - 1
+	maxUSTARID   = 1<<21 - 1
+)
+
+//CheckUSTARHeader returns an error if the given header cannot be represented
+//in the USTAR format, i.e. if a tar.Writer would need PAX or GNU extensions
+//to write it. The error describes which limit is exceeded, but does not name
+//the entry.
+func CheckUSTARHeader(hdr *tar.Header) error {
+	switch {
+	case !isASCII(hdr.Name):
+		return errors.New("name contains non-ASCII characters, which the USTAR format cannot represent")
+	case !fitsUSTARName(hdr.Name):
+		return fmt.Errorf("name is %d bytes long, but the USTAR format allows at most %d bytes (or a %d-byte prefix and a %d-byte name, separated by a slash)",
+			len(hdr.Name), maxUSTARName, maxUSTARPrefix, maxUSTARName,
+		)
+	case !isASCII(hdr.Linkname):
+		return errors.New("link target contains non-ASCII characters, which the USTAR format cannot represent")
+	case len(hdr.Linkname) > maxUSTARLinkname:
+		return fmt.Errorf("link target is %d bytes long, but the USTAR format allows at most %d bytes",
+			len(hdr.Linkname), maxUSTARLinkname,
+		)
+	case hdr.Size > maxUSTARSize:
+		return fmt.Errorf("size is %d bytes, but the USTAR format allows at most %d bytes",
+			hdr.Size, int64(maxUSTARSize),
+		)
+	case hdr.Uid > maxUSTARID || hdr.Gid > maxUSTARID:
+		return fmt.Errorf("owner is %d:%d, but the USTAR format allows IDs up to %d only",
+			hdr.Uid, hdr.Gid, maxUSTARID,
+		)
+	}
+	return nil
+}
+
+//fitsUSTARName returns whether the given path fits into the name field of
+//a USTAR header, or can be split into the prefix and name fields at a slash
+//(this follows the rules of archive/tar).
+func fitsUSTARName(name string) bool {
+	if len(name) <= maxUSTARName {
+		return true
+	}
+	length := len(name)
+	if length > maxUSTARPrefix+1 {
+		length = maxUSTARPrefix + 1
+	} else if name[length-1] == '/' {
+		length--
+	}
+	idx := strings.LastIndex(name[:length], "/")
+	nameLength := len(name) - idx - 1
+	return idx > 0 && nameLength > 0 && nameLength <= maxUSTARName
+}
+
+func isASCII(s string) bool {
+	for _, c := range s {
+		if c >= 0x80 || c == 0x00 {
+			return false
+		}
+	}
+	return true
+}
+
+//applyFormat applies TarOptions.Format to the given header.
+func (opts TarOptions) applyFormat(hdr *tar.Header) error {
+	switch opts.Format {
+	case tar.FormatUnknown:
+		return nil
+	case tar.FormatUSTAR:
+		err := CheckUSTARHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("cannot write %s: %s", hdr.Name, err.Error())
+		}
+		//USTAR has no fields for these timestamps
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+	case tar.FormatPAX, tar.FormatGNU:
+	default:
+		return fmt.Errorf("unsupported tar format %s", opts.Format)
+	}
+	hdr.Format = opts.Format
+	return nil
+}
+
+//ZstdOptions contains options for the zstd compressor (see TarOptions.Zstd).
+//The zero value selects the defaults of the zstd program.
+type ZstdOptions struct {
+	//Level is the compression level from 1 to 22, or 0 for the default.
+	Level int
+	//Workers is the number of compression threads, or 0 for the default.
+	Workers int
+	//LongWindowLog, if not zero, enables long-distance matching with a window
+	//size of 2^LongWindowLog bytes. Since larger windows require special
+	//options when decompressing, at most 27 is allowed, which can be
+	//decompressed by the standard zstd program and by libarchive.
+	LongWindowLog int
+}
+
+//args returns the arguments for the zstd program that select these options.
+func (o ZstdOptions) args() ([]string, error) {
+	var args []string
+	switch {
+	case o.Level < 0 || o.Level > 22:
+		return nil, fmt.Errorf("invalid zstd compression level %d (must be between 1 and 22)", o.Level)
+	case o.Level > 19:
+		args = append(args, "--ultra", fmt.Sprintf("-%d", o.Level))
+	case o.Level > 0:
+		args = append(args, fmt.Sprintf("-%d", o.Level))
+	}
+	if o.Workers < 0 {
+		return nil, fmt.Errorf("invalid zstd worker count %d", o.Workers)
+	}
+	if o.Workers > 0 {
+		args = append(args, fmt.Sprintf("-T%d", o.Workers))
+	}
+	if o.LongWindowLog != 0 {
+		if o.LongWindowLog < 10 || o.LongWindowLog > 27 {
+			return nil, fmt.Errorf("invalid zstd window log %d (must be between 10 and 27)", o.LongWindowLog)
+		}
+		args = append(args, fmt.Sprintf("--long=%d", o.LongWindowLog))
+	}
+	return args, nil
+}
+
 //ToTarArchive creates a TAR archive containing this directory and all the
 //filesystem entries in it.
 //
-//With `leadingDot = true`, generate entry paths like `./foo/bar.conf`.
-//With `leadingDot = false`, generate entry paths like `foo/bar.conf`.
-//
-//With `skipRootDirectory = true`, don't generate an entry for the root
-//directory in the resulting package.
-func (d *Directory) ToTarArchive(w io.Writer, leadingDot, skipRootDirectory bool) error {
-	tw := tar.NewWriter(w)
+//The resulting archive is reproducible: Entries are written in the order of
+//Walk() (i.e. sorted by path), and all timestamps are set to zero.
+func (d *Directory) ToTarArchive(w io.Writer, opts TarOptions) error {
+	if opts.BlockSize < 0 || opts.BlockSize%512 != 0 {
+		return fmt.Errorf("invalid tar block size %d (must be a multiple of 512)", opts.BlockSize)
+	}
+	cw := &countingWriter{Writer: w}
+	tw := tar.NewWriter(cw)
 
-	timestamp := time.Unix(0, 0)
+	err := d.walkTarHeaders(opts, func(hdr *tar.Header, node Node) error {
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("cannot write %s: %s", hdr.Name, err.Error())
+		}
+		switch n := node.(type) {
+		case *RegularFile:
+			_, err = tw.Write([]byte(n.Content))
+			return err
+		case *ReaderFile:
+			_, err = n.WriteTo(tw)
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %s", hdr.Name, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tw.Close()
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
 
-	err := d.Walk(".", func(path string, node Node) error {
-		if !leadingDot {
-			path = strings.TrimPrefix(path, "./")
+	if opts.BlockSize > 0 {
+		if remainder := cw.Count % int64(opts.BlockSize); remainder > 0 {
+			_, err = w.Write(make([]byte, int64(opts.BlockSize)-remainder))
 		}
-		if skipRootDirectory && path == "." {
+	}
+	return err
+}
+
+//TarHeaders returns the headers that ToTarArchive would write for this
+//directory with the given options, in the same order, without reading any
+//file contents. This is useful for inspecting the archive layout.
+func (d *Directory) TarHeaders(opts TarOptions) ([]tar.Header, error) {
+	var result []tar.Header
+	err := d.walkTarHeaders(opts, func(hdr *tar.Header, node Node) error {
+		result = append(result, *hdr)
+		return nil
+	})
+	return result, err
+}
+
+//walkTarHeaders constructs the tar headers for ToTarArchive and TarHeaders,
+//and calls the callback for each of them.
+func (d *Directory) walkTarHeaders(opts TarOptions, callback func(hdr *tar.Header, node Node) error) error {
+	timestamp := time.Unix(0, 0)
+
+	return d.Walk(".", func(path string, node Node) error {
+		isRoot := path == "."
+		if opts.SkipRootDirectory && isRoot {
 			return nil
 		}
+		absolutePath := strings.TrimPrefix(path, ".")
+		if isRoot {
+			absolutePath = "/"
+		}
+		uid, gid, err := d.ArchiveOwner(absolutePath, node, opts.RemapOwner)
+		if err != nil {
+			return err
+		}
+		path = opts.PathStyle.apply(path)
 
-		var err error
+		var hdr *tar.Header
 		switch n := node.(type) {
 		case *Directory:
-			err = tw.WriteHeader(&tar.Header{
-				Name:       path + "/",
+			hdr = &tar.Header{
+				Name:       strings.TrimSuffix(path, "/") + "/",
 				Typeflag:   tar.TypeDir,
 				Mode:       int64(n.FileModeForArchive(false)),
-				Uid:        int(n.Metadata.UID()),
-				Gid:        int(n.Metadata.GID()),
+				Uid:        int(uid),
+				Gid:        int(gid),
 				ModTime:    timestamp,
 				AccessTime: timestamp,
 				ChangeTime: timestamp,
-			})
+			}
 		case *RegularFile:
-			err = tw.WriteHeader(&tar.Header{
+			hdr = &tar.Header{
 				Name:       path,
 				Size:       int64(len([]byte(n.Content))),
 				Typeflag:   tar.TypeReg,
 				Mode:       int64(n.FileModeForArchive(false)),
-				Uid:        int(n.Metadata.UID()),
-				Gid:        int(n.Metadata.GID()),
+				Uid:        int(uid),
+				Gid:        int(gid),
 				ModTime:    timestamp,
 				AccessTime: timestamp,
 				ChangeTime: timestamp,
-			})
+			}
+		case *ReaderFile:
+			hdr = &tar.Header{
+				Name:       path,
+				Size:       n.Size,
+				Typeflag:   tar.TypeReg,
+				Mode:       int64(n.FileModeForArchive(false)),
+				Uid:        int(uid),
+				Gid:        int(gid),
+				ModTime:    timestamp,
+				AccessTime: timestamp,
+				ChangeTime: timestamp,
+			}
 		case *Symlink:
-			err = tw.WriteHeader(&tar.Header{
+			hdr = &tar.Header{
 				Name:       path,
 				Typeflag:   tar.TypeSymlink,
 				Mode:       int64(n.FileModeForArchive(false)),
+				Uid:        int(uid),
+				Gid:        int(gid),
 				Linkname:   n.Target,
 				ModTime:    timestamp,
 				AccessTime: timestamp,
 				ChangeTime: timestamp,
-			})
+			}
+		case *Hardlink:
+			target, err := d.ResolveHardlink(n)
+			if err != nil {
+				return fmt.Errorf("cannot write %s: %s", path, err.Error())
+			}
+			hdr = &tar.Header{
+				Name:       path,
+				Typeflag:   tar.TypeLink,
+				Mode:       int64(target.FileModeForArchive(false)),
+				Uid:        int(uid),
+				Gid:        int(gid),
+				Linkname:   opts.PathStyle.apply("./" + strings.Join(splitRelativePath(n.Target), "/")),
+				ModTime:    timestamp,
+				AccessTime: timestamp,
+				ChangeTime: timestamp,
+			}
 		default:
 			panic("unreachable")
 		}
+		err = opts.applyFormat(hdr)
 		if err != nil {
 			return err
 		}
-		if n, ok := node.(*RegularFile); ok {
-			_, err = tw.Write([]byte(n.Content))
-			return err
-		}
-		return nil
+		return callback(hdr, node)
 	})
-	if err != nil {
-		tw.Close()
-		return err
-	}
+}
 
-	return tw.Close()
+//countingWriter is an io.Writer that counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	Count int64
 }
 
-//ToTarGZArchive is identical to ToTarArchive, but GZip-compresses the result.
-func (d *Directory) ToTarGZArchive(w io.Writer, leadingDot, skipRootDirectory bool) error {
+func (w *countingWriter) Write(buf []byte) (int, error) {
+	n, err := w.Writer.Write(buf)
+	w.Count += int64(n)
+	return n, err
+}
+
+//NewGzipWriter creates a gzip.Writer that produces reproducible output, i.e.
+//the gzip header does not contain a modification time, file name or
+//information about the operating system. These are also the defaults of
+//gzip.NewWriter, but since reproducible packages depend on them, they are set
+//explicitly instead of relying on the defaults.
+func NewGzipWriter(w io.Writer) *gzip.Writer {
 	gzw := gzip.NewWriter(w)
+	gzw.Header.ModTime = time.Time{} //encoded as MTIME = 0 ("no timestamp available")
+	gzw.Header.OS = 255              //unknown operating system
+	gzw.Header.Name = ""
+	gzw.Header.Comment = ""
+	return gzw
+}
 
-	err := d.ToTarArchive(gzw, leadingDot, skipRootDirectory)
-	if err != nil {
-		gzw.Close()
-		return err
+//ToTarGZArchive is identical to ToTarArchive, but GZip-compresses the result.
+func (d *Directory) ToTarGZArchive(w io.Writer, opts TarOptions) error {
+	_, err := d.ToCompressedTarArchive(w, GzipCompressor{}, opts)
+	return err
+}
+
+//ToTarXZArchive is identical to ToTarArchive, but XZ-compresses the result.
+func (d *Directory) ToTarXZArchive(w io.Writer, opts TarOptions) error {
+	_, err := d.ToCompressedTarArchive(w, XZCompressor{MemoryLimit: opts.XZMemoryLimit}, opts)
+	return err
+}
+
+//RunXZ compresses the data from the reader with the "xz" program and writes
+//the result into the writer. If memoryLimit is not zero, it limits the memory
+//usage of xz to the given number of bytes (see TarOptions.XZMemoryLimit).
+//Additional arguments (e.g. "--format=lzma") are passed to xz.
+func RunXZ(w io.Writer, r io.Reader, memoryLimit int, args ...string) error {
+	args = append(args, "--compress")
+	if memoryLimit > 0 {
+		args = append(args, fmt.Sprintf("--memlimit-compress=%d", memoryLimit))
 	}
-	return gzw.Close()
+	return runCompressor(w, r, "xz", args...)
 }
 
-//ToTarXZArchive is identical to ToTarArchive, but GZip-compresses the result.
-func (d *Directory) ToTarXZArchive(w io.Writer, leadingDot, skipRootDirectory bool) error {
-	var buf bytes.Buffer
-	err := d.ToTarArchive(&buf, leadingDot, skipRootDirectory)
+//ToTarZstdArchive is identical to ToTarArchive, but Zstandard-compresses the
+//result.
+func (d *Directory) ToTarZstdArchive(w io.Writer, opts TarOptions) error {
+	_, err := d.ToCompressedTarArchive(w, ZstdCompressor{Options: opts.Zstd}, opts)
+	return err
+}
+
+//RunZstd compresses the data from the reader with the "zstd" program and
+//writes the result into the writer. Additional arguments (e.g. "-19") are
+//passed to zstd.
+func RunZstd(w io.Writer, r io.Reader, args ...string) error {
+	args = append(args, "--compress", "--quiet", "--stdout")
+	return runCompressor(w, r, "zstd", args...)
+}
+
+//runCompressor runs the given compression program as a filter from the
+//reader to the writer. Its error output is included in the returned error.
+func runCompressor(w io.Writer, r io.Reader, program string, args ...string) error {
+	cw, err := startCompressor(w, program, args...)
 	if err != nil {
 		return err
 	}
-
-	//since we don't have a "compress/xz" package, use the "xz" binary instead
-	cmd := exec.Command("xz", "--compress")
-	cmd.Stdin = &buf
-	cmd.Stdout = w
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	_, err = io.Copy(cw, r)
+	closeErr := cw.Close()
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
 }
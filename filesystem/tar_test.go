@@ -0,0 +1,352 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//readTarHeaders returns the headers of all entries in the given tar archive.
+func readTarHeaders(t *testing.T, data []byte) []*tar.Header {
+	t.Helper()
+	var result []*tar.Header
+	r := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, hdr)
+	}
+}
+
+//makeTestTree returns a Directory containing one node of each type, which
+//are inserted in the given order of paths (or in an arbitrary fixed order if
+//none are given).
+func makeTestTree(t *testing.T, order ...string) *Directory {
+	t.Helper()
+	nodes := map[string]Node{
+		"/etc/foo.conf":        &RegularFile{Content: "foo=1\n", Metadata: NodeMetadata{Mode: 0644}},
+		"/usr/bin/foo":         &RegularFile{Content: "#!/bin/sh\necho foo\n", Metadata: NodeMetadata{Mode: 0755}},
+		"/usr/bin/bar":         &Symlink{Target: "foo"},
+		"/usr/share/foo/a.txt": &RegularFile{Content: "a\n", Metadata: NodeMetadata{Mode: 0644}},
+		"/usr/share/foo/b.txt": &RegularFile{Content: "b\n", Metadata: NodeMetadata{Mode: 0644}},
+		"/var/lib/foo":         &Directory{Entries: map[string]Node{}, Metadata: NodeMetadata{Mode: 0700}},
+	}
+	if len(order) == 0 {
+		order = []string{"/var/lib/foo", "/usr/share/foo/b.txt", "/etc/foo.conf", "/usr/bin/foo", "/usr/share/foo/a.txt", "/usr/bin/bar"}
+	}
+
+	d := NewDirectory()
+	for _, path := range order {
+		err := d.AddFile(path, nodes[path])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+func TestTarRemapOwner(t *testing.T) {
+	d := NewDirectory()
+	d.AddFile("/usr/bin/foo", &RegularFile{Content: "foo", Metadata: NodeMetadata{Mode: 0755}})
+	d.AddFile("/usr/bin/bar", &Symlink{Target: "foo"})
+	d.AddFile("/usr/bin/baz", &Hardlink{Target: "/usr/bin/foo"})
+
+	remap := func(absolutePath string, m NodeMetadata) NodeMetadata {
+		switch absolutePath {
+		case "/usr/bin/foo":
+			m.Owner = &IntOrString{Int: 1000}
+		case "/usr/bin/bar":
+			m.Group = &IntOrString{Int: 2000}
+		}
+		return m
+	}
+
+	//write twice to check that the remapping is not applied to the Directory
+	for idx := 0; idx < 2; idx++ {
+		var buf bytes.Buffer
+		err := d.ToTarArchive(&buf, TarOptions{PathStyle: DotSlash, SkipRootDirectory: true, RemapOwner: remap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string][2]int{
+			"./usr/":        {0, 0},
+			"./usr/bin/":    {0, 0},
+			"./usr/bin/bar": {0, 2000},
+			"./usr/bin/baz": {1000, 0}, //like the target
+			"./usr/bin/foo": {1000, 0},
+		}
+		for _, hdr := range readTarHeaders(t, buf.Bytes()) {
+			ids, exists := expected[hdr.Name]
+			if !exists {
+				t.Errorf("unexpected entry %s", hdr.Name)
+				continue
+			}
+			if hdr.Uid != ids[0] || hdr.Gid != ids[1] {
+				t.Errorf("expected %s to be owned by %d:%d, but got %d:%d", hdr.Name, ids[0], ids[1], hdr.Uid, hdr.Gid)
+			}
+		}
+	}
+
+	if owner := d.Entries["usr"].(*Directory).Entries["bin"].(*Directory).Entries["foo"].(*RegularFile).Metadata.Owner; owner != nil {
+		t.Errorf("expected RemapOwner not to modify the Directory, but owner is %#v", *owner)
+	}
+}
+
+func TestTarRemapOwnerRejectsNames(t *testing.T) {
+	d := NewDirectory()
+	d.AddFile("/etc/foo.conf", &RegularFile{Content: "foo", Metadata: NodeMetadata{Mode: 0644}})
+	remap := func(absolutePath string, m NodeMetadata) NodeMetadata {
+		m.Owner = &IntOrString{Str: "http"}
+		return m
+	}
+	err := d.ToTarArchive(io.Discard, TarOptions{RemapOwner: remap})
+	if err == nil {
+		t.Error("expected error for owner name returned by RemapOwner, but got none")
+	}
+}
+
+func TestCheckUSTARHeader(t *testing.T) {
+	long := strings.Repeat("x", 99) + "/"
+	testCases := []struct {
+		Header tar.Header
+		Valid  bool
+	}{
+		{tar.Header{Name: "./usr/bin/foo"}, true},
+		{tar.Header{Name: strings.Repeat("x", 100)}, true},
+		{tar.Header{Name: strings.Repeat("x", 101)}, false},
+		//long paths are split into prefix and name at a slash
+		{tar.Header{Name: long + strings.Repeat("y", 100)}, true},
+		{tar.Header{Name: long + strings.Repeat("y", 101)}, false},
+		{tar.Header{Name: strings.Repeat(long, 2)[:155] + "/" + strings.Repeat("y", 100)}, true},
+		{tar.Header{Name: strings.Repeat(long, 2)[:156] + "/" + strings.Repeat("y", 99)}, false},
+		{tar.Header{Name: long + strings.Repeat("y", 99) + "/", Typeflag: tar.TypeDir}, true},
+		{tar.Header{Name: "./usr/share/föö"}, false},
+		{tar.Header{Name: "foo", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("x", 100)}, true},
+		{tar.Header{Name: "foo", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("x", 101)}, false},
+		{tar.Header{Name: "foo", Typeflag: tar.TypeSymlink, Linkname: "föö"}, false},
+		{tar.Header{Name: "foo", Uid: 1<<21 - 1, Gid: 1<<21 - 1}, true},
+		{tar.Header{Name: "foo", Uid: 1 << 21}, false},
+		{tar.Header{Name: "foo", Gid: 1 << 21}, false},
+	}
+
+	for _, tc := range testCases {
+		hdr := tc.Header
+		err := CheckUSTARHeader(&hdr)
+		if tc.Valid && err != nil {
+			t.Errorf("unexpected error for %q: %s", hdr.Name, err.Error())
+		}
+		if !tc.Valid && err == nil {
+			t.Errorf("expected error for %q, but got none", hdr.Name)
+		}
+
+		//the result must agree with archive/tar
+		hdr.Format = tar.FormatUSTAR
+		hdr.Mode = 0644
+		tarErr := tar.NewWriter(io.Discard).WriteHeader(&hdr)
+		if (err == nil) != (tarErr == nil) {
+			t.Errorf("CheckUSTARHeader(%q) returned %v, but archive/tar returned %v", hdr.Name, err, tarErr)
+		}
+	}
+}
+
+func TestTarUSTARFormat(t *testing.T) {
+	d := NewDirectory()
+	//with PathStyle = NoPrefix, the parent directory fits exactly into the
+	//prefix field
+	d.AddFile("/usr/share/"+strings.Repeat("x", 47)+"/"+strings.Repeat("y", 97)+"/foo", &RegularFile{Content: "foo", Metadata: NodeMetadata{Mode: 0644}})
+
+	//fits into prefix and name
+	var buf bytes.Buffer
+	err := d.ToTarArchive(&buf, TarOptions{Format: tar.FormatUSTAR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hdr := range readTarHeaders(t, buf.Bytes()) {
+		if hdr.Format != tar.FormatUSTAR {
+			t.Errorf("expected %s to be written as USTAR, but got %s", hdr.Name, hdr.Format)
+		}
+	}
+
+	//does not fit anymore with the leading slash
+	err = d.ToTarArchive(io.Discard, TarOptions{Format: tar.FormatUSTAR, PathStyle: LeadingSlash})
+	if err == nil {
+		t.Error("expected error for path that does not fit into a USTAR header, but got none")
+	} else if !strings.Contains(err.Error(), "155-byte prefix") {
+		t.Errorf("expected error to name the limit, but got: %s", err.Error())
+	}
+
+	//the default format falls back to PAX
+	buf.Reset()
+	err = d.ToTarArchive(&buf, TarOptions{PathStyle: LeadingSlash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := readTarHeaders(t, buf.Bytes())
+	if hdr := headers[len(headers)-1]; hdr.Format != tar.FormatPAX {
+		t.Errorf("expected %s to be written as PAX, but got %s", hdr.Name, hdr.Format)
+	}
+}
+
+func TestTarEntryOrderIsReproducible(t *testing.T) {
+	//Go randomizes the iteration order of maps, so build the archive a few
+	//times from trees that were constructed in different orders
+	orders := [][]string{
+		nil,
+		{"/usr/share/foo/a.txt", "/usr/share/foo/b.txt", "/usr/bin/bar", "/usr/bin/foo", "/etc/foo.conf", "/var/lib/foo"},
+		{"/etc/foo.conf", "/var/lib/foo", "/usr/bin/foo", "/usr/bin/bar", "/usr/share/foo/b.txt", "/usr/share/foo/a.txt"},
+	}
+	var archives [][]byte
+	for run := 0; run < 10; run++ {
+		var buf bytes.Buffer
+		err := makeTestTree(t, orders[run%len(orders)]...).ToTarArchive(&buf, TarOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, buf.Bytes())
+	}
+	for idx, archive := range archives[1:] {
+		if !bytes.Equal(archive, archives[0]) {
+			t.Errorf("archive %d differs from archive 0", idx+1)
+		}
+	}
+
+	var names []string
+	for _, hdr := range readTarHeaders(t, archives[0]) {
+		names = append(names, hdr.Name)
+	}
+	expected := []string{
+		"./", "etc/", "etc/foo.conf", "usr/", "usr/bin/", "usr/bin/bar", "usr/bin/foo",
+		"usr/share/", "usr/share/foo/", "usr/share/foo/a.txt", "usr/share/foo/b.txt",
+		"var/", "var/lib/", "var/lib/foo/",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected entries %q, got %q", expected, names)
+	}
+}
+
+func TestTarLargeFileSize(t *testing.T) {
+	//sizes above 2 GiB overflow 32-bit integers, and sizes above 8 GiB do not
+	//fit into the size field of USTAR headers; the content is never read
+	for _, size := range []int64{3 << 30, 9 << 30} {
+		d := NewDirectory()
+		err := d.AddFile("/usr/share/foo/large.img", &ReaderFile{
+			Open: func() (io.ReadCloser, error) {
+				t.Error("unexpected call to Open()")
+				return nil, io.EOF
+			},
+			Size:     size,
+			Metadata: NodeMetadata{Mode: 0644},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := d.InstalledSizeInBytes(); actual < size {
+			t.Errorf("%d bytes: expected InstalledSizeInBytes() >= %d, got %d", size, size, actual)
+		}
+
+		hdrs, err := d.TarHeaders(TarOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := hdrs[len(hdrs)-1]
+		if hdr.Name != "usr/share/foo/large.img" || hdr.Size != size {
+			t.Fatalf("%d bytes: unexpected header: %#v", size, hdr)
+		}
+
+		//check that the size survives encoding and decoding of the header
+		var buf bytes.Buffer
+		err = tar.NewWriter(&buf).WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Size != size {
+			t.Errorf("%d bytes: header was decoded with size %d", size, decoded.Size)
+		}
+
+		_, err = d.TarHeaders(TarOptions{Format: tar.FormatUSTAR})
+		if size <= maxUSTARSize && err != nil {
+			t.Errorf("%d bytes: unexpected error for USTAR format: %s", size, err.Error())
+		}
+		if size > maxUSTARSize && (err == nil || !strings.Contains(err.Error(), "size is 9663676416 bytes")) {
+			t.Errorf("%d bytes: expected size error for USTAR format, got %v", size, err)
+		}
+	}
+}
+
+func TestTarLongSymlinkTarget(t *testing.T) {
+	target := "/opt/" + strings.Repeat("x", 191) + "/foo"
+	d := NewDirectory()
+	err := d.AddFile("/usr/bin/foo", &Symlink{Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//USTAR cannot represent this target, so this must fail instead of
+	//truncating the target
+	err = d.ToTarArchive(io.Discard, TarOptions{Format: tar.FormatUSTAR})
+	if err == nil || !strings.Contains(err.Error(), "link target is 200 bytes long") {
+		t.Errorf("expected error for long link target in USTAR format, got %v", err)
+	}
+
+	//the default format stores the target in a PAX record
+	var buf bytes.Buffer
+	err = d.ToTarArchive(&buf, TarOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := readTarHeaders(t, buf.Bytes())
+	if hdr := headers[len(headers)-1]; hdr.Linkname != target || hdr.Format != tar.FormatPAX {
+		t.Errorf("expected PAX header with link target %q, got %s header with %q", target, hdr.Format, hdr.Linkname)
+	}
+
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not available")
+	}
+	extractDir := t.TempDir()
+	cmd := exec.Command("tar", "-xf", "-", "-C", extractDir)
+	cmd.Stdin = bytes.NewReader(buf.Bytes())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("tar failed: %s: %s", err.Error(), output)
+	}
+	actual, err := os.Readlink(filepath.Join(extractDir, "usr/bin/foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != target {
+		t.Errorf("expected extracted link target %q, got %q", target, actual)
+	}
+}
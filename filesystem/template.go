@@ -0,0 +1,127 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"text/template"
+)
+
+//TemplateFile is a type of Node that represents a regular file whose content
+//is rendered from a text/template when the package is built. Generators will
+//never see a TemplateFile since build.Package.PrepareBuild() replaces all
+//TemplateFile instances with RegularFile instances.
+type TemplateFile struct {
+	//Template is the template source in text/template syntax.
+	Template string
+	//Data is passed to the template as the ".Data" field (next to the
+	//package's metadata, see build.TemplateData).
+	Data     interface{}
+	Metadata NodeMetadata
+}
+
+//Insert implements the Node interface.
+func (t *TemplateFile) Insert(entry Node, relPath []string, location string) error {
+	if len(relPath) == 0 {
+		return errors.New("duplicate entry")
+	}
+	return fmt.Errorf("%s is not a directory", location)
+}
+
+//InstalledSizeInBytes implements the Node interface. Since the template has
+//not been rendered yet, this only returns an estimate based on the size of
+//the template source.
+func (t *TemplateFile) InstalledSizeInBytes() int64 {
+	return int64(len(t.Template))
+}
+
+//InstalledSizeOnDisk implements the Node interface. Like
+//InstalledSizeInBytes, this only returns an estimate.
+func (t *TemplateFile) InstalledSizeOnDisk(blockSize int) int64 {
+	return roundUpToBlockSize(int64(len(t.Template)), blockSize)
+}
+
+//FileModeForArchive implements the Node interface.
+func (t *TemplateFile) FileModeForArchive(includingFileType bool) uint32 {
+	if includingFileType {
+		return 0100000 | (uint32(t.Metadata.Mode) & 07777)
+	}
+	return uint32(t.Metadata.Mode) & 07777
+}
+
+//Walk implements the Node interface.
+func (t *TemplateFile) Walk(absolutePath string, callback func(string, Node) error) error {
+	return callback(absolutePath, t)
+}
+
+//PostponeUnmaterializable implements the Node interface.
+func (t *TemplateFile) PostponeUnmaterializable(absolutePath string) string {
+	return t.Metadata.postponeUnmaterializable(absolutePath)
+}
+
+//Render executes the template with the given data, and returns a RegularFile
+//with the result as content and the same metadata as this TemplateFile.
+func (t *TemplateFile) Render(data interface{}) (*RegularFile, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(t.Template)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return &RegularFile{Content: buf.String(), Metadata: t.Metadata}, nil
+}
+
+//RenderTemplates replaces all TemplateFile nodes below this directory by the
+//RegularFile returned from their Render() method. The data for each template
+//is obtained from the given callback.
+func (d *Directory) RenderTemplates(makeData func(t *TemplateFile) interface{}) error {
+	_, err := d.renderTemplates("", makeData)
+	return err
+}
+
+func (d *Directory) renderTemplates(relPath string, makeData func(t *TemplateFile) interface{}) (changed bool, err error) {
+	for _, name := range d.sortedEntryNames() {
+		entryPath := relPath + "/" + name
+		switch n := d.Entries[name].(type) {
+		case *Directory:
+			subChanged, err := n.renderTemplates(entryPath, makeData)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || subChanged
+		case *TemplateFile:
+			file, err := n.Render(makeData(n))
+			if err != nil {
+				return false, fmt.Errorf("cannot render template %s: %s", entryPath, err.Error())
+			}
+			d.Entries[name] = file
+			changed = true
+		}
+	}
+	if changed {
+		d.invalidateSize()
+	}
+	return changed, nil
+}
@@ -19,6 +19,18 @@
 
 package build
 
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
 //Generator is a generic interface for the package generator implementations.
 //One Generator exists for every target package format (e.g. pacman, dpkg, RPM)
 //supported by libpackagebuild.
@@ -45,13 +57,207 @@ type Generator interface {
 	//run (even across systems) produces an identical result. For example, no
 	//timestamps or generator version information may be included.
 	//
-	//Build should call pkg.PrepareBuild() to execute some common preparation steps.
+	//Build should call pkg.PrepareBuild() to execute some common preparation
+	//steps, then pkg.InsertDocFiles(), and return their errors (if any).
 	Build() ([]byte, error)
 	//Generate the recommended file name for this package. Distributions usually
 	//have guidelines for this sort of thing. The string returned must be a plain
 	//file name without any slashes.
+	//
+	//RecommendedFileName may be called before Build() (e.g. to check if the
+	//package has already been built), but only after Validate() has succeeded.
 	RecommendedFileName() string
 }
 
 //GeneratorFactory is a type of function that creates generators.
 type GeneratorFactory func(*Package) Generator
+
+//NewBuildReader is a helper for implementing the BuildReader() methods of
+//generators. It runs `write` in a background goroutine, and returns a reader
+//that yields everything that `write` writes into its argument. The error
+//returned by `write` is returned by Read() once all data has been read.
+//
+//When the reader is closed early, all further writes fail, so `write` must
+//return on the first write error. Close() waits for the goroutine to
+//terminate, so the generator can be used again once Close() has returned.
+func NewBuildReader(write func(w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(write(pw))
+	}()
+	return buildReader{pr, done}
+}
+
+//buildReader is the io.ReadCloser returned by NewBuildReader().
+type buildReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+//Close implements the io.Closer interface.
+func (r buildReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+//BuildResult is returned by the BuildResult() method of the generators in this
+//library. Besides the package file, it contains the figures that repository
+//indexes usually need.
+type BuildResult struct {
+	//Bytes is the package file, as returned by Build().
+	Bytes               []byte
+	RecommendedFileName string
+	//CompressedSize is the size of the package file, i.e. len(Bytes).
+	CompressedSize int64
+	//UncompressedSize is the size of the package's payload before
+	//compression. Its exact meaning depends on the package format (see the
+	//generators' BuildResult() methods).
+	UncompressedSize int64
+	//InstalledSize is the installed size of the package contents, as reported
+	//by FSRoot.InstalledSizeInBytes() (and as recorded in the package
+	//metadata).
+	InstalledSize int64
+}
+
+//SizeLimits is embedded into the generators in this library to reject
+//packages that exceed a size budget. A limit of 0 means unlimited.
+type SizeLimits struct {
+	//MaxInstalledSize is the maximum size in bytes of the installed package
+	//contents, as reported by InstalledSizeInBytes().
+	MaxInstalledSize int64
+	//MaxCompressedSize is the maximum size in bytes of the package file
+	//produced by Build().
+	MaxCompressedSize int64
+}
+
+//CheckInstalledSize returns an error if the installed size of the given
+//package exceeds MaxInstalledSize. Generators should call this after
+//PrepareBuild(), before compressing the package.
+func (l SizeLimits) CheckInstalledSize(pkg *Package) error {
+	size := pkg.FSRoot.InstalledSizeInBytes()
+	if l.MaxInstalledSize > 0 && size > l.MaxInstalledSize {
+		return fmt.Errorf("installed size of package %s is %d bytes, which exceeds the limit of %d bytes (MaxInstalledSize)",
+			pkg.Name, size, l.MaxInstalledSize)
+	}
+	return nil
+}
+
+//CheckCompressedSize returns an error if the given package file exceeds
+//MaxCompressedSize.
+func (l SizeLimits) CheckCompressedSize(pkg *Package, data []byte) error {
+	if l.MaxCompressedSize > 0 && int64(len(data)) > l.MaxCompressedSize {
+		return fmt.Errorf("compressed size of package %s is %d bytes, which exceeds the limit of %d bytes (MaxCompressedSize)",
+			pkg.Name, len(data), l.MaxCompressedSize)
+	}
+	return nil
+}
+
+//PackageWriter is used by the BuildReader() methods of generators to write
+//the package file into a stream. It computes the checksums of the package
+//file along the way (see ComputeChecksums), and fails once the package file
+//exceeds MaxCompressedSize.
+type PackageWriter struct {
+	w      io.Writer
+	pkg    *Package
+	limit  int64
+	size   int64
+	hashes []hash.Hash
+}
+
+//NewPackageWriter returns a PackageWriter that writes into the given writer.
+func (l SizeLimits) NewPackageWriter(pkg *Package, w io.Writer) *PackageWriter {
+	return &PackageWriter{
+		w:      w,
+		pkg:    pkg,
+		limit:  l.MaxCompressedSize,
+		hashes: []hash.Hash{md5.New(), sha256.New(), sha512.New()},
+	}
+}
+
+//Write implements the io.Writer interface.
+func (pw *PackageWriter) Write(buf []byte) (int, error) {
+	if pw.limit > 0 && pw.size+int64(len(buf)) > pw.limit {
+		return 0, fmt.Errorf("compressed size of package %s exceeds the limit of %d bytes (MaxCompressedSize)",
+			pw.pkg.Name, pw.limit)
+	}
+	n, err := pw.w.Write(buf)
+	pw.size += int64(n)
+	for _, h := range pw.hashes {
+		h.Write(buf[:n])
+	}
+	return n, err
+}
+
+//Size returns the number of bytes written so far.
+func (pw *PackageWriter) Size() int64 {
+	return pw.size
+}
+
+//Checksums returns the checksums of everything written so far, in the same
+//format as ComputeChecksums().
+func (pw *PackageWriter) Checksums() map[string]string {
+	return map[string]string{
+		"md5":    hex.EncodeToString(pw.hashes[0].Sum(nil)),
+		"sha256": hex.EncodeToString(pw.hashes[1].Sum(nil)),
+		"sha512": hex.EncodeToString(pw.hashes[2].Sum(nil)),
+	}
+}
+
+//ExtraControlFiles is embedded into the generators in this library to inject
+//additional files into the control area of the package, for metadata that the
+//generator does not produce by itself. Each generator documents which names
+//it accepts and where the files end up; unacceptable names are reported by
+//Validate().
+type ExtraControlFiles struct {
+	//ControlFiles contains the files added by AddControlFile(), in order.
+	ControlFiles []ControlFile
+}
+
+//ControlFile is a file in ExtraControlFiles.
+type ControlFile struct {
+	Name    string
+	Content []byte
+	Mode    os.FileMode
+}
+
+//AddControlFile adds a file to the control area of the package.
+func (e *ExtraControlFiles) AddControlFile(name string, content []byte, mode os.FileMode) {
+	e.ControlFiles = append(e.ControlFiles, ControlFile{name, content, mode})
+}
+
+//ValidateControlFileNames returns an error for each control file whose name
+//is not accepted by the given function, or that is given more than once.
+func (e ExtraControlFiles) ValidateControlFileNames(formatName string, isAcceptable func(name string) bool) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for _, file := range e.ControlFiles {
+		switch {
+		case !isAcceptable(file.Name):
+			errs = append(errs, fmt.Errorf("Control file name \"%s\" is not acceptable for %s packages", file.Name, formatName))
+		case seen[file.Name]:
+			errs = append(errs, fmt.Errorf("Control file \"%s\" is given more than once", file.Name))
+		}
+		seen[file.Name] = true
+	}
+	return errs
+}
+
+//ComputeChecksums returns the hex-encoded MD5, SHA-256 and SHA-512 digests of
+//the given package file, with the keys "md5", "sha256" and "sha512".
+func ComputeChecksums(data []byte) map[string]string {
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+	sha512sum := sha512.Sum512(data)
+	return map[string]string{
+		"md5":    hex.EncodeToString(md5sum[:]),
+		"sha256": hex.EncodeToString(sha256sum[:]),
+		"sha512": hex.EncodeToString(sha512sum[:]),
+	}
+}
+
+//ErrNotBuilt is returned by the Checksums() methods of generators when Build()
+//has not been called successfully yet.
+var ErrNotBuilt = errors.New("package has not been built yet")
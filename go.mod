@@ -1 +1,3 @@
 module github.com/holocm/libpackagebuild
+
+go 1.20
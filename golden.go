@@ -0,0 +1,216 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//CompareWithGolden compares the output of a Generator with the contents of a
+//golden file, and returns an error describing the first difference, or nil if
+//both are equivalent. This is intended for use in tests.
+//
+//Compressed data (GZip, XZ and Zstandard) is decompressed before comparison,
+//and tar and ar archives (including the tar archives inside an ar archive, as
+//found in Debian packages) are compared member-by-member. Differences that
+//only affect the compression container are therefore not reported.
+func CompareWithGolden(got []byte, goldenPath string) error {
+	expected, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		return err
+	}
+
+	gotMembers, err := archiveMembers(got, "")
+	if err != nil {
+		return fmt.Errorf("cannot read generator output: %s", err.Error())
+	}
+	expectedMembers, err := archiveMembers(expected, "")
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", goldenPath, err.Error())
+	}
+
+	for idx, e := range expectedMembers {
+		if idx >= len(gotMembers) {
+			return fmt.Errorf("member %s is missing from generator output", e.Name)
+		}
+		g := gotMembers[idx]
+		if g.Name != e.Name {
+			return fmt.Errorf("member #%d is %s in generator output, but %s in %s", idx+1, g.Name, e.Name, goldenPath)
+		}
+		if !bytes.Equal(g.Content, e.Content) {
+			return fmt.Errorf("member %s differs from %s", g.Name, goldenPath)
+		}
+	}
+	if len(gotMembers) > len(expectedMembers) {
+		return fmt.Errorf("member %s is not in %s", gotMembers[len(expectedMembers)].Name, goldenPath)
+	}
+	return nil
+}
+
+type archiveMember struct {
+	Name    string
+	Content []byte
+}
+
+//archiveMembers decompresses the given data, and splits it into the members
+//of the contained archive, recursing into archive members that are archives
+//themselves. Non-archive data yields a single member.
+func archiveMembers(data []byte, name string) ([]archiveMember, error) {
+	data, err := Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []archiveMember
+	switch {
+	case bytes.HasPrefix(data, []byte("!<arch>\n")):
+		members, err = arMembers(data)
+	case isTarArchive(data):
+		members, err = tarMembers(data)
+	default:
+		return []archiveMember{{Name: name, Content: data}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []archiveMember
+	for _, m := range members {
+		memberName := m.Name
+		if name != "" {
+			memberName = name + ":" + m.Name
+		}
+		submembers, err := archiveMembers(m.Content, memberName)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %s", memberName, err.Error())
+		}
+		result = append(result, submembers...)
+	}
+	return result, nil
+}
+
+//Decompress detects the compression format (XZ, Zstandard or GZip) of the
+//given data by its magic number and returns the uncompressed data. Data in any
+//other format is returned unchanged. Since the standard library has no XZ or
+//Zstandard support, these formats require the "xz" and "zstd" binaries.
+func Decompress(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xFD7zXZ\x00")):
+		//since we don't have a "compress/xz" package, use the "xz" binary instead
+		return runDecompressor(data, "xz", "--decompress", "--stdout")
+	case bytes.HasPrefix(data, []byte("\x28\xB5\x2F\xFD")):
+		//same for zstd
+		return runDecompressor(data, "zstd", "--decompress", "--stdout")
+	case bytes.HasPrefix(data, []byte("\x1F\x8B")):
+		gzr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		return ioutil.ReadAll(gzr)
+	default:
+		return data, nil
+	}
+}
+
+//runDecompressor runs the given decompression program on the data. Its error
+//output is included in the returned error.
+func runDecompressor(data []byte, program string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("%s failed: %s", program, err.Error())
+		}
+		return nil, fmt.Errorf("%s failed: %s", program, strings.Replace(msg, "\n", " ", -1))
+	}
+	return stdout.Bytes(), nil
+}
+
+func isTarArchive(data []byte) bool {
+	//"ustar" magic at offset 257 (covers both POSIX and GNU tar)
+	return len(data) >= 512 && bytes.HasPrefix(data[257:], []byte("ustar"))
+}
+
+func tarMembers(data []byte) ([]archiveMember, error) {
+	var members []archiveMember
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		//include the metadata in the comparison, but not in a way that
+		//depends on the exact header encoding
+		meta := fmt.Sprintf("type=%c mode=%o uid=%d gid=%d link=%s\n",
+			hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Linkname)
+		members = append(members, archiveMember{
+			Name:    hdr.Name,
+			Content: append([]byte(meta), content...),
+		})
+	}
+}
+
+func arMembers(data []byte) ([]archiveMember, error) {
+	var members []archiveMember
+	data = data[8:] //skip global header "!<arch>\n"
+	for len(data) > 0 {
+		if len(data) < 60 {
+			return nil, errors.New("truncated ar member header")
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(data[0:16])), "/")
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for ar member %s: %s", name, err.Error())
+		}
+		data = data[60:]
+		if len(data) < size {
+			return nil, fmt.Errorf("truncated ar member %s", name)
+		}
+		members = append(members, archiveMember{Name: name, Content: data[:size]})
+		data = data[size:]
+		//members are padded to an even length
+		if size%2 == 1 && len(data) > 0 {
+			data = data[1:]
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,79 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	payload := []byte("hello world\n")
+
+	var gzBuf bytes.Buffer
+	gzw := gzip.NewWriter(&gzBuf)
+	_, err := gzw.Write(payload)
+	must(t, err)
+	must(t, gzw.Close())
+
+	inputs := map[string][]byte{
+		"uncompressed": payload,
+		"gzip":         gzBuf.Bytes(),
+	}
+	for _, tool := range []string{"xz", "zstd"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Logf("skipping %s: %s", tool, err.Error())
+			continue
+		}
+		cmd := exec.Command(tool, "--compress", "--stdout")
+		cmd.Stdin = bytes.NewReader(payload)
+		compressed, err := cmd.Output()
+		must(t, err)
+		inputs[tool] = compressed
+	}
+
+	for desc, input := range inputs {
+		output, err := Decompress(input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", desc, err.Error())
+			continue
+		}
+		if !bytes.Equal(output, payload) {
+			t.Errorf("%s: expected %q, got %q", desc, payload, output)
+		}
+	}
+}
+
+func TestDecompressReportsErrors(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not available")
+	}
+	//valid XZ magic, but truncated stream
+	_, err := Decompress([]byte("\xFD7zXZ\x00garbage"))
+	if err == nil {
+		t.Fatal("expected error for corrupt XZ data, but got none")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "xz failed: ") || msg == "xz failed: exit status 1" {
+		t.Errorf("expected error to include the output of xz, but got: %s", msg)
+	}
+}
@@ -0,0 +1,386 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//JSONOptions configures Package.ToJSON().
+type JSONOptions struct {
+	//OmitFSRoot leaves out the list of files and directories.
+	OmitFSRoot bool
+	//InlineContents includes the contents of regular files and the sources of
+	//templates. By default, only their size and SHA-256 digest are included.
+	InlineContents bool
+}
+
+//MarshalJSON implements the json.Marshaler interface. It is equivalent to
+//ToJSON() with default options.
+func (p *Package) MarshalJSON() ([]byte, error) {
+	return p.ToJSON(JSONOptions{})
+}
+
+//ToJSON returns a JSON representation of this package. The representation is
+//canonical: Two packages with the same ToJSON() result (with the same options)
+//will result in identical packages when built with the same generator.
+//Files and directories are listed in the order of Walk(). The DirDefaults of
+//a directory are only included when they differ from the ones inherited from
+//its parent directory, and FileDefaults are only included for the root
+//directory (since they are not used anywhere else).
+func (p *Package) ToJSON(opts JSONOptions) ([]byte, error) {
+	data := jsonPackage{
+		Name:                  p.Name,
+		Version:               p.Version,
+		Release:               p.Release,
+		Epoch:                 p.Epoch,
+		Description:           p.Description,
+		Author:                p.Author,
+		Maintainer:            p.Maintainer,
+		Source:                p.Source,
+		Vendor:                p.Vendor,
+		AutoInstallHint:       p.AutoInstallHint,
+		Architecture:          architectureNames[p.Architecture],
+		ArchitectureInput:     p.ArchitectureInput,
+		Requires:              toJSONRelations(p.Requires),
+		PreDepends:            toJSONRelations(p.PreDepends),
+		Provides:              toJSONRelations(p.Provides),
+		ProvidedLibraries:     p.ProvidedLibraries,
+		Conflicts:             toJSONRelations(p.Conflicts),
+		Replaces:              toJSONRelations(p.Replaces),
+		Essential:             p.Essential,
+		BuildEssential:        p.BuildEssential,
+		Prefixes:              p.Prefixes,
+		RefreshAppStreamCache: p.RefreshAppStreamCache,
+		ForceRootOwnership:    p.ForceRootOwnership,
+		OptionalChecks:        p.OptionalChecks,
+		AllowedEmptyFiles:     p.AllowedEmptyFiles,
+	}
+	if data.Architecture == "" {
+		return nil, fmt.Errorf("unknown architecture %d", p.Architecture)
+	}
+	for _, trigger := range p.Triggers {
+		data.Triggers = append(data.Triggers, jsonTrigger{trigger.Directive, trigger.Name})
+	}
+	for _, doc := range p.DocFiles {
+		d := jsonDocFile{
+			Name:    doc.Name,
+			License: doc.License,
+			SHA256:  (&filesystem.RegularFile{Content: doc.Content}).SHA256Digest(),
+		}
+		if opts.InlineContents {
+			content := doc.Content
+			d.Content = &content
+		}
+		data.DocFiles = append(data.DocFiles, d)
+	}
+	for _, action := range p.Actions {
+		data.Actions = append(data.Actions, jsonAction{
+			Type:        actionTypeNames[action.Type],
+			Interpreter: action.Interpreter,
+			Content:     action.Content,
+		})
+	}
+	for _, trigger := range p.RPMTriggers {
+		data.RPMTriggers = append(data.RPMTriggers, jsonRPMTrigger{
+			Type:        rpmTriggerTypeNames[trigger.Type],
+			Target:      toJSONRelations([]PackageRelation{trigger.Target})[0],
+			Interpreter: trigger.Interpreter,
+			Content:     trigger.Content,
+		})
+	}
+
+	if p.FSRoot != nil && !opts.OmitFSRoot {
+		dirDefaults := make(map[string]filesystem.NodeMetadata)
+		err := p.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+			n, err := toJSONNode(absolutePath, node, opts.InlineContents)
+			if dir, ok := node.(*filesystem.Directory); ok {
+				n.setDefaults(absolutePath, dir, dirDefaults)
+			}
+			data.Files = append(data.Files, n)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//do not escape "<" and ">" (which appear in version constraints and
+	//mail addresses) like json.Marshal() would
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+//architectureNames contains the names of all architectures in the JSON
+//representation of a package.
+var architectureNames = map[Architecture]string{
+	ArchitectureAny:      "any",
+	ArchitectureI386:     "i386",
+	ArchitectureX86_64:   "x86_64",
+	ArchitectureARMv5:    "armv5",
+	ArchitectureARMv6h:   "armv6h",
+	ArchitectureARMv7h:   "armv7h",
+	ArchitectureAArch64:  "aarch64",
+	ArchitectureARMv7:    "armv7",
+	ArchitectureMIPS:     "mips",
+	ArchitectureMIPS64EL: "mips64el",
+	ArchitectureLoong64:  "loong64",
+}
+
+var actionTypeNames = map[uint]string{
+	SetupAction:   "setup",
+	CleanupAction: "cleanup",
+}
+
+var rpmTriggerTypeNames = map[uint]string{
+	RPMTriggerIn:     "in",
+	RPMTriggerUn:     "un",
+	RPMTriggerPostUn: "postun",
+}
+
+type jsonPackage struct {
+	Name                  string           `json:"name"`
+	Version               string           `json:"version"`
+	Release               uint             `json:"release,omitempty"`
+	Epoch                 uint             `json:"epoch,omitempty"`
+	Description           string           `json:"description,omitempty"`
+	Author                string           `json:"author,omitempty"`
+	Maintainer            string           `json:"maintainer,omitempty"`
+	Source                string           `json:"source,omitempty"`
+	Vendor                string           `json:"vendor,omitempty"`
+	AutoInstallHint       bool             `json:"auto_install_hint,omitempty"`
+	Architecture          string           `json:"architecture"`
+	ArchitectureInput     string           `json:"architecture_input,omitempty"`
+	Requires              []jsonRelation   `json:"requires,omitempty"`
+	PreDepends            []jsonRelation   `json:"pre_depends,omitempty"`
+	Provides              []jsonRelation   `json:"provides,omitempty"`
+	ProvidedLibraries     []string         `json:"provided_libraries,omitempty"`
+	Conflicts             []jsonRelation   `json:"conflicts,omitempty"`
+	Replaces              []jsonRelation   `json:"replaces,omitempty"`
+	Actions               []jsonAction     `json:"actions,omitempty"`
+	Essential             bool             `json:"essential,omitempty"`
+	BuildEssential        bool             `json:"build_essential,omitempty"`
+	Prefixes              []string         `json:"prefixes,omitempty"`
+	Triggers              []jsonTrigger    `json:"triggers,omitempty"`
+	RPMTriggers           []jsonRPMTrigger `json:"rpm_triggers,omitempty"`
+	DocFiles              []jsonDocFile    `json:"doc_files,omitempty"`
+	RefreshAppStreamCache bool             `json:"refresh_appstream_cache,omitempty"`
+	ForceRootOwnership    bool             `json:"force_root_ownership,omitempty"`
+	OptionalChecks        OptionalCheck    `json:"optional_checks,omitempty"`
+	AllowedEmptyFiles     []string         `json:"allowed_empty_files,omitempty"`
+	Files                 []jsonNode       `json:"files,omitempty"`
+}
+
+type jsonRelation struct {
+	Package     string           `json:"package"`
+	Constraints []jsonConstraint `json:"constraints,omitempty"`
+}
+
+type jsonConstraint struct {
+	Relation string `json:"relation"`
+	Version  string `json:"version"`
+}
+
+type jsonTrigger struct {
+	Directive string `json:"directive"`
+	Name      string `json:"name"`
+}
+
+type jsonDocFile struct {
+	Name    string  `json:"name"`
+	License bool    `json:"license,omitempty"`
+	SHA256  string  `json:"sha256"`
+	Content *string `json:"content,omitempty"`
+}
+
+type jsonAction struct {
+	Type        string `json:"type"`
+	Interpreter string `json:"interpreter,omitempty"`
+	Content     string `json:"content"`
+}
+
+type jsonRPMTrigger struct {
+	Type        string       `json:"type"`
+	Target      jsonRelation `json:"target"`
+	Interpreter string       `json:"interpreter,omitempty"`
+	Content     string       `json:"content"`
+}
+
+type jsonNode struct {
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Implicit bool        `json:"implicit,omitempty"`
+	Mode     string      `json:"mode,omitempty"`
+	Owner    interface{} `json:"owner,omitempty"`
+	Group    interface{} `json:"group,omitempty"`
+	Size     int64       `json:"size,omitempty"`
+	SHA256   string      `json:"sha256,omitempty"`
+	Content  *string     `json:"content,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	Target   string      `json:"target,omitempty"`
+	Dangling bool        `json:"dangling,omitempty"`
+	//DirDefaults and FileDefaults are only used for directories.
+	DirDefaults  *jsonMetadata `json:"dir_defaults,omitempty"`
+	FileDefaults *jsonMetadata `json:"file_defaults,omitempty"`
+	//Source is only used by LoadPackage(): It references a file on the build
+	//system whose contents shall be used for this node.
+	Source string `json:"source,omitempty"`
+}
+
+type jsonMetadata struct {
+	Mode  string      `json:"mode,omitempty"`
+	Owner interface{} `json:"owner,omitempty"`
+	Group interface{} `json:"group,omitempty"`
+}
+
+func toJSONRelations(rels []PackageRelation) []jsonRelation {
+	var result []jsonRelation
+	for _, rel := range rels {
+		r := jsonRelation{Package: rel.RelatedPackage}
+		for _, c := range rel.Constraints {
+			r.Constraints = append(r.Constraints, jsonConstraint{c.Relation, c.Version})
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func toJSONNode(absolutePath string, node filesystem.Node, inlineContents bool) (jsonNode, error) {
+	result := jsonNode{Path: absolutePath}
+	switch n := node.(type) {
+	case *filesystem.Directory:
+		result.Type = "directory"
+		result.Implicit = n.Implicit
+		result.setMetadata(n.Metadata)
+	case *filesystem.RegularFile:
+		result.Type = "file"
+		result.setMetadata(n.Metadata)
+		result.Size = int64(len(n.Content))
+		result.SHA256 = n.SHA256Digest()
+		if inlineContents {
+			result.Content = &n.Content
+		}
+	case *filesystem.ReaderFile:
+		result.Type = "file"
+		result.setMetadata(n.Metadata)
+		result.Size = n.Size
+		if inlineContents {
+			var buf bytes.Buffer
+			_, err := n.WriteTo(&buf)
+			if err != nil {
+				return result, fmt.Errorf("cannot read %s: %s", absolutePath, err.Error())
+			}
+			content := buf.String()
+			result.Content = &content
+			result.SHA256 = (&filesystem.RegularFile{Content: content}).SHA256Digest()
+		} else {
+			var err error
+			_, result.SHA256, err = n.Digests()
+			if err != nil {
+				return result, fmt.Errorf("cannot read %s: %s", absolutePath, err.Error())
+			}
+		}
+	case *filesystem.TemplateFile:
+		result.Type = "template"
+		result.setMetadata(n.Metadata)
+		result.SHA256 = (&filesystem.RegularFile{Content: n.Template}).SHA256Digest()
+		result.Data = n.Data
+		if inlineContents {
+			result.Content = &n.Template
+		}
+	case *filesystem.Symlink:
+		result.Type = "symlink"
+		result.Target = n.Target
+		result.Dangling = n.Dangling
+	case *filesystem.Hardlink:
+		result.Type = "hardlink"
+		result.Target = n.Target
+	default:
+		return result, fmt.Errorf("cannot serialize %s: unknown node type %T", absolutePath, node)
+	}
+	return result, nil
+}
+
+func (n *jsonNode) setMetadata(m filesystem.NodeMetadata) {
+	md := toJSONMetadata(m)
+	n.Mode, n.Owner, n.Group = md.Mode, md.Owner, md.Group
+}
+
+//setDefaults serializes the DirDefaults and FileDefaults of a directory.
+//dirDefaults records the effective DirDefaults of all directories visited so
+//far, since the DirDefaults of a directory are only serialized when they
+//differ from the ones that it would inherit from its parent.
+func (n *jsonNode) setDefaults(absolutePath string, dir *filesystem.Directory, dirDefaults map[string]filesystem.NodeMetadata) {
+	//a nil DirDefaults is equivalent to mode 0755 and owner root:root
+	defaults := filesystem.NodeMetadata{Mode: 0755}
+	if dir.DirDefaults != nil {
+		defaults = *dir.DirDefaults
+	}
+	dirDefaults[absolutePath] = defaults
+
+	if absolutePath == "/" {
+		if dir.DirDefaults != nil {
+			md := toJSONMetadata(defaults)
+			n.DirDefaults = &md
+		}
+		if dir.FileDefaults != nil {
+			md := toJSONMetadata(*dir.FileDefaults)
+			n.FileDefaults = &md
+		}
+		return
+	}
+	if !reflect.DeepEqual(defaults, dirDefaults[path.Dir(absolutePath)]) {
+		md := toJSONMetadata(defaults)
+		n.DirDefaults = &md
+	}
+}
+
+func toJSONMetadata(m filesystem.NodeMetadata) jsonMetadata {
+	return jsonMetadata{
+		Mode:  fmt.Sprintf("%04o", uint32(m.Mode)),
+		Owner: toJSONOwner(m.Owner),
+		Group: toJSONOwner(m.Group),
+	}
+}
+
+//toJSONOwner represents owners and groups as a name if one is given, or as a
+//numeric ID otherwise.
+func toJSONOwner(id *filesystem.IntOrString) interface{} {
+	switch {
+	case id == nil:
+		return nil
+	case id.Str != "":
+		return id.Str
+	default:
+		return id.Int
+	}
+}
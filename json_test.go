@@ -0,0 +1,97 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+func TestJSONRoundTripDefaults(t *testing.T) {
+	pkg := &Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Architecture: ArchitectureAny,
+		FSRoot:       filesystem.NewDirectory(),
+	}
+	pkg.FSRoot.DirDefaults = &filesystem.NodeMetadata{Mode: 0750, Group: &filesystem.IntOrString{Str: "wheel"}}
+	pkg.FSRoot.FileDefaults = &filesystem.NodeMetadata{Mode: 0640, Owner: &filesystem.IntOrString{Int: 42}}
+	opt := filesystem.NewDirectory()
+	opt.DirDefaults = &filesystem.NodeMetadata{Mode: 0700}
+	must(t, pkg.InsertFSNode("/opt", opt))
+	must(t, pkg.InsertFSNode("/opt/foo/bin/foo", &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0755}}))
+	must(t, pkg.InsertFSNode("/usr/share/foo/data", &filesystem.RegularFile{Content: "data", Metadata: filesystem.NodeMetadata{Mode: 0644}}))
+
+	data, err := pkg.ToJSON(JSONOptions{InlineContents: true})
+	must(t, err)
+	loaded, err := LoadPackage(bytes.NewReader(data), "json")
+	must(t, err)
+	loadedData, err := loaded.ToJSON(JSONOptions{InlineContents: true})
+	must(t, err)
+	if !bytes.Equal(data, loadedData) {
+		t.Errorf("JSON representation changed on round trip:\n  before: %s\n  after:  %s", data, loadedData)
+	}
+
+	//the defaults must also apply to nodes inserted after loading
+	must(t, loaded.InsertFSNode("/opt/foo/lib/libfoo.so", &filesystem.RegularFile{Content: "lib"}))
+	must(t, loaded.InsertFSNode("/var/lib/foo/state", &filesystem.RegularFile{Content: "state"}))
+	assertDirMode(t, loaded, "opt/foo/lib", 0700)
+	assertDirMode(t, loaded, "var/lib/foo", 0750)
+	if md := loaded.FSRoot.GeneratedFileMetadata(); md.Mode != 0640 || md.UID() != 42 {
+		t.Errorf("expected generated files to have mode 0640 and owner 42, but got %#v", md)
+	}
+}
+
+func TestJSONRejectsMisplacedDefaults(t *testing.T) {
+	testCases := []string{
+		`{"path":"/etc/foo","type":"file","content":"","dir_defaults":{"mode":"0700"}}`,
+		`{"path":"/etc","type":"directory","file_defaults":{"mode":"0600"}}`,
+		`{"path":"/etc","type":"directory","dir_defaults":{"mode":"foo"}}`,
+	}
+	for _, file := range testCases {
+		input := `{"name":"foo","version":"1.0","architecture":"any","files":[` + file + `]}`
+		_, err := LoadPackage(bytes.NewReader([]byte(input)), "json")
+		if err == nil {
+			t.Errorf("expected error when loading %s", file)
+		}
+	}
+}
+
+func assertDirMode(t *testing.T, pkg *Package, relPath string, mode uint32) {
+	t.Helper()
+	node := pkg.FSRoot.Lookup(relPath)
+	dir, ok := node.(*filesystem.Directory)
+	if !ok {
+		t.Errorf("expected directory at %s, but got %T", relPath, node)
+		return
+	}
+	if uint32(dir.Metadata.Mode) != mode {
+		t.Errorf("expected mode %04o for %s, but got %04o", mode, relPath, uint32(dir.Metadata.Mode))
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
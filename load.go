@@ -0,0 +1,344 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//LoadPackage constructs a Package from a declarative configuration. The only
+//supported format is "json", using the same schema as Package.ToJSON().
+//Relative paths in the "source" fields of file entries are resolved relative
+//to the working directory; use LoadPackageFile() to resolve them relative to
+//the configuration file instead.
+//
+//In addition to the fields produced by ToJSON(), a regular file may have a
+//"source" field instead of "content", referencing a file on the build system
+//whose contents are read when the package is built. The "size" and "sha256"
+//fields are ignored when loading. When "mode" is omitted, it defaults to 0755
+//for directories and 0644 for files. Implicit directories may be given, but
+//are skipped unless they have "dir_defaults" of their own.
+//
+//A directory may have "dir_defaults" (see Directory.DirDefaults). Directories
+//without "dir_defaults" inherit them from their parent directory. The root
+//directory may also have "file_defaults" (see Directory.FileDefaults). When
+//"mode" is omitted in these, it defaults to 0755 and 0644, respectively.
+func LoadPackage(r io.Reader, format string) (*Package, error) {
+	return loadPackage(r, format, "")
+}
+
+//LoadPackageFile is like LoadPackage, but reads the configuration from the
+//given file. The format is derived from the file name extension, and relative
+//source paths are resolved relative to the directory containing the file.
+func LoadPackageFile(path string) (*Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	return loadPackage(f, format, filepath.Dir(path))
+}
+
+func loadPackage(r io.Reader, format, baseDir string) (*Package, error) {
+	if format != "json" {
+		return nil, fmt.Errorf("cannot load package: unsupported format %q", format)
+	}
+
+	var data jsonPackage
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load package: %s", err.Error())
+	}
+
+	pkg, errs := data.toPackage(baseDir)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for idx, err := range errs {
+			msgs[idx] = err.Error()
+		}
+		return nil, fmt.Errorf("cannot load package: %s", strings.Join(msgs, "; "))
+	}
+	return pkg, nil
+}
+
+func (data jsonPackage) toPackage(baseDir string) (*Package, []error) {
+	var ec errorCollector
+
+	if data.Name == "" {
+		ec.Addf("the \"name\" field is required")
+	}
+	if data.Version == "" {
+		ec.Addf("the \"version\" field is required")
+	}
+	arch, ok := parseArchitectureName(data.Architecture)
+	switch {
+	case data.Architecture == "":
+		ec.Addf("the \"architecture\" field is required")
+	case !ok:
+		ec.Addf("unknown architecture %q", data.Architecture)
+	}
+
+	pkg := &Package{
+		Name:                  data.Name,
+		Version:               data.Version,
+		Release:               data.Release,
+		Epoch:                 data.Epoch,
+		Description:           data.Description,
+		Author:                data.Author,
+		Maintainer:            data.Maintainer,
+		Source:                data.Source,
+		Vendor:                data.Vendor,
+		AutoInstallHint:       data.AutoInstallHint,
+		Architecture:          arch,
+		ArchitectureInput:     data.ArchitectureInput,
+		Requires:              fromJSONRelations(data.Requires),
+		PreDepends:            fromJSONRelations(data.PreDepends),
+		Provides:              fromJSONRelations(data.Provides),
+		ProvidedLibraries:     data.ProvidedLibraries,
+		Conflicts:             fromJSONRelations(data.Conflicts),
+		Replaces:              fromJSONRelations(data.Replaces),
+		Essential:             data.Essential,
+		BuildEssential:        data.BuildEssential,
+		Prefixes:              data.Prefixes,
+		RefreshAppStreamCache: data.RefreshAppStreamCache,
+		FSRoot:                filesystem.NewDirectory(),
+		ForceRootOwnership:    data.ForceRootOwnership,
+		OptionalChecks:        data.OptionalChecks,
+		AllowedEmptyFiles:     data.AllowedEmptyFiles,
+	}
+
+	for _, action := range data.Actions {
+		actionType, ok := parseJSONName(actionTypeNames, action.Type)
+		if !ok {
+			ec.Addf("unknown action type %q", action.Type)
+		}
+		pkg.Actions = append(pkg.Actions, PackageAction{
+			Type:        actionType,
+			Content:     action.Content,
+			Interpreter: action.Interpreter,
+		})
+	}
+	for _, trigger := range data.Triggers {
+		pkg.Triggers = append(pkg.Triggers, Trigger{trigger.Directive, trigger.Name})
+	}
+	for _, trigger := range data.RPMTriggers {
+		triggerType, ok := parseJSONName(rpmTriggerTypeNames, trigger.Type)
+		if !ok {
+			ec.Addf("unknown RPM trigger type %q", trigger.Type)
+		}
+		pkg.RPMTriggers = append(pkg.RPMTriggers, RPMTrigger{
+			Type:        triggerType,
+			Target:      fromJSONRelations([]jsonRelation{trigger.Target})[0],
+			Content:     trigger.Content,
+			Interpreter: trigger.Interpreter,
+		})
+	}
+	for _, doc := range data.DocFiles {
+		if doc.Content == nil {
+			ec.Addf("doc file %q has no content", doc.Name)
+			continue
+		}
+		pkg.DocFiles = append(pkg.DocFiles, DocFile{
+			Name:    doc.Name,
+			Content: *doc.Content,
+			License: doc.License,
+		})
+	}
+
+	for _, n := range data.Files {
+		ec.Add(n.insertInto(pkg, baseDir))
+	}
+
+	return pkg, ec.Errors
+}
+
+func fromJSONRelations(rels []jsonRelation) []PackageRelation {
+	var result []PackageRelation
+	for _, rel := range rels {
+		r := PackageRelation{RelatedPackage: rel.Package}
+		for _, c := range rel.Constraints {
+			r.Constraints = append(r.Constraints, VersionConstraint{c.Relation, c.Version})
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+//parseArchitectureName is the reverse lookup for architectureNames.
+func parseArchitectureName(name string) (Architecture, bool) {
+	for arch, value := range architectureNames {
+		if value == name {
+			return arch, true
+		}
+	}
+	return 0, false
+}
+
+//parseJSONName is the reverse lookup for actionTypeNames and
+//rpmTriggerTypeNames.
+func parseJSONName(names map[uint]string, name string) (uint, bool) {
+	for key, value := range names {
+		if value == name {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+func (n jsonNode) insertInto(pkg *Package, baseDir string) error {
+	defaultMode := os.FileMode(0644)
+	if n.Type == "directory" {
+		defaultMode = 0755
+	}
+	md, err := n.metadata(defaultMode)
+	if err != nil {
+		return fmt.Errorf("invalid entry for %s: %s", n.Path, err.Error())
+	}
+
+	if n.Type != "directory" && (n.DirDefaults != nil || n.FileDefaults != nil) {
+		return fmt.Errorf("invalid entry for %s: \"dir_defaults\" and \"file_defaults\" are only allowed for directories", n.Path)
+	}
+
+	var node filesystem.Node
+	switch n.Type {
+	case "directory":
+		var dirDefaults, fileDefaults *filesystem.NodeMetadata
+		if n.DirDefaults != nil {
+			defaults, err := n.DirDefaults.metadata(0755)
+			if err != nil {
+				return fmt.Errorf("invalid dir_defaults for %s: %s", n.Path, err.Error())
+			}
+			dirDefaults = &defaults
+		}
+		if n.FileDefaults != nil {
+			if n.Path != "/" {
+				return fmt.Errorf("invalid entry for %s: \"file_defaults\" is only allowed for the root directory", n.Path)
+			}
+			defaults, err := n.FileDefaults.metadata(0644)
+			if err != nil {
+				return fmt.Errorf("invalid file_defaults for %s: %s", n.Path, err.Error())
+			}
+			fileDefaults = &defaults
+		}
+		if n.Path == "/" {
+			pkg.FSRoot.Metadata = md
+			pkg.FSRoot.DirDefaults = dirDefaults
+			pkg.FSRoot.FileDefaults = fileDefaults
+			return nil
+		}
+		if n.Implicit && dirDefaults == nil {
+			return nil
+		}
+		dir := filesystem.NewDirectory()
+		dir.Metadata = md
+		dir.Implicit = n.Implicit
+		dir.DirDefaults = dirDefaults
+		node = dir
+	case "file":
+		switch {
+		case n.Source != "" && n.Content != nil:
+			return fmt.Errorf("invalid entry for %s: \"source\" and \"content\" are mutually exclusive", n.Path)
+		case n.Source != "":
+			path := n.Source
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			node, err = filesystem.NewMappedFile(path, md)
+			if err != nil {
+				return fmt.Errorf("invalid entry for %s: %s", n.Path, err.Error())
+			}
+		case n.Content != nil:
+			node = &filesystem.RegularFile{Content: *n.Content, Metadata: md}
+		default:
+			return fmt.Errorf("invalid entry for %s: \"source\" or \"content\" is required", n.Path)
+		}
+	case "template":
+		if n.Content == nil {
+			return fmt.Errorf("invalid entry for %s: \"content\" is required", n.Path)
+		}
+		node = &filesystem.TemplateFile{Template: *n.Content, Data: n.Data, Metadata: md}
+	case "symlink":
+		node = &filesystem.Symlink{Target: n.Target, Dangling: n.Dangling}
+	case "hardlink":
+		node = &filesystem.Hardlink{Target: n.Target}
+	default:
+		return fmt.Errorf("invalid entry for %s: unknown type %q", n.Path, n.Type)
+	}
+
+	return pkg.InsertFSNode(n.Path, node)
+}
+
+//metadata parses the metadata of this node. If no mode is given, the
+//defaultMode is used.
+func (n jsonNode) metadata(defaultMode os.FileMode) (filesystem.NodeMetadata, error) {
+	return jsonMetadata{n.Mode, n.Owner, n.Group}.metadata(defaultMode)
+}
+
+//metadata parses this metadata. If no mode is given, the defaultMode is used.
+func (m jsonMetadata) metadata(defaultMode os.FileMode) (filesystem.NodeMetadata, error) {
+	var err error
+	md := filesystem.NodeMetadata{Mode: defaultMode}
+	if m.Mode != "" {
+		mode, err := strconv.ParseUint(m.Mode, 8, 32)
+		if err != nil {
+			return md, fmt.Errorf("invalid mode %q", m.Mode)
+		}
+		md.Mode = os.FileMode(mode)
+	}
+	md.Owner, err = fromJSONOwner(m.Owner)
+	if err != nil {
+		return md, fmt.Errorf("invalid owner: %s", err.Error())
+	}
+	md.Group, err = fromJSONOwner(m.Group)
+	if err != nil {
+		return md, fmt.Errorf("invalid group: %s", err.Error())
+	}
+	return md, nil
+}
+
+//fromJSONOwner is the reverse of toJSONOwner.
+func fromJSONOwner(value interface{}) (*filesystem.IntOrString, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return &filesystem.IntOrString{Str: value}, nil
+	case float64:
+		id := uint32(value)
+		if float64(id) != value {
+			return nil, fmt.Errorf("%v is not a valid ID", value)
+		}
+		return &filesystem.IntOrString{Int: id}, nil
+	default:
+		return nil, errors.New("expected a name or a numeric ID")
+	}
+}
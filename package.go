@@ -20,8 +20,9 @@
 package build
 
 import (
+	"errors"
 	"fmt"
-	"path/filepath"
+	"path"
 	"strings"
 
 	"github.com/holocm/libpackagebuild/filesystem"
@@ -46,8 +47,27 @@ const (
 	ArchitectureARMv7h
 	// ArchitectureAArch64 = AArch64 (ARMv8 64-bit)
 	ArchitectureAArch64
+	// ArchitectureARMv7 = ARMv7 (softfloat)
+	ArchitectureARMv7
+	// ArchitectureMIPS = MIPS (32-bit, big-endian)
+	ArchitectureMIPS
+	// ArchitectureMIPS64EL = MIPS64 (64-bit, little-endian)
+	ArchitectureMIPS64EL
+	// ArchitectureLoong64 = LoongArch (64-bit)
+	ArchitectureLoong64
 )
 
+//Is64Bit returns whether binaries for this architecture are 64-bit ELF
+//binaries. For ArchitectureAny, false is returned.
+func (a Architecture) Is64Bit() bool {
+	switch a {
+	case ArchitectureX86_64, ArchitectureAArch64, ArchitectureMIPS64EL, ArchitectureLoong64:
+		return true
+	default:
+		return false
+	}
+}
+
 //Package contains all information about a single package. This representation
 //will be passed into the generator backends.
 type Package struct {
@@ -65,12 +85,36 @@ type Package struct {
 	//usually results in the epoch not being shown in the combined version
 	//string at all.
 	Epoch uint
-	//Description is the optional package description.
+	//Description is the optional package description. Its first line is the
+	//synopsis, and further lines are the extended description (see
+	//DescriptionSynopsis() and ExtendedDescription()). Generators for formats
+	//that have only one description field flatten it into one line.
 	Description string
 	//Author contains the package's author's name and mail address in the form
 	//"Firstname Lastname <email.address@server.tld>", if this information is
-	//available.
+	//available. This is the upstream author of the packaged software. When
+	//a Maintainer is set, the Author is still recorded (see UpstreamAuthor()).
 	Author string
+	//Maintainer contains the name and mail address of the person who
+	//maintains the package (the "packager"), in the same form as Author. Use
+	//PackagerName() to read it, since it falls back to Author when empty.
+	Maintainer string
+	//Source optionally records where the package contents came from, e.g. a
+	//Git repository URL and commit ID. It is recorded as "X-Source" in the
+	//Debian control file, as a comment in pacman's .PKGINFO, and as the URL
+	//of RPM packages.
+	Source string
+	//Vendor optionally names the organization that distributes the package.
+	//It is recorded as "Origin" in the Debian control file, as a comment in
+	//pacman's .PKGINFO, and as the Vendor of RPM packages.
+	Vendor string
+	//AutoInstallHint marks packages that are usually installed as a
+	//dependency of other packages (e.g. metadata packages), so that
+	//front-ends can default the install reason accordingly. None of the
+	//package formats has a standard field for this, so it is recorded as
+	//"X-Install-Reason: dependency" in the Debian control file and as a
+	//comment in pacman's .PKGINFO. It is ignored by RPM.
+	AutoInstallHint bool
 	//Architecture specifies the target architecture of this package.
 	Architecture Architecture
 	//ArchitectureInput contains the raw architecture string specified by the
@@ -80,9 +124,35 @@ type Package struct {
 	//for this package and thus must be installed together with this package.
 	//This is called "Depends" by some package managers.
 	Requires []PackageRelation
+	//PreDepends is like Requires, but the required packages must be fully
+	//installed and configured before this package can be unpacked. This is
+	//only supported by Debian and ignored by other generators.
+	PreDepends []PackageRelation
 	//Provides contains a list of packages that this package provides features
-	//of (or virtual packages whose capabilities it implements).
+	//of (or virtual packages whose capabilities it implements). A provided
+	//package may declare its version with a single "=" constraint.
+	//
+	//Virtual packages (e.g. "mail-transport-agent") are declared without a
+	//version. All generators render them as a plain entry in the format's own
+	//provides field, so that requirements on the virtual package are
+	//satisfied by this package. If only one provider of the virtual package
+	//may be installed at a time, list it in Conflicts and Replaces as well.
+	//Note that on Debian, this does not choose which provider's files are
+	//used for shared commands like /usr/sbin/sendmail; that is done by
+	//registering alternatives with update-alternatives in the Actions.
+	//
+	//Shared libraries shall not be listed here, since their sonames are not
+	//valid package names in all formats. Use ProvidedLibraries instead.
 	Provides []PackageRelation
+	//ProvidedLibraries contains the sonames of shared libraries provided by
+	//this package, e.g. "libfoo.so.1". Each generator declares them like the
+	//format's own build tools do: pacman as "libfoo.so=1-64" (like makepkg),
+	//RPM as "libfoo.so.1()(64bit)" (like rpmbuild; without the suffix on
+	//32-bit architectures), and Debian as an entry in the "shlibs" control
+	//file (like dh_makeshlibs), since Debian has no provides for sonames.
+	//Sonames must have a version suffix, and the package must have a specific
+	//architecture.
+	ProvidedLibraries []string
 	//Conflicts contains a list of other packages that cannot be installed at
 	//the same time as this package.
 	Conflicts []PackageRelation
@@ -93,9 +163,213 @@ type Package struct {
 	//Actions contains a list of actions that can be executed while the package
 	//manager runs.
 	Actions []PackageAction
+	//Essential marks the package as essential, i.e. the package manager will
+	//refuse to remove it. This is only supported by Debian and ignored by other
+	//generators. The Debian generator warns about essential packages without
+	//maintainer scripts.
+	Essential bool
+	//BuildEssential marks the package as part of the minimal set of packages
+	//required for building packages. This is only supported by Debian and
+	//ignored by other generators.
+	BuildEssential bool
+	//Prefixes contains a list of absolute paths below which all files of this
+	//package are located. If not empty, the package is relocatable, i.e. it
+	//can be installed below a different prefix. This is only supported by RPM
+	//and ignored by other generators.
+	Prefixes []string
+	//Triggers contains a list of dpkg triggers that this package is interested
+	//in or activates. This is only supported by Debian and ignored by other
+	//generators.
+	Triggers []Trigger
+	//RPMTriggers contains a list of scripts that run when other packages are
+	//installed or removed. This is only supported by RPM and ignored by other
+	//generators.
+	RPMTriggers []RPMTrigger
+	//DocFiles contains documentation and license files that generators
+	//install at the conventional location for their package format. Use
+	//AddDoc() and AddLicenseFile() to fill this.
+	DocFiles []DocFile
+	//RefreshAppStreamCache causes the AppStream cache to be refreshed after
+	//the package has been installed or removed, if the appstreamcli program
+	//is available on the target system. This is only supported by pacman and
+	//ignored by other generators. It is set by AddAppStreamComponent().
+	RefreshAppStreamCache bool
 	//FSRoot represents the root directory of the package's file system, and
 	//contains all other files and directories recursively.
 	FSRoot *filesystem.Directory
+	//ForceRootOwnership causes all files and directories to be owned by
+	//root:root in the resulting package, regardless of their metadata in
+	//FSRoot. This makes packages reproducible across build hosts with
+	//different user and group IDs.
+	ForceRootOwnership bool
+	//OptionalChecks enables additional validations in ValidateWith() that are
+	//not performed by default.
+	OptionalChecks OptionalCheck
+	//AllowedEmptyFiles contains glob patterns (see filesystem.MatchGlob) for
+	//files that are intentionally empty and shall not be reported by
+	//CheckEmptyFiles, in addition to DefaultAllowedEmptyFiles.
+	AllowedEmptyFiles []string
+}
+
+//OptionalCheck is a bitfield used by Package.OptionalChecks to enable
+//additional validations. Unless noted otherwise, their findings are reported
+//as errors.
+type OptionalCheck uint
+
+const (
+	//CheckCaseInsensitivePaths reports paths that differ only in case, and
+	//would thus conflict on case-insensitive filesystems.
+	CheckCaseInsensitivePaths OptionalCheck = 1 << iota
+	//CheckScriptSyntax checks the syntax of shell scripts in Package.Actions
+	//by running them through `sh -n` (or `bash -n` etc., depending on the
+	//shell that the generator or the action's Interpreter uses). If the shell
+	//is not available on the build system, the check is skipped with a
+	//warning.
+	CheckScriptSyntax
+	//CheckELFArchitecture reads the headers of all ELF binaries in the
+	//package, and reports binaries that cannot run on Package.Architecture,
+	//including native binaries in packages with ArchitectureAny.
+	CheckELFArchitecture
+	//CheckExecutableBinaries warns about regular files in /bin, /sbin,
+	///usr/bin and /usr/sbin that are not executable.
+	CheckExecutableBinaries
+	//CheckNonExecutableConfig warns about executable regular files in /etc,
+	//except in directories that conventionally contain scripts (such as
+	///etc/init.d and /etc/cron.daily).
+	CheckNonExecutableConfig
+	//CheckDirectoryModes warns about directories that are readable, but not
+	//searchable (i.e. executable) for their owner, group or others.
+	CheckDirectoryModes
+	//CheckConflictingProvides reports provided packages that the package
+	//also conflicts with. This is not checked by default because
+	//"Provides: foo" together with "Conflicts: foo" is a common idiom for
+	//packages that replace "foo" (e.g. "foo-git"), or for virtual packages
+	//that only one provider may be installed for.
+	CheckConflictingProvides
+	//CheckEmptyFiles warns about regular files without content (which often
+	//indicates a bug in the program that assembled the package), except for
+	//those matching DefaultAllowedEmptyFiles or Package.AllowedEmptyFiles.
+	//Templates are checked by their rendered output. Findings are reported as
+	//warnings (see ValidateWithWarnings()).
+	CheckEmptyFiles
+	//CheckSynopsisLength warns about a DescriptionSynopsis() that is longer
+	//than MaxSynopsisLength characters. Longer synopses are truncated or
+	//wrapped by package manager frontends, and linters like rpmlint complain
+	//about them. Findings are reported as warnings (see
+	//ValidateWithWarnings()).
+	CheckSynopsisLength
+)
+
+//MaxSynopsisLength is the maximum length (in characters) of the
+//DescriptionSynopsis() accepted by CheckSynopsisLength.
+const MaxSynopsisLength = 79
+
+//DefaultAllowedEmptyFiles contains glob patterns (see filesystem.MatchGlob)
+//for files that are conventionally empty, and thus not reported by
+//CheckEmptyFiles.
+var DefaultAllowedEmptyFiles = []string{
+	"**/.keep",
+	"**/.keep_*",
+	"**/.gitkeep",
+	"**/__init__.py",
+	"**/py.typed",
+}
+
+//CheckFileModes enables all checks for file modes. To suppress one of them,
+//use e.g. `CheckFileModes &^ CheckNonExecutableConfig`. Their findings are
+//reported as warnings (see ValidateWithWarnings()).
+const CheckFileModes = CheckExecutableBinaries | CheckNonExecutableConfig | CheckDirectoryModes
+
+//Clone returns a deep copy of this package. All slices and the FSRoot are
+//copied, so generators may safely mutate the clone (including its FSRoot)
+//while the original is used elsewhere, e.g. in another goroutine.
+func (p *Package) Clone() *Package {
+	result := *p
+	result.Requires = cloneRelations(p.Requires)
+	result.PreDepends = cloneRelations(p.PreDepends)
+	result.Provides = cloneRelations(p.Provides)
+	result.Conflicts = cloneRelations(p.Conflicts)
+	result.Replaces = cloneRelations(p.Replaces)
+	if p.Actions != nil {
+		result.Actions = append([]PackageAction(nil), p.Actions...)
+	}
+	if p.ProvidedLibraries != nil {
+		result.ProvidedLibraries = append([]string(nil), p.ProvidedLibraries...)
+	}
+	if p.Prefixes != nil {
+		result.Prefixes = append([]string(nil), p.Prefixes...)
+	}
+	if p.Triggers != nil {
+		result.Triggers = append([]Trigger(nil), p.Triggers...)
+	}
+	if p.RPMTriggers != nil {
+		result.RPMTriggers = make([]RPMTrigger, len(p.RPMTriggers))
+		for idx, trigger := range p.RPMTriggers {
+			trigger.Target = cloneRelations([]PackageRelation{trigger.Target})[0]
+			result.RPMTriggers[idx] = trigger
+		}
+	}
+	if p.DocFiles != nil {
+		result.DocFiles = append([]DocFile(nil), p.DocFiles...)
+	}
+	if p.AllowedEmptyFiles != nil {
+		result.AllowedEmptyFiles = append([]string(nil), p.AllowedEmptyFiles...)
+	}
+	if p.FSRoot != nil {
+		result.FSRoot = p.FSRoot.Clone()
+	}
+	return &result
+}
+
+//PackagerName returns the Maintainer, or the Author if no Maintainer has been
+//set.
+func (p *Package) PackagerName() string {
+	if p.Maintainer != "" {
+		return p.Maintainer
+	}
+	return p.Author
+}
+
+//UpstreamAuthor returns the Author if it differs from PackagerName(), or an
+//empty string otherwise. Generators record this separately from the
+//packager: as "Uploaders" in the Debian control file, as a comment in
+//pacman's .PKGINFO, and as the Vendor of RPM packages that have no Vendor.
+func (p *Package) UpstreamAuthor() string {
+	if p.Author == p.PackagerName() {
+		return ""
+	}
+	return p.Author
+}
+
+//DescriptionSynopsis returns the first line of the Description.
+func (p *Package) DescriptionSynopsis() string {
+	lines := strings.SplitN(strings.TrimSpace(p.Description), "\n", 2)
+	return strings.TrimSpace(lines[0])
+}
+
+//ExtendedDescription returns the lines of the Description after the first
+//one, without leading and trailing empty lines. For single-line descriptions,
+//the result is empty.
+func (p *Package) ExtendedDescription() string {
+	lines := strings.SplitN(strings.TrimSpace(p.Description), "\n", 2)
+	if len(lines) < 2 {
+		return ""
+	}
+	return strings.Trim(lines[1], "\r\n")
+}
+
+func cloneRelations(rels []PackageRelation) []PackageRelation {
+	if rels == nil {
+		return nil
+	}
+	result := make([]PackageRelation, len(rels))
+	for idx, rel := range rels {
+		result[idx].RelatedPackage = rel.RelatedPackage
+		if rel.Constraints != nil {
+			result[idx].Constraints = append([]VersionConstraint(nil), rel.Constraints...)
+		}
+	}
+	return result
 }
 
 //PackageRelation declares a relation to another package. For the related
@@ -135,6 +409,11 @@ type PackageAction struct {
 	Type uint
 	//Content is a shell script that will be executed when the action is run.
 	Content string
+	//Interpreter is the absolute path to the program that executes Content,
+	//e.g. "/usr/bin/python3". If empty, Content is a shell script (which shell
+	//is used depends on the generator). Not all generators support non-shell
+	//interpreters.
+	Interpreter string
 }
 
 const (
@@ -147,14 +426,103 @@ const (
 	CleanupAction
 )
 
+//Trigger declares a dpkg trigger, see deb-triggers(5). This is only
+//supported by Debian and ignored by other generators.
+type Trigger struct {
+	//Directive is one of "interest", "interest-await", "interest-noawait",
+	//"activate", "activate-await" or "activate-noawait".
+	Directive string
+	//Name is the trigger name, or an absolute path for file triggers (e.g.
+	//"/usr/share/icons").
+	Name string
+}
+
+//RPMTrigger declares an RPM trigger script, i.e. a script that runs when a
+//different package is installed or removed.
+type RPMTrigger struct {
+	//Type determines when this trigger will be run. Acceptable values include
+	//`RPMTriggerIn`, `RPMTriggerUn` and `RPMTriggerPostUn`.
+	Type uint
+	//Target is the package whose installation or removal activates this
+	//trigger. Version constraints restrict the trigger to matching versions
+	//of the target package.
+	Target PackageRelation
+	//Content is the script that will be executed when the trigger is run.
+	Content string
+	//Interpreter is the absolute path to the program that executes Content.
+	//If empty, Content is a shell script.
+	Interpreter string
+}
+
+const (
+	//RPMTriggerIn is an acceptable value for `RPMTrigger.Type`. Such triggers
+	//run after the target package has been installed (%triggerin).
+	RPMTriggerIn = iota
+	//RPMTriggerUn is an acceptable value for `RPMTrigger.Type`. Such triggers
+	//run before the target package is removed (%triggerun).
+	RPMTriggerUn
+	//RPMTriggerPostUn is an acceptable value for `RPMTrigger.Type`. Such
+	//triggers run after the target package has been removed (%triggerpostun).
+	RPMTriggerPostUn
+)
+
+//TemplateData is the data that is passed to a filesystem.TemplateFile when
+//it is rendered during PrepareBuild().
+type TemplateData struct {
+	Name    string
+	Version string
+	Release uint
+	Epoch   uint
+	//Architecture is the architecture name as used by the package format
+	//(e.g. "amd64" for Debian, but "x86_64" for pacman).
+	Architecture string
+	//Data is the TemplateFile's own Data field.
+	Data interface{}
+}
+
 //PrepareBuild executes common preparation steps. This should be called by each
-//generator's Build() implementation.
-func (p *Package) PrepareBuild() {
+//generator's Build() implementation. The `archMap` is the same as for
+//ValidateWith(), and is used to render architecture names into templates.
+//
+//Since Build() may be called without Validate(), PrepareBuild fails if the
+//package name or version is empty, so that no package (and no file name like
+//"-0-x86_64.pkg.tar.xz") is produced for it.
+func (p *Package) PrepareBuild(archMap map[Architecture]string) error {
+	if p.Name == "" {
+		return errors.New("cannot build package: name is empty")
+	}
+	if p.Version == "" {
+		return fmt.Errorf("cannot build package %s: version is empty", p.Name)
+	}
+
+	err := p.FSRoot.RenderTemplates(func(t *filesystem.TemplateFile) interface{} {
+		return p.templateData(t, archMap)
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.ForceRootOwnership {
+		p.FSRoot.ChownRecursive("", 0, 0)
+	}
 	script := p.FSRoot.PostponeUnmaterializable("/")
 	if script != "" {
 		script = strings.TrimSuffix(script, "\n")
 		p.PrependActions(PackageAction{Type: SetupAction, Content: script})
 	}
+	return nil
+}
+
+//templateData returns the data for rendering the given TemplateFile.
+func (p *Package) templateData(t *filesystem.TemplateFile, archMap map[Architecture]string) TemplateData {
+	return TemplateData{
+		Name:         p.Name,
+		Version:      p.Version,
+		Release:      p.Release,
+		Epoch:        p.Epoch,
+		Architecture: archMap[p.Architecture],
+		Data:         t.Data,
+	}
 }
 
 //PrependActions prepends elements to p.Actions.
@@ -167,6 +535,13 @@ func (p *Package) AppendActions(actions ...PackageAction) {
 	p.Actions = append(p.Actions, actions...)
 }
 
+//AppendScript appends a shell script snippet as a new action of the given
+//type. Snippets for the same action type are combined in the order in which
+//they were added (see Script()).
+func (p *Package) AppendScript(actionType uint, snippet string) {
+	p.AppendActions(PackageAction{Type: actionType, Content: snippet})
+}
+
 //Script returns the concatenation of the scripts for all actions of the given
 //type.
 func (p *Package) Script(actionType uint) string {
@@ -179,27 +554,66 @@ func (p *Package) Script(actionType uint) string {
 	return strings.TrimSpace(strings.Join(scripts, "\n"))
 }
 
+//ScriptInterpreter returns the interpreter for the concatenation of the
+//scripts for all actions of the given type (as returned by Script()). Returns
+//an empty string if all these scripts are shell scripts without an explicit
+//Interpreter. Returns an error if the scripts require different
+//interpreters.
+func (p *Package) ScriptInterpreter(actionType uint) (string, error) {
+	result := ""
+	hasNonShell := false
+	hasDefault := false
+	for _, action := range p.Actions {
+		if action.Type != actionType {
+			continue
+		}
+		if action.Interpreter == "" {
+			hasDefault = true
+			continue
+		}
+		if result != "" && result != action.Interpreter {
+			return "", fmt.Errorf("actions of the same type require different interpreters (%q and %q)", result, action.Interpreter)
+		}
+		result = action.Interpreter
+		hasNonShell = hasNonShell || !IsShellInterpreter(action.Interpreter)
+	}
+	if hasNonShell && hasDefault {
+		return "", fmt.Errorf("actions of the same type require different interpreters (%q and a shell)", result)
+	}
+	return result, nil
+}
+
+//IsShellInterpreter returns whether the given PackageAction.Interpreter value
+//refers to a POSIX-compatible shell. The empty string is also accepted, since
+//it refers to the generator's default shell.
+func IsShellInterpreter(interpreter string) bool {
+	switch path.Base(interpreter) {
+	case ".", "sh", "bash", "dash", "ksh", "zsh":
+		return true
+	default:
+		return false
+	}
+}
+
 //InsertFSNode inserts a filesystem.Node into the package's FSRoot at the given
-//absolute path.
+//absolute path. Missing parent directories are created implicitly.
 func (p *Package) InsertFSNode(absolutePath string, entry filesystem.Node) error {
-	relPath, err := filepath.Rel("/", absolutePath)
-	if err != nil {
-		return err
-	}
-	err = p.FSRoot.Insert(entry, strings.Split(relPath, "/"), "/")
+	err := p.FSRoot.AddFile(absolutePath, entry)
 	if err != nil {
 		return fmt.Errorf("failed to insert \"%s\" into the package file system: %s", absolutePath, err.Error())
 	}
 	return nil
 }
 
-//WalkFSWithAbsolutePaths wraps the FSRoot.Wrap function, yielding absolute
-//paths (with a leading slash) to the callback.
+//WalkFSWithAbsolutePaths wraps the FSRoot.Walk function, yielding absolute
+//paths (with a leading slash) to the callback. The FSRoot itself will be
+//visited with `absolutePath = "/"`. Nodes are visited in the same order as in
+//WalkFSWithRelativePaths.
 func (p *Package) WalkFSWithAbsolutePaths(callback func(absolutePath string, node filesystem.Node) error) error {
 	return p.FSRoot.Walk("/", callback)
 }
 
-//WalkFSWithRelativePaths wraps the FSRoot.Wrap function, yielding paths
+//WalkFSWithRelativePaths wraps the FSRoot.Walk function, yielding paths
 //relative to the FSRoot (without leading slash) to the callback. The FSRoot
 //itself will be visited with `relativePath = ""`.
 func (p *Package) WalkFSWithRelativePaths(callback func(relativePath string, node filesystem.Node) error) error {
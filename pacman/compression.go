@@ -0,0 +1,101 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//Compression identifies the compression format of a pacman package, as used
+//by Generator.Compression.
+type Compression int
+
+const (
+	//CompressionXZ is the default compression format (".pkg.tar.xz").
+	CompressionXZ Compression = iota
+	//CompressionZstd is the default compression format of current makepkg
+	//versions (".pkg.tar.zst"). This requires the "zstd" program.
+	CompressionZstd
+	//CompressionGzip selects ".pkg.tar.gz".
+	CompressionGzip
+	//CompressionNone produces an uncompressed ".pkg.tar".
+	CompressionNone
+)
+
+//Extension returns the file name extension for this compression format
+//(without the ".pkg.tar" part), e.g. ".xz".
+func (c Compression) Extension() string {
+	switch c {
+	case CompressionZstd:
+		return ".zst"
+	case CompressionGzip:
+		return ".gz"
+	case CompressionNone:
+		return ""
+	default:
+		return ".xz"
+	}
+}
+
+//DetectCompression determines the compression format of a pacman package
+//from the magic number at its start. Setting the result as
+//Generator.Compression allows to rebuild an existing package in the same
+//format.
+func DetectCompression(pkgFile []byte) (Compression, error) {
+	switch {
+	case bytes.HasPrefix(pkgFile, []byte("\xFD7zXZ\x00")):
+		return CompressionXZ, nil
+	case bytes.HasPrefix(pkgFile, []byte("\x28\xB5\x2F\xFD")):
+		return CompressionZstd, nil
+	case bytes.HasPrefix(pkgFile, []byte("\x1F\x8B")):
+		return CompressionGzip, nil
+	case len(pkgFile) >= 512 && bytes.HasPrefix(pkgFile[257:], []byte("ustar")):
+		return CompressionNone, nil
+	default:
+		return 0, errors.New("unknown compression format")
+	}
+}
+
+//compressor returns Generator.Compressor, or the filesystem.Compressor for
+//Generator.Compression if none is set.
+func (g *Generator) compressor() filesystem.Compressor {
+	if g.Compressor != nil {
+		return g.Compressor
+	}
+	switch g.Compression {
+	case CompressionZstd:
+		return filesystem.ZstdCompressor{Options: g.ZstdOptions}
+	case CompressionGzip:
+		return filesystem.GzipCompressor{}
+	case CompressionNone:
+		return filesystem.NoCompressor{}
+	default:
+		return filesystem.XZCompressor{MemoryLimit: g.XZMemoryLimit}
+	}
+}
+
+//fileExtension returns the file name extension for the package's compression
+//format (without the ".pkg.tar" part).
+func (g *Generator) fileExtension() string {
+	return g.compressor().Extension()
+}
@@ -22,7 +22,10 @@ package pacman
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
@@ -35,68 +38,398 @@ import (
 //and derivatives).
 type Generator struct {
 	Package *build.Package
+	//SizeLimits, if set, cause Build() to fail for oversized packages.
+	build.SizeLimits
+	//ExtraControlFiles are written into the root of the package archive next
+	//to the .PKGINFO, and are listed in the .MTREE. Acceptable names are
+	//".BUILDINFO", ".CHANGELOG" and ".INSTALL" (the latter only for packages
+	//without actions, since the .INSTALL is generated for them). All other
+	//files would be installed by pacman.
+	build.ExtraControlFiles
+	//Compression selects the compression format of the package. The default
+	//is CompressionXZ.
+	Compression Compression
+	//XZMemoryLimit, if not zero, limits the memory usage of the xz compressor
+	//to the given number of bytes, at the expense of the compression ratio.
+	XZMemoryLimit int
+	//RemapOwner, if not nil, chooses the owners and groups recorded in the
+	//archive and in .MTREE (see filesystem.RemapFunc).
+	RemapOwner func(path string, md filesystem.NodeMetadata) filesystem.NodeMetadata
+	//ZstdOptions configures the zstd compressor for CompressionZstd.
+	ZstdOptions filesystem.ZstdOptions
+	//Compressor, if not nil, overrides Compression with a custom compression
+	//format. Note that pacman can only install packages in the formats that
+	//libarchive supports.
+	Compressor filesystem.Compressor
+	//PathStyle selects the form of the paths in the package archive. The
+	//default is filesystem.NoPrefix, which matches the output of makepkg.
+	PathStyle filesystem.PathStyle
+	//DotSlashLayout, if true, writes a "./" entry for the root directory and
+	//prefixes all other paths with "./" (overriding PathStyle), like
+	//archives created with "bsdtar -cf - -C $pkgdir .". This is for tools
+	//that expect this layout. Note that makepkg does not do this: Its
+	//archives have neither a root entry nor "./" prefixes, which is what
+	//this generator writes by default.
+	DotSlashLayout bool
+	//ProvisionedPathPrefix is the path prefix (relative to the package root)
+	//of files that are provisioned by a configuration management tool instead
+	//of being installed at their final location. Files below this prefix are
+	//not marked for backup since the user is not expected to edit them. If
+	//empty, DefaultProvisionedPathPrefix is used. Set it to "/" to mark all
+	//files for backup (since no relative path starts with a slash).
+	ProvisionedPathPrefix string
+	//BackupPaths, if not empty, contains glob patterns (see
+	//filesystem.MatchGlob) for the files that are marked for backup, instead
+	//of all regular files outside ProvisionedPathPrefix. Validate() reports
+	//patterns that do not match any regular file.
+	BackupPaths []string
+	//PackageType is recorded as "xdata = pkgtype=..." in the .PKGINFO.
+	//Acceptable values are "pkg" (the default if empty), "debug", "split"
+	//and "src".
+	PackageType string
+	//MTREEHook, if not nil, is called with the uncompressed contents of the
+	//generated .MTREE, and returns the contents that will be written into the
+	//package instead (e.g. with additional keywords). If it returns an error,
+	//Build() fails.
+	MTREEHook func(defaultContents []byte) ([]byte, error)
+	//UpdateMIMEDatabase, if true, causes the shared MIME database to be
+	//updated after installation and removal if the package contains MIME type
+	//definitions (in /usr/share/mime/packages/*.xml).
+	UpdateMIMEDatabase bool
+	//CompileGSettingsSchemas, if true, causes the GSettings schemas to be
+	//compiled after installation and removal if the package contains files
+	//in /usr/share/glib-2.0/schemas/.
+	CompileGSettingsSchemas bool
+	//PreserveDescriptionWhitespace, if true, writes the package description
+	//into the .PKGINFO as is, except that line breaks are replaced by spaces
+	//(since .PKGINFO fields cannot span multiple lines). By default, all runs
+	//of whitespace are collapsed into single spaces like makepkg does.
+	PreserveDescriptionWhitespace bool
+
+	controlFiles     map[string][]byte
+	checksums        map[string]string
+	installedSize    int64
+	uncompressedSize int64
 }
 
+//DefaultProvisionedPathPrefix is the default value for
+//Generator.ProvisionedPathPrefix, where Holo expects the files that it
+//provisions.
+const DefaultProvisionedPathPrefix = "usr/share/holo/"
+
 //GeneratorFactory spawns Generator instances. It satisfies the build.GeneratorFactory type.
 func GeneratorFactory(pkg *build.Package) build.Generator {
 	return &Generator{Package: pkg}
 }
 
 var archMap = map[build.Architecture]string{
-	build.ArchitectureAny:     "any",
-	build.ArchitectureI386:    "i686",
-	build.ArchitectureX86_64:  "x86_64",
-	build.ArchitectureARMv5:   "arm",
-	build.ArchitectureARMv6h:  "armv6h",
-	build.ArchitectureARMv7h:  "armv7h",
-	build.ArchitectureAArch64: "aarch64",
+	build.ArchitectureAny:      "any",
+	build.ArchitectureI386:     "i686",
+	build.ArchitectureX86_64:   "x86_64",
+	build.ArchitectureARMv5:    "arm",
+	build.ArchitectureARMv6h:   "armv6h",
+	build.ArchitectureARMv7h:   "armv7h",
+	build.ArchitectureAArch64:  "aarch64",
+	build.ArchitectureARMv7:    "armv7",
+	build.ArchitectureMIPS:     "mips",
+	build.ArchitectureMIPS64EL: "mips64el",
+	build.ArchitectureLoong64:  "loong64",
 }
 
 //RecommendedFileName implements the build.Generator interface.
 func (g *Generator) RecommendedFileName() string {
-	//this is called after Build(), so we can assume that package name,
-	//version, etc. were already validated
+	//this only uses the package name, version and architecture, so it can be
+	//called before Build(), but we assume that Validate() was called before
+	pkg := g.Package
+	return fmt.Sprintf("%s-%s-%s.pkg.tar%s", pkg.Name, fullVersionString(pkg), archMap[pkg.Architecture], g.fileExtension())
+}
+
+//ArtifactName is like RecommendedFileName, but inserts the given variant
+//(e.g. "debug") before the file extension, giving
+//"name-version-arch.variant.pkg.tar.xz". This is useful for storing multiple
+//variants of a package next to each other. Note that pacman itself does not
+//parse the file name (the package type is recorded in the .PKGINFO, see
+//PackageType), so the package should be renamed to its RecommendedFileName
+//when it is put into a repository. If the variant is empty, the
+//RecommendedFileName is returned.
+func (g *Generator) ArtifactName(variant string) string {
+	if variant == "" {
+		return g.RecommendedFileName()
+	}
 	pkg := g.Package
-	return fmt.Sprintf("%s-%s-%s.pkg.tar.xz", pkg.Name, fullVersionString(pkg), archMap[pkg.Architecture])
+	return fmt.Sprintf("%s-%s-%s.%s.pkg.tar%s", pkg.Name, fullVersionString(pkg), archMap[pkg.Architecture], variant, g.fileExtension())
+}
+
+//GeneratedControlFiles returns the contents of the metadata files (".PKGINFO",
+//".INSTALL" if any, ".MTREE" and the ExtraControlFiles), as generated by the
+//last call to Build(). Before the first Build(), nil is returned.
+func (g *Generator) GeneratedControlFiles() map[string][]byte {
+	return g.controlFiles
+}
+
+//Checksums returns the digests of the package file produced by the last
+//successful call to Build(), as computed by build.ComputeChecksums().
+func (g *Generator) Checksums() (map[string]string, error) {
+	if g.checksums == nil {
+		return nil, build.ErrNotBuilt
+	}
+	return g.checksums, nil
+}
+
+//BuildResult is like Build, but also returns the sizes of the package. The
+//UncompressedSize is the size of the uncompressed tar archive.
+func (g *Generator) BuildResult() (build.BuildResult, error) {
+	data, err := g.Build()
+	if err != nil {
+		return build.BuildResult{}, err
+	}
+	return build.BuildResult{
+		Bytes:               data,
+		RecommendedFileName: g.RecommendedFileName(),
+		CompressedSize:      int64(len(data)),
+		UncompressedSize:    g.uncompressedSize,
+		InstalledSize:       g.installedSize,
+	}, nil
 }
 
 //Validate implements the build.Generator interface.
 func (g *Generator) Validate() []error {
+	errs, _ := g.ValidateWithWarnings()
+	return errs
+}
+
+//isBashCompatibleInterpreter returns whether a PackageAction.Interpreter
+//value can be honored by the bash that sources the .INSTALL file.
+func isBashCompatibleInterpreter(interpreter string) bool {
+	switch path.Base(interpreter) {
+	case ".", "sh", "bash":
+		return true
+	default:
+		return false
+	}
+}
+
+//ValidateWithWarnings is like Validate, but also returns warnings (see
+//build.Package.ValidateWithWarnings()).
+func (g *Generator) ValidateWithWarnings() (errs []error, warnings []error) {
 	var nameRx = `[a-z0-9@._+][a-z0-9@._+-]*`
 	var versionRx = `[a-zA-Z0-9._]+`
-	return g.Package.ValidateWith(build.RegexSet{
+	errs, warnings = g.Package.ValidateWithWarnings(build.RegexSet{
 		PackageName:    nameRx,
 		PackageVersion: versionRx,
 		RelatedName:    "(?:except:)?(?:group:)?" + nameRx,
 		RelatedVersion: "(?:[0-9]+:)?" + versionRx + "(?:-[1-9][0-9]*)?", //incl. release/epoch
 		FormatName:     "pacman",
+		DefaultShell:   "bash",
 	}, archMap)
+
+	//group: and except: are resolved by compilePackageRequirements(), which
+	//cannot carry version constraints over to the resolved packages
+	for _, rels := range [][]build.PackageRelation{g.Package.Requires, g.Package.Provides, g.Package.Conflicts, g.Package.Replaces} {
+		for _, rel := range rels {
+			isSpecial := strings.HasPrefix(rel.RelatedPackage, "except:") || strings.HasPrefix(rel.RelatedPackage, "group:")
+			if isSpecial && len(rel.Constraints) > 0 {
+				err := fmt.Errorf("version constraints are not allowed on %q (group references and exclusions cannot be versioned)", rel.RelatedPackage)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	//explicit backup patterns must match something (otherwise they are
+	//probably typos)
+	if len(g.BackupPaths) > 0 && g.Package.FSRoot != nil {
+		regularFiles := backupPaths(g.Package, "/", nil) //"/" excludes nothing
+		for _, pattern := range g.BackupPaths {
+			found, err := matchesAnyPath(pattern, regularFiles)
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("backup pattern %q is malformed: %s", pattern, err.Error()))
+			case !found:
+				errs = append(errs, fmt.Errorf("backup pattern %q does not match any regular file in the package", pattern))
+			}
+		}
+	}
+
+	switch g.packageType() {
+	case "pkg", "debug", "split", "src":
+	default:
+		errs = append(errs, fmt.Errorf("package type %q is not acceptable (must be one of \"pkg\", \"debug\", \"split\" or \"src\")", g.PackageType))
+	}
+
+	//the .INSTALL file is always sourced by bash, so scripts written for other
+	//shells (e.g. zsh or ksh) cannot be honored either
+	for _, action := range g.Package.Actions {
+		if !isBashCompatibleInterpreter(action.Interpreter) {
+			err := fmt.Errorf("interpreter %q is not supported for pacman packages (only bash and POSIX shell scripts are supported)", action.Interpreter)
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, g.ValidateControlFileNames("pacman", func(name string) bool {
+		switch name {
+		case ".BUILDINFO", ".CHANGELOG", ".INSTALL":
+			return true
+		default:
+			return false
+		}
+	})...)
+	return errs, warnings
+}
+
+//Preview returns a summary of the package that Build() would produce, without
+//building it. Validation errors and size limit violations are reported like
+//in Validate() and Build(). The ConfigFiles are those marked for backup. The
+//Package is not modified.
+func (g *Generator) Preview() (build.BuildPreview, error) {
+	errs := g.Validate()
+	if len(errs) > 0 {
+		return build.BuildPreview{}, errors.Join(errs...)
+	}
+	pkg := g.Package.Clone()
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = pkg.InsertDocFiles(build.LicenseDirectory)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	return build.NewBuildPreview(pkg, backupPaths(pkg, g.provisionedPathPrefix(), g.BackupPaths)), nil
 }
 
 //Build implements the build.Generator interface.
 func (g *Generator) Build() ([]byte, error) {
+	opts, err := g.prepareBuild()
+	if err != nil {
+		return nil, err
+	}
+
+	//compress package
 	pkg := g.Package
-	pkg.PrepareBuild()
+	var buf bytes.Buffer
+	g.uncompressedSize, err = pkg.FSRoot.ToCompressedTarArchive(&buf, g.compressor(), opts)
+	if err != nil {
+		return nil, err
+	}
+	err = g.CheckCompressedSize(pkg, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	g.checksums = build.ComputeChecksums(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+//BuildReader is like Build, but streams the package file through the
+//returned reader instead of holding it in memory (see build.NewBuildReader).
+//Errors from preparing the package are returned immediately, errors from
+//compressing it are returned by Read(). Checksums() and BuildResult() become
+//available once the reader has been read to the end.
+func (g *Generator) BuildReader() (io.ReadCloser, error) {
+	opts, err := g.prepareBuild()
+	if err != nil {
+		return nil, err
+	}
+	pkg := g.Package
+	c := g.compressor()
+	g.checksums = nil
+	return build.NewBuildReader(func(w io.Writer) error {
+		pw := g.NewPackageWriter(pkg, w)
+		size, err := pkg.FSRoot.ToCompressedTarArchive(pw, c, opts)
+		if err != nil {
+			return err
+		}
+		g.uncompressedSize = size
+		g.checksums = pw.Checksums()
+		return nil
+	}), nil
+}
+
+//prepareBuild executes all steps of Build() before compressing the package,
+//i.e. it renders the package and writes the control files into it. The
+//TarOptions for compressing the package are returned.
+func (g *Generator) prepareBuild() (filesystem.TarOptions, error) {
+	var opts filesystem.TarOptions
+	pkg := g.Package
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return opts, err
+	}
+	err = pkg.InsertDocFiles(build.LicenseDirectory)
+	if err != nil {
+		return opts, err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return opts, err
+	}
+	g.installedSize = pkg.FSRoot.InstalledSizeInBytes()
 
 	//write .PKGINFO
-	err := writePKGINFO(pkg)
+	err = g.writePKGINFO()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to write .PKGINFO: %s", err.Error())
+		return opts, fmt.Errorf("Failed to write .PKGINFO: %s", err.Error())
 	}
 
 	//write .INSTALL
-	writeINSTALL(pkg)
+	writeINSTALL(pkg, g.installHooks())
+
+	//write extra control files (before the mtree, since they are listed in it)
+	controlFileNames := []string{".PKGINFO", ".INSTALL"}
+	for _, file := range g.ControlFiles {
+		if _, exists := pkg.FSRoot.Entries[file.Name]; exists {
+			return opts, fmt.Errorf("cannot add control file %s: file is already generated", file.Name)
+		}
+		pkg.FSRoot.Entries[file.Name] = &filesystem.RegularFile{
+			Content:  string(file.Content),
+			Metadata: filesystem.NodeMetadata{Mode: file.Mode},
+		}
+		if file.Name != ".INSTALL" {
+			controlFileNames = append(controlFileNames, file.Name)
+		}
+	}
 
 	//write mtree
-	err = writeMTREE(pkg)
+	err = writeMTREE(pkg, g.MTREEHook, g.RemapOwner)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to write .MTREE: %s", err.Error())
+		return opts, fmt.Errorf("Failed to write .MTREE: %s", err.Error())
 	}
+	//the control files were written into FSRoot.Entries directly, so the
+	//cached size of FSRoot is stale
+	pkg.FSRoot.RecomputeSize()
 
-	//compress package
-	var buf bytes.Buffer
-	err = pkg.FSRoot.ToTarXZArchive(&buf, false, true)
-	return buf.Bytes(), err
+	g.controlFiles = make(map[string][]byte)
+	for _, name := range append(controlFileNames, ".MTREE") {
+		if file, ok := pkg.FSRoot.Entries[name].(*filesystem.RegularFile); ok {
+			g.controlFiles[name] = []byte(file.Content)
+		}
+	}
+
+	opts = filesystem.TarOptions{PathStyle: g.PathStyle, SkipRootDirectory: true}
+	if g.DotSlashLayout {
+		opts = filesystem.TarOptions{PathStyle: filesystem.DotSlash}
+	}
+	opts.RemapOwner = g.RemapOwner
+	return opts, nil
+}
+
+//provisionedPathPrefix returns the effective ProvisionedPathPrefix.
+func (g *Generator) provisionedPathPrefix() string {
+	if g.ProvisionedPathPrefix == "" {
+		return DefaultProvisionedPathPrefix
+	}
+	return g.ProvisionedPathPrefix
+}
+
+//packageType returns the effective PackageType.
+func (g *Generator) packageType() string {
+	if g.PackageType == "" {
+		return "pkg"
+	}
+	return g.PackageType
 }
 
 func fullVersionString(pkg *build.Package) string {
@@ -107,20 +440,35 @@ func fullVersionString(pkg *build.Package) string {
 	return str
 }
 
-func writePKGINFO(pkg *build.Package) error {
-	//normalize package description like makepkg does
-	desc := regexp.MustCompile(`\s+`).ReplaceAllString(strings.TrimSpace(pkg.Description), " ")
+func (g *Generator) writePKGINFO() error {
+	pkg := g.Package
+	desc := normalizeDescription(pkg.Description)
+	if g.PreserveDescriptionWhitespace {
+		desc = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(pkg.Description)
+	}
 
 	//generate .PKGINFO
 	contents := "# Generated by holo-build\n"
+	if pkg.Source != "" {
+		contents += fmt.Sprintf("# source: %s\n", pkg.Source)
+	}
+	if pkg.Vendor != "" {
+		contents += fmt.Sprintf("# vendor: %s\n", pkg.Vendor)
+	}
+	if author := pkg.UpstreamAuthor(); author != "" {
+		contents += fmt.Sprintf("# author: %s\n", author)
+	}
+	if pkg.AutoInstallHint {
+		contents += "# install-reason: dependency\n"
+	}
 	contents += fmt.Sprintf("pkgname = %s\n", pkg.Name)
 	contents += fmt.Sprintf("pkgver = %s\n", fullVersionString(pkg))
 	contents += fmt.Sprintf("pkgdesc = %s\n", desc)
 	contents += "url = \n"
-	if pkg.Author == "" {
+	if pkg.PackagerName() == "" {
 		contents += "packager = Unknown Packager\n"
 	} else {
-		contents += fmt.Sprintf("packager = %s\n", pkg.Author)
+		contents += fmt.Sprintf("packager = %s\n", pkg.PackagerName())
 	}
 	contents += fmt.Sprintf("size = %d\n", pkg.FSRoot.InstalledSizeInBytes())
 	contents += fmt.Sprintf("arch = %s\n", archMap[pkg.Architecture])
@@ -137,8 +485,9 @@ func writePKGINFO(pkg *build.Package) error {
 	if err != nil {
 		return err
 	}
+	provides += compileLibraryProvides(pkg)
 	contents += replaces + conflicts + provides
-	contents += compileBackupMarkers(pkg)
+	contents += compileBackupMarkers(backupPaths(pkg, g.provisionedPathPrefix(), g.BackupPaths))
 	requires, err := compilePackageRequirements("depend", pkg.Requires)
 	if err != nil {
 		return err
@@ -158,6 +507,7 @@ func writePKGINFO(pkg *build.Package) error {
 	contents += "makepkgopt = !purge\n"
 	contents += "makepkgopt = !upx\n"
 	contents += "makepkgopt = !debug\n"
+	contents += fmt.Sprintf("xdata = pkgtype=%s\n", g.packageType())
 
 	//write .PKGINFO
 	pkg.FSRoot.Entries[".PKGINFO"] = &filesystem.RegularFile{
@@ -167,29 +517,113 @@ func writePKGINFO(pkg *build.Package) error {
 	return nil
 }
 
-func compileBackupMarkers(pkg *build.Package) string {
+//normalizeDescription normalizes the package description like makepkg does.
+func normalizeDescription(desc string) string {
+	return regexp.MustCompile(`\s+`).ReplaceAllString(strings.TrimSpace(desc), " ")
+}
+
+func compileBackupMarkers(paths []string) string {
 	var lines []string
+	for _, path := range paths {
+		lines = append(lines, fmt.Sprintf("backup = %s\n", path))
+	}
+	return strings.Join(lines, "")
+}
+
+//backupPaths returns the sorted list of relative paths of all files that are
+//marked for backup, i.e. all regular files matching one of the patterns, or
+//(if there are no patterns) all regular files outside the
+//provisionedPathPrefix. Templates count as regular files, since they are
+//rendered into regular files by Build() (but may still be unrendered when
+//Validate() is called).
+func backupPaths(pkg *build.Package, provisionedPathPrefix string, patterns []string) []string {
+	var paths []string
 	pkg.WalkFSWithRelativePaths(func(path string, node filesystem.Node) error {
-		if _, ok := node.(*filesystem.RegularFile); !ok {
+		switch node.(type) {
+		case *filesystem.RegularFile, *filesystem.ReaderFile, *filesystem.TemplateFile:
+		default:
 			return nil //look only at regular files
 		}
-		if !strings.HasPrefix(path, "usr/share/holo/") {
-			lines = append(lines, fmt.Sprintf("backup = %s\n", path))
+		if len(patterns) > 0 {
+			for _, pattern := range patterns {
+				if ok, _ := filesystem.MatchGlob(pattern, path); ok {
+					paths = append(paths, path)
+					break
+				}
+			}
+		} else if !strings.HasPrefix(path, provisionedPathPrefix) {
+			paths = append(paths, path)
 		}
 		return nil
 	})
-	sort.Strings(lines)
-	return strings.Join(lines, "")
+	sort.Strings(paths)
+	return paths
+}
+
+//matchesAnyPath reports whether the glob pattern matches any of the paths.
+func matchesAnyPath(pattern string, paths []string) (bool, error) {
+	for _, path := range paths {
+		ok, err := filesystem.MatchGlob(pattern, path)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
 }
 
-func writeINSTALL(pkg *build.Package) {
+//Scripts that installHooks() adds to the .INSTALL. Since the programs may
+//not be installed on the target system, failures are ignored.
+const (
+	refreshAppStreamCacheScript   = `if command -v appstreamcli >/dev/null 2>&1; then appstreamcli refresh-cache --force >/dev/null 2>&1 || true; fi`
+	updateMIMEDatabaseScript      = `if command -v update-mime-database >/dev/null 2>&1; then update-mime-database /usr/share/mime >/dev/null 2>&1 || true; fi`
+	compileGSettingsSchemasScript = `if command -v glib-compile-schemas >/dev/null 2>&1; then glib-compile-schemas /usr/share/glib-2.0/schemas >/dev/null 2>&1 || true; fi`
+)
+
+//installHooks returns the scripts that the .INSTALL runs after installation
+//and removal in addition to the package's own actions. Hooks for specific
+//kinds of files are only included if the package contains such files.
+func (g *Generator) installHooks() []string {
+	pkg := g.Package
+	var hooks []string
+	if pkg.RefreshAppStreamCache {
+		hooks = append(hooks, refreshAppStreamCacheScript)
+	}
+	if g.UpdateMIMEDatabase && containsRegularFile(pkg, "usr/share/mime/packages/*.xml") {
+		hooks = append(hooks, updateMIMEDatabaseScript)
+	}
+	if g.CompileGSettingsSchemas && containsRegularFile(pkg, "usr/share/glib-2.0/schemas/*") {
+		hooks = append(hooks, compileGSettingsSchemasScript)
+	}
+	return hooks
+}
+
+//containsRegularFile reports whether the package contains a regular file
+//matching the given glob pattern (see filesystem.MatchGlob).
+func containsRegularFile(pkg *build.Package, pattern string) bool {
+	for _, path := range pkg.FSRoot.Select(pattern) {
+		switch pkg.FSRoot.Lookup(path).(type) {
+		case *filesystem.RegularFile, *filesystem.ReaderFile, *filesystem.Hardlink:
+			return true
+		}
+	}
+	return false
+}
+
+func writeINSTALL(pkg *build.Package, hooks []string) {
 	//assemble the contents for the .INSTALL file
+	setupScript := pkg.Script(build.SetupAction)
+	cleanupScript := pkg.Script(build.CleanupAction)
+	for _, hook := range hooks {
+		setupScript = strings.TrimPrefix(setupScript+"\n"+hook, "\n")
+		cleanupScript = strings.TrimPrefix(cleanupScript+"\n"+hook, "\n")
+	}
+
 	contents := ""
-	if script := pkg.Script(build.SetupAction); script != "" {
-		contents += fmt.Sprintf("post_install() {\n%s\n}\npost_upgrade() {\npost_install\n}\n", script)
+	if setupScript != "" {
+		contents += fmt.Sprintf("post_install() {\n%s\n}\npost_upgrade() {\npost_install\n}\n", setupScript)
 	}
-	if script := pkg.Script(build.CleanupAction); script != "" {
-		contents += fmt.Sprintf("post_remove() {\n%s\n}\n", script)
+	if cleanupScript != "" {
+		contents += fmt.Sprintf("post_remove() {\n%s\n}\n", cleanupScript)
 	}
 
 	//do we need the .INSTALL file at all?
@@ -203,8 +637,8 @@ func writeINSTALL(pkg *build.Package) {
 	}
 }
 
-func writeMTREE(pkg *build.Package) error {
-	contents, err := makeMTREE(pkg)
+func writeMTREE(pkg *build.Package, hook func([]byte) ([]byte, error), remap filesystem.RemapFunc) error {
+	contents, err := makeMTREE(pkg, hook, remap)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,232 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+func TestProvides(t *testing.T) {
+	testCases := []struct {
+		Architecture build.Architecture
+		Expected     string
+	}{
+		{build.ArchitectureX86_64, "provides = mail-transport-agent\nprovides = libfoo.so=1.2-64\n"},
+		{build.ArchitectureI386, "provides = mail-transport-agent\nprovides = libfoo.so=1.2-32\n"},
+	}
+
+	for _, tc := range testCases {
+		pkg := &build.Package{
+			Name:              "foo",
+			Version:           "1.0",
+			Release:           1,
+			Architecture:      tc.Architecture,
+			Provides:          []build.PackageRelation{{RelatedPackage: "mail-transport-agent"}},
+			ProvidedLibraries: []string{"libfoo.so.1.2"},
+			FSRoot:            filesystem.NewDirectory(),
+		}
+		err := pkg.InsertFSNode("/usr/lib/libfoo.so.1.2", &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0644}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		g := &Generator{Package: pkg}
+		if errs := g.Validate(); len(errs) > 0 {
+			t.Fatalf("unexpected validation errors: %q", errs)
+		}
+		_, err = g.Build()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var provides string
+		for _, line := range strings.SplitAfter(string(g.GeneratedControlFiles()[".PKGINFO"]), "\n") {
+			if strings.HasPrefix(line, "provides = ") {
+				provides += line
+			}
+		}
+		if provides != tc.Expected {
+			t.Errorf("expected %q for architecture %d, but got %q", tc.Expected, tc.Architecture, provides)
+		}
+	}
+}
+
+func TestDotSlashLayout(t *testing.T) {
+	testCases := []struct {
+		DotSlashLayout bool
+		Expected       []string
+	}{
+		//like makepkg: neither a root entry nor "./" prefixes
+		{false, []string{".MTREE", ".PKGINFO", "etc/", "etc/foo.conf"}},
+		{true, []string{"./", "./.MTREE", "./.PKGINFO", "./etc/", "./etc/foo.conf"}},
+	}
+
+	for _, tc := range testCases {
+		pkg := &build.Package{
+			Name:         "foo",
+			Version:      "1.0",
+			Release:      1,
+			Architecture: build.ArchitectureAny,
+			FSRoot:       filesystem.NewDirectory(),
+		}
+		err := pkg.InsertFSNode("/etc/foo.conf", &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0644}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, err := (&Generator{Package: pkg, Compression: CompressionNone, DotSlashLayout: tc.DotSlashLayout}).Build()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var names []string
+		r := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			names = append(names, hdr.Name)
+		}
+		if strings.Join(names, " ") != strings.Join(tc.Expected, " ") {
+			t.Errorf("expected entries %q with DotSlashLayout = %t, but got %q", tc.Expected, tc.DotSlashLayout, names)
+		}
+	}
+}
+
+func TestValidateActionInterpreters(t *testing.T) {
+	testCases := map[string]bool{
+		"":                 true,
+		"/bin/sh":          true,
+		"/usr/bin/bash":    true,
+		"/bin/zsh":         false,
+		"/bin/ksh":         false,
+		"/usr/bin/python3": false,
+	}
+
+	for interpreter, acceptable := range testCases {
+		pkg := &build.Package{
+			Name:         "foo",
+			Version:      "1.0",
+			Release:      1,
+			Architecture: build.ArchitectureAny,
+			Actions: []build.PackageAction{{
+				Type:        build.SetupAction,
+				Content:     "echo hello",
+				Interpreter: interpreter,
+			}},
+			FSRoot: filesystem.NewDirectory(),
+		}
+		errs := (&Generator{Package: pkg}).Validate()
+		if acceptable && len(errs) > 0 {
+			t.Errorf("interpreter %q: unexpected validation errors: %q", interpreter, errs)
+		}
+		if !acceptable && len(errs) != 1 {
+			t.Errorf("interpreter %q: expected exactly one validation error, got %q", interpreter, errs)
+		}
+	}
+}
+
+func TestEmptyDirectoryIsExtracted(t *testing.T) {
+	//pacman extracts packages with libarchive, same as bsdtar
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar is not available")
+	}
+	pkg := &build.Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: build.ArchitectureAny,
+		FSRoot:       filesystem.NewDirectory(),
+	}
+	err := pkg.InsertFSNode("/var/lib/foo", &filesystem.Directory{Entries: map[string]filesystem.Node{}, Metadata: filesystem.NodeMetadata{Mode: 0750}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := (&Generator{Package: pkg}).Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	extractDir := t.TempDir()
+	cmd := exec.Command("bsdtar", "-xf", "-", "-C", extractDir)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("bsdtar failed: %s: %s", err.Error(), output)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(extractDir, "var/lib/foo"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) > 0 {
+		t.Errorf("expected /var/lib/foo to be empty, but found %d entries", len(entries))
+	}
+}
+
+func TestInstalledSizeCacheAfterBuild(t *testing.T) {
+	pkg := &build.Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: build.ArchitectureAny,
+		Actions:      []build.PackageAction{{Type: build.SetupAction, Content: "echo hello"}},
+		FSRoot:       filesystem.NewDirectory(),
+	}
+	err := pkg.InsertFSNode("/etc/foo.conf", &filesystem.RegularFile{Content: "foo", Metadata: filesystem.NodeMetadata{Mode: 0644}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sizeBefore := pkg.FSRoot.InstalledSizeInBytes()
+
+	g := &Generator{Package: pkg}
+	g.AddControlFile(".CHANGELOG", []byte("changes"), 0644)
+	_, err = g.Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the size in .PKGINFO does not include the control files...
+	if !strings.Contains(string(g.GeneratedControlFiles()[".PKGINFO"]), fmt.Sprintf("\nsize = %d\n", sizeBefore)) {
+		t.Errorf("expected size = %d in .PKGINFO", sizeBefore)
+	}
+	//...but the cached size of FSRoot must account for them
+	cached := pkg.FSRoot.InstalledSizeInBytes()
+	if actual := pkg.FSRoot.RecomputeSize(); cached != actual {
+		t.Errorf("cached InstalledSizeInBytes() is %d after Build(), but should be %d", cached, actual)
+	}
+	if cached <= sizeBefore {
+		t.Errorf("expected InstalledSizeInBytes() to grow beyond %d after Build(), got %d", sizeBefore, cached)
+	}
+}
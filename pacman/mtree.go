@@ -21,7 +21,6 @@ package pacman
 
 import (
 	"bytes"
-	"compress/gzip"
 	"fmt"
 	"strings"
 
@@ -29,8 +28,11 @@ import (
 	"github.com/holocm/libpackagebuild/filesystem"
 )
 
-//makeMTREE generates the mtree metadata archive for this package.
-func makeMTREE(pkg *build.Package) ([]byte, error) {
+//makeMTREE generates the mtree metadata archive for this package. If the hook
+//is not nil, it may modify the uncompressed contents (see
+//Generator.MTREEHook). Owners are chosen like in the tar archive (see
+//Generator.RemapOwner).
+func makeMTREE(pkg *build.Package, hook func([]byte) ([]byte, error), remap filesystem.RemapFunc) ([]byte, error) {
 	//this implementation is not particularly clever w.r.t. the use of "/set",
 	//but we use some defaults here to maybe keep the result size down a bit
 	lines := []string{
@@ -38,7 +40,7 @@ func makeMTREE(pkg *build.Package) ([]byte, error) {
 		"/set type=file uid=0 gid=0 mode=644 time=0.0",
 	}
 
-	pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
+	err := pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
 		//skip root directory
 		if path == "/" {
 			return nil
@@ -46,16 +48,28 @@ func makeMTREE(pkg *build.Package) ([]byte, error) {
 
 		//make path relative, e.g. "./etc/foo.conf"
 		line := mtreeEscapeString("." + path)
+		uid, gid, err := pkg.FSRoot.ArchiveOwner(path, node, remap)
+		if err != nil {
+			return err
+		}
+
+		//hardlinks are described like their target (like bsdtar does)
+		if link, ok := node.(*filesystem.Hardlink); ok {
+			node, err = pkg.FSRoot.ResolveHardlink(link)
+			if err != nil {
+				return err
+			}
+		}
 
 		//add attributes in the same order as makepkg:
 		//  type,uid,gid,mode,time,size,md5,sha256,link
 		switch n := node.(type) {
 		case *filesystem.Directory:
 			line += " type=dir"
-			if uid := n.Metadata.UID(); uid != 0 { //uid 0 is default
+			if uid != 0 { //uid 0 is default
 				line += fmt.Sprintf(" uid=%d", uid)
 			}
-			if gid := n.Metadata.GID(); gid != 0 { //gid 0 is default
+			if gid != 0 { //gid 0 is default
 				line += fmt.Sprintf(" gid=%d", gid)
 			}
 			if n.Metadata.Mode != 0644 { //mode 0644 is default
@@ -63,10 +77,10 @@ func makeMTREE(pkg *build.Package) ([]byte, error) {
 			}
 		case *filesystem.RegularFile:
 			// type=file is default
-			if uid := n.Metadata.UID(); uid != 0 { //uid 0 is default
+			if uid != 0 { //uid 0 is default
 				line += fmt.Sprintf(" uid=%d", uid)
 			}
-			if gid := n.Metadata.GID(); gid != 0 { //gid 0 is default
+			if gid != 0 { //gid 0 is default
 				line += fmt.Sprintf(" gid=%d", gid)
 			}
 			if n.Metadata.Mode != 0644 { //mode 0644 is default
@@ -75,9 +89,33 @@ func makeMTREE(pkg *build.Package) ([]byte, error) {
 			line += fmt.Sprintf(" size=%d md5digest=%s sha256digest=%s",
 				len([]byte(n.Content)), n.MD5Digest(), n.SHA256Digest(),
 			)
+		case *filesystem.ReaderFile:
+			// type=file is default
+			if uid != 0 { //uid 0 is default
+				line += fmt.Sprintf(" uid=%d", uid)
+			}
+			if gid != 0 { //gid 0 is default
+				line += fmt.Sprintf(" gid=%d", gid)
+			}
+			if n.Metadata.Mode != 0644 { //mode 0644 is default
+				line += fmt.Sprintf(" mode=%o", n.Metadata.Mode)
+			}
+			md5Digest, sha256Digest, err := n.Digests()
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %s", path, err.Error())
+			}
+			line += fmt.Sprintf(" size=%d md5digest=%s sha256digest=%s",
+				n.Size, md5Digest, sha256Digest,
+			)
 		case *filesystem.Symlink:
-			// uid=0 gid=0 is default
-			line += " type=link mode=777"
+			line += " type=link"
+			if uid != 0 { //uid 0 is default
+				line += fmt.Sprintf(" uid=%d", uid)
+			}
+			if gid != 0 { //gid 0 is default
+				line += fmt.Sprintf(" gid=%d", gid)
+			}
+			line += " mode=777"
 			//need to replace spaces in link target since spaces separate
 			line += " link=" + mtreeEscapeString(n.Target)
 		}
@@ -85,14 +123,23 @@ func makeMTREE(pkg *build.Package) ([]byte, error) {
 		lines = append(lines, line)
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	contents := strings.Join(lines, "\n") + "\n"
+	contents := []byte(strings.Join(lines, "\n") + "\n")
+	if hook != nil {
+		contents, err = hook(contents)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	//GZip that
 	var buf bytes.Buffer
-	w := gzip.NewWriter(&buf)
+	w := filesystem.NewGzipWriter(&buf)
 
-	_, err := w.Write([]byte(contents))
+	_, err = w.Write(contents)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,143 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"fmt"
+	"strings"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//GeneratePKGBUILD renders a PKGBUILD that documents how makepkg could
+//produce a package equivalent to the one built by this Generator. It does not
+//declare any sources: The package() function expects all regular files
+//to be present in $srcdir at the same relative path as in the package.
+//
+//Relations using the special "group:" or "except:" syntax are only included
+//as comments since they cannot be resolved without access to the package
+//database. Files below DefaultProvisionedPathPrefix are not marked for backup.
+func GeneratePKGBUILD(pkg *build.Package) string {
+	desc := normalizeDescription(pkg.Description)
+
+	contents := "# Generated by holo-build\n"
+	if pkg.PackagerName() != "" {
+		contents += fmt.Sprintf("# Maintainer: %s\n", pkg.PackagerName())
+	}
+	if pkg.Maintainer != "" && pkg.Author != "" && pkg.Author != pkg.Maintainer {
+		contents += fmt.Sprintf("# Contributor: %s\n", pkg.Author)
+	}
+	contents += "\n"
+	contents += fmt.Sprintf("pkgname=%s\n", shellQuote(pkg.Name))
+	contents += fmt.Sprintf("pkgver=%s\n", shellQuote(pkg.Version))
+	contents += fmt.Sprintf("pkgrel=%d\n", pkg.Release)
+	if pkg.Epoch > 0 {
+		contents += fmt.Sprintf("epoch=%d\n", pkg.Epoch)
+	}
+	contents += fmt.Sprintf("pkgdesc=%s\n", shellQuote(desc))
+	contents += fmt.Sprintf("arch=(%s)\n", shellQuote(archMap[pkg.Architecture]))
+	contents += "license=('custom:none')\n"
+	contents += compilePKGBUILDRelations("depends", pkg.Requires)
+	contents += compilePKGBUILDRelations("provides", pkg.Provides)
+	contents += compilePKGBUILDRelations("conflicts", pkg.Conflicts)
+	contents += compilePKGBUILDRelations("replaces", pkg.Replaces)
+	if paths := backupPaths(pkg, DefaultProvisionedPathPrefix, nil); len(paths) > 0 {
+		contents += fmt.Sprintf("backup=(%s)\n", shellQuoteAll(paths))
+	}
+	if pkg.Script(build.SetupAction) != "" || pkg.Script(build.CleanupAction) != "" || pkg.RefreshAppStreamCache {
+		contents += fmt.Sprintf("install=%s\n", shellQuote(pkg.Name+".install"))
+	}
+	contents += "options=('!strip' 'emptydirs')\n"
+
+	contents += "\npackage() {\n"
+	pkg.WalkFSWithRelativePaths(func(path string, node filesystem.Node) error {
+		if path == "" {
+			return nil
+		}
+		target := shellQuote(path)
+		switch n := node.(type) {
+		case *filesystem.Directory:
+			contents += fmt.Sprintf("  install -d -m %o \"$pkgdir\"/%s\n", n.Metadata.Mode, target)
+			contents += pkgbuildChown(path, n.Metadata)
+		case *filesystem.RegularFile:
+			contents += fmt.Sprintf("  install -D -m %o \"$srcdir\"/%s \"$pkgdir\"/%s\n", n.Metadata.Mode, target, target)
+			contents += pkgbuildChown(path, n.Metadata)
+		case *filesystem.ReaderFile:
+			contents += fmt.Sprintf("  install -D -m %o \"$srcdir\"/%s \"$pkgdir\"/%s\n", n.Metadata.Mode, target, target)
+			contents += pkgbuildChown(path, n.Metadata)
+		case *filesystem.Symlink:
+			contents += fmt.Sprintf("  ln -s %s \"$pkgdir\"/%s\n", shellQuote(n.Target), target)
+		case *filesystem.Hardlink:
+			contents += fmt.Sprintf("  ln \"$pkgdir\"/%s \"$pkgdir\"/%s\n", shellQuote(strings.TrimPrefix(n.Target, "/")), target)
+		}
+		return nil
+	})
+	contents += "}\n"
+
+	return contents
+}
+
+func compilePKGBUILDRelations(key string, rels []build.PackageRelation) string {
+	if len(rels) == 0 {
+		return ""
+	}
+	var (
+		entries  []string
+		comments string
+	)
+	for _, rel := range rels {
+		if strings.HasPrefix(rel.RelatedPackage, "except:") || strings.HasPrefix(rel.RelatedPackage, "group:") {
+			comments += fmt.Sprintf("# %s: %s (not resolved)\n", key, rel.RelatedPackage)
+			continue
+		}
+		if len(rel.Constraints) == 0 {
+			entries = append(entries, rel.RelatedPackage)
+		}
+		for _, c := range rel.Constraints {
+			entries = append(entries, rel.RelatedPackage+c.Relation+c.Version)
+		}
+	}
+	if len(entries) == 0 {
+		return comments
+	}
+	return comments + fmt.Sprintf("%s=(%s)\n", key, shellQuoteAll(entries))
+}
+
+func pkgbuildChown(path string, m filesystem.NodeMetadata) string {
+	uid, gid := m.UID(), m.GID()
+	if uid == 0 && gid == 0 {
+		return ""
+	}
+	return fmt.Sprintf("  chown %d:%d \"$pkgdir\"/%s\n", uid, gid, shellQuote(path))
+}
+
+//shellQuote quotes a string for use in a shell script.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+func shellQuoteAll(strs []string) string {
+	quoted := make([]string, len(strs))
+	for idx, str := range strs {
+		quoted[idx] = shellQuote(str)
+	}
+	return strings.Join(quoted, " ")
+}
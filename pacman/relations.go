@@ -50,16 +50,47 @@ func compilePackageRelations(relType string, rels []build.PackageRelation) strin
 	return strings.Join(lines, "\n") + "\n"
 }
 
+//compileLibraryProvides renders Package.ProvidedLibraries in the same way as
+//makepkg does for the shared libraries that it finds in a package, e.g.
+//"libfoo.so.1" on x86_64 as "provides = libfoo.so=1-64".
+func compileLibraryProvides(pkg *build.Package) string {
+	bits := "32"
+	if pkg.Architecture.Is64Bit() {
+		bits = "64"
+	}
+	var result string
+	for _, soname := range pkg.ProvidedLibraries {
+		name, version, ok := build.SplitSoname(soname)
+		if !ok {
+			continue //rejected by Validate()
+		}
+		result += fmt.Sprintf("provides = %s.so=%s-%s\n", name, version, bits)
+	}
+	return result
+}
+
 //Like compilePackageRelations, but resolve special syntax for requirements
-//(references to groups, exclusion of packages and groups).
+//(references to groups, exclusion of packages and groups). This is used for
+//all relation types. The syntax is:
+//
+//	"group:foo"        - all packages in the group "foo" (as reported by
+//	                     `pacman -Sqg foo`), since .PKGINFO cannot
+//	                     reference groups directly
+//	"except:bar"       - removes "bar" from the result, e.g. when it was
+//	                     added by a group
+//	"except:group:foo" - removes all packages in the group "foo"
+//
+//Exclusions apply regardless of the order of the relations. Version
+//constraints on these special relations are rejected by Validate().
 func compilePackageRequirements(relType string, rels []build.PackageRelation) (string, error) {
-	//acceptRel marks which packages will be included in the result
-	//(e.g. "not:foo" sets acceptPkg["foo"] = false)
+	//acceptPkg marks which packages will be included in the result
+	//(e.g. "except:foo" sets acceptPkg["foo"] = false)
 	acceptPkg := make(map[string]bool, len(rels))
 
 	//read all input relations, and filter plain package relations (those that
 	//are not groups or negations)
-	actualRels := make([]build.PackageRelation, len(rels))
+	actualRels := make([]build.PackageRelation, 0, len(rels))
+	var excludedPkgs []string
 	for _, rel := range rels {
 		name := rel.RelatedPackage
 		isNegated := strings.HasPrefix(name, "except:")
@@ -67,31 +98,43 @@ func compilePackageRequirements(relType string, rels []build.PackageRelation) (s
 		isGroup := strings.HasPrefix(name, "group:")
 		name = strings.TrimPrefix(name, "group:")
 
+		pkgs := []string{name}
 		if isGroup {
 			//resolve groups
-			pkgs, err := resolvePackageGroup(name)
+			var err error
+			pkgs, err = resolvePackageGroup(name)
 			if err != nil {
 				return "", err
 			}
+		}
 
-			//accept packages in this group if not negated
-			for _, pkgName := range pkgs {
-				acceptPkg[pkgName] = !isNegated
-			}
-		} else {
-			acceptPkg[name] = !isNegated
-			if !isNegated {
-				actualRels = append(actualRels, rel)
-			}
+		if isNegated {
+			excludedPkgs = append(excludedPkgs, pkgs...)
+			continue
+		}
+		for _, pkgName := range pkgs {
+			acceptPkg[pkgName] = true
+		}
+		if !isGroup {
+			actualRels = append(actualRels, rel)
 		}
 	}
 
-	//prune all not-accepted packages from actualRels
+	//exclusions are only applied once all other relations have been read, so
+	//that they work regardless of the order of the relations
+	for _, pkgName := range excludedPkgs {
+		acceptPkg[pkgName] = false
+	}
+
+	//prune all not-accepted packages from actualRels (the same package may
+	//appear multiple times, e.g. "conflict = foo<2.0" and "conflict = foo>3.0")
 	prunedRels := make([]build.PackageRelation, 0, len(actualRels))
 	for _, rel := range actualRels {
 		if acceptPkg[rel.RelatedPackage] {
 			prunedRels = append(prunedRels, rel)
 		}
+	}
+	for _, rel := range actualRels {
 		delete(acceptPkg, rel.RelatedPackage)
 	}
 
@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"strings"
+	"testing"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+func TestCompilePackageRequirements(t *testing.T) {
+	//use the mock implementation of resolvePackageGroup(), where
+	//"group:foo-bar" contains the packages "foo" and "bar"
+	t.Setenv("HOLO_MOCK", "1")
+
+	testCases := []struct {
+		Names    []string
+		Expected string
+	}{
+		{[]string{"foo", "bar"}, "depend = foo\ndepend = bar\n"},
+		//groups are expanded into their packages (sorted by name)
+		{[]string{"group:foo-bar-baz"}, "depend = bar\ndepend = baz\ndepend = foo\n"},
+		//plain relations come before packages that are only added by groups
+		{[]string{"group:foo-bar", "qux", "bar"}, "depend = qux\ndepend = bar\ndepend = foo\n"},
+		//exclusions work regardless of their position
+		{[]string{"group:foo-bar-baz", "except:bar"}, "depend = baz\ndepend = foo\n"},
+		{[]string{"except:bar", "group:foo-bar-baz"}, "depend = baz\ndepend = foo\n"},
+		{[]string{"bar", "except:bar", "foo"}, "depend = foo\n"},
+		{[]string{"except:bar", "bar", "foo"}, "depend = foo\n"},
+		//exclusion of groups
+		{[]string{"group:foo-bar-baz", "except:group:bar-baz"}, "depend = foo\n"},
+		{[]string{"except:group:bar-baz", "baz", "group:foo-bar"}, "depend = foo\n"},
+		{[]string{"except:foo"}, ""},
+	}
+
+	for _, tc := range testCases {
+		rels := make([]build.PackageRelation, 0, len(tc.Names))
+		for _, name := range tc.Names {
+			rels = append(rels, build.PackageRelation{RelatedPackage: name})
+		}
+		actual, err := compilePackageRequirements("depend", rels)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.Names, err.Error())
+			continue
+		}
+		if actual != tc.Expected {
+			t.Errorf("%v: expected %q, but got %q", tc.Names, tc.Expected, actual)
+		}
+	}
+}
+
+func TestCompilePackageRequirementsKeepsConstraints(t *testing.T) {
+	t.Setenv("HOLO_MOCK", "1")
+	rels := []build.PackageRelation{
+		{RelatedPackage: "group:foo-bar"},
+		{RelatedPackage: "foo", Constraints: []build.VersionConstraint{
+			{Relation: ">=", Version: "1.0"},
+			{Relation: "<", Version: "2.0"},
+		}},
+	}
+	expected := "depend = foo>=1.0\ndepend = foo<2.0\ndepend = bar\n"
+	actual, err := compilePackageRequirements("depend", rels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected {
+		t.Errorf("expected %q, but got %q", expected, actual)
+	}
+}
+
+func TestConflictsAndReplacesKeepOperators(t *testing.T) {
+	for _, relation := range []string{"<", "<=", "=", ">=", ">"} {
+		constraints := []build.VersionConstraint{{Relation: relation, Version: "2.0"}}
+		pkg := &build.Package{
+			Name:         "foo",
+			Version:      "1.0",
+			Release:      1,
+			Architecture: build.ArchitectureAny,
+			Conflicts:    []build.PackageRelation{{RelatedPackage: "bar", Constraints: constraints}},
+			Replaces:     []build.PackageRelation{{RelatedPackage: "baz", Constraints: constraints}},
+			FSRoot:       filesystem.NewDirectory(),
+		}
+		g := &Generator{Package: pkg}
+		if errs := g.Validate(); len(errs) > 0 {
+			t.Fatalf("%s: unexpected validation errors: %q", relation, errs)
+		}
+		_, err := g.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pkginfo := string(g.GeneratedControlFiles()[".PKGINFO"])
+		for _, line := range []string{"conflict = bar" + relation + "2.0\n", "replaces = baz" + relation + "2.0\n"} {
+			if !strings.Contains(pkginfo, "\n"+line) {
+				t.Errorf("%s: expected line %q in .PKGINFO, but got %q", relation, line, pkginfo)
+			}
+		}
+	}
+}
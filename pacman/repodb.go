@@ -0,0 +1,148 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	build "github.com/holocm/libpackagebuild"
+)
+
+//repoDBFields lists the sections of a repository database "desc" entry (in
+//the order written by repo-add) together with the .PKGINFO keys that they are
+//taken from. Sections without a .PKGINFO key are computed by RepoDBEntry().
+var repoDBFields = []struct {
+	Section string
+	Key     string
+}{
+	{"FILENAME", ""},
+	{"NAME", "pkgname"},
+	{"BASE", "pkgbase"},
+	{"VERSION", "pkgver"},
+	{"DESC", "pkgdesc"},
+	{"GROUPS", "group"},
+	{"CSIZE", ""},
+	{"ISIZE", "size"},
+	{"MD5SUM", ""},
+	{"SHA256SUM", ""},
+	{"PGPSIG", ""},
+	{"URL", "url"},
+	{"LICENSE", "license"},
+	{"ARCH", "arch"},
+	{"BUILDDATE", "builddate"},
+	{"PACKAGER", "packager"},
+	{"REPLACES", "replaces"},
+	{"CONFLICTS", "conflict"},
+	{"PROVIDES", "provides"},
+	{"DEPENDS", "depend"},
+	{"OPTDEPENDS", "optdepend"},
+	{"MAKEDEPENDS", "makedepend"},
+	{"CHECKDEPENDS", "checkdepend"},
+}
+
+//RepoDBEntry renders the "desc" file for the given pacman package in a
+//repository database, like repo-add does. The package is read from pkgFile
+//(e.g. the result of Generator.Build()) and will be referenced by the given
+//fileName in the database.
+//
+//If signature is not nil, it must be the detached PGP signature of pkgFile,
+//and will be embedded into the entry as %PGPSIG%, so that pacman can verify
+//the package without downloading a separate ".sig" file.
+func RepoDBEntry(pkgFile []byte, fileName string, signature []byte) (string, error) {
+	pkginfo, err := readPKGINFO(pkgFile)
+	if err != nil {
+		return "", err
+	}
+
+	checksums := build.ComputeChecksums(pkgFile)
+	computed := map[string]string{
+		"FILENAME":  fileName,
+		"CSIZE":     strconv.Itoa(len(pkgFile)),
+		"MD5SUM":    checksums["md5"],
+		"SHA256SUM": checksums["sha256"],
+	}
+	if signature != nil {
+		computed["PGPSIG"] = base64.StdEncoding.EncodeToString(signature)
+	}
+
+	var buf bytes.Buffer
+	for _, field := range repoDBFields {
+		var values []string
+		if field.Key == "" {
+			if value := computed[field.Section]; value != "" {
+				values = []string{value}
+			}
+		} else {
+			values = pkginfo[field.Key]
+		}
+		if len(values) == 0 {
+			continue //like repo-add, omit empty sections
+		}
+		fmt.Fprintf(&buf, "%%%s%%\n%s\n\n", field.Section, strings.Join(values, "\n"))
+	}
+	return buf.String(), nil
+}
+
+//readPKGINFO extracts the .PKGINFO from the given (compressed) pacman package,
+//and returns its non-empty values for each key.
+func readPKGINFO(pkgFile []byte) (map[string][]string, error) {
+	data, err := build.Decompress(pkgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("package does not contain a .PKGINFO")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") != ".PKGINFO" {
+			continue
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make(map[string][]string)
+		for _, line := range strings.Split(string(contents), "\n") {
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(line, " = ", 2)
+			if len(kv) == 2 && kv[1] != "" {
+				result[kv[0]] = append(result[kv[0]], kv[1])
+			}
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,248 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package pacman
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	build "github.com/holocm/libpackagebuild"
+)
+
+//Mismatch describes a disagreement between the .MTREE of a pacman package and
+//the actual payload of that package, as reported by VerifyMTREE().
+type Mismatch struct {
+	//Path is the path of the affected entry as written in the .MTREE, e.g.
+	//"./etc/foo.conf".
+	Path string
+	//Field is the name of the mtree keyword that disagrees, e.g. "mode" or
+	//"sha256digest". For entries that exist only in the .MTREE or only in the
+	//payload, this is "type".
+	Field string
+	//MTREEValue is the value recorded in the .MTREE, or "" if the .MTREE does
+	//not contain this entry.
+	MTREEValue string
+	//PayloadValue is the value determined from the payload, or "" if the
+	//payload does not contain this entry.
+	PayloadValue string
+}
+
+//String returns a human-readable description of this mismatch.
+func (m Mismatch) String() string {
+	if m.MTREEValue == "" && m.Field == "type" {
+		return fmt.Sprintf("%s: not listed in .MTREE", m.Path)
+	}
+	if m.PayloadValue == "" && m.Field == "type" {
+		return fmt.Sprintf("%s: missing from payload", m.Path)
+	}
+	return fmt.Sprintf("%s: .MTREE has %s=%s, but payload has %s=%s",
+		m.Path, m.Field, m.MTREEValue, m.Field, m.PayloadValue)
+}
+
+//mtreeKeywords are the keywords checked by VerifyMTREE, in the order in which
+//mismatches are reported. The "time" keyword is ignored since
+//holo-build always uses a zero timestamp.
+var mtreeKeywords = []string{"type", "uid", "gid", "mode", "size", "md5digest", "sha256digest", "link"}
+
+//VerifyMTREE reads a built pacman package (XZ-, Zstandard- or
+//GZip-compressed, or uncompressed), recomputes the attributes of each payload
+//entry, and compares them against the records in the package's .MTREE. All
+//disagreeing entries are reported, sorted by path. An error is only returned
+//if the package cannot be read at all.
+func VerifyMTREE(r io.Reader) ([]Mismatch, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err = build.Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mtreeData []byte
+		payload   = make(map[string]map[string]string)
+	)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		path := "./" + strings.Trim(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if path == "./" || path == "./." {
+			continue //root directory is not listed in the .MTREE
+		}
+		if path == "./.MTREE" {
+			mtreeData, err = ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		attrs := map[string]string{
+			"uid":  strconv.Itoa(hdr.Uid),
+			"gid":  strconv.Itoa(hdr.Gid),
+			"mode": strconv.FormatInt(hdr.Mode&07777, 8),
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			attrs["type"] = "dir"
+		case tar.TypeSymlink:
+			attrs["type"] = "link"
+			attrs["link"] = mtreeEscapeString(hdr.Linkname)
+		case tar.TypeLink:
+			//hardlinks share the contents of their target, which must appear
+			//earlier in the archive
+			target := "./" + strings.Trim(strings.TrimPrefix(hdr.Linkname, "./"), "/")
+			targetAttrs, exists := payload[mtreeEscapeString(target)]
+			if !exists {
+				return nil, fmt.Errorf("hardlink %s points to unknown entry %s", path, target)
+			}
+			for key, value := range targetAttrs {
+				attrs[key] = value
+			}
+		case tar.TypeReg:
+			attrs["type"] = "file"
+			md5Hash := md5.New()
+			sha256Hash := sha256.New()
+			size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), tr)
+			if err != nil {
+				return nil, err
+			}
+			attrs["size"] = strconv.FormatInt(size, 10)
+			attrs["md5digest"] = hex.EncodeToString(md5Hash.Sum(nil))
+			attrs["sha256digest"] = hex.EncodeToString(sha256Hash.Sum(nil))
+		default:
+			attrs["type"] = fmt.Sprintf("unknown(%c)", hdr.Typeflag)
+		}
+		payload[mtreeEscapeString(path)] = attrs
+	}
+
+	if mtreeData == nil {
+		return nil, errors.New("package does not contain a .MTREE")
+	}
+	records, err := parseMTREE(mtreeData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse .MTREE: %s", err.Error())
+	}
+
+	var result []Mismatch
+	for path, expected := range records {
+		actual, exists := payload[path]
+		if !exists {
+			result = append(result, Mismatch{Path: path, Field: "type", MTREEValue: expected["type"]})
+			continue
+		}
+		for _, key := range mtreeKeywords {
+			expectedValue, isRecorded := expected[key]
+			if !isRecorded {
+				continue
+			}
+			if actualValue := actual[key]; actualValue != expectedValue {
+				result = append(result, Mismatch{Path: path, Field: key, MTREEValue: expectedValue, PayloadValue: actualValue})
+			}
+		}
+	}
+	for path, actual := range payload {
+		if _, exists := records[path]; !exists {
+			result = append(result, Mismatch{Path: path, Field: "type", PayloadValue: actual["type"]})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+//parseMTREE parses a (GZip-compressed) mtree file into a map of path to
+//keyword values, with "/set" defaults already applied. Paths are kept in
+//their escaped form.
+func parseMTREE(data []byte) (map[string]map[string]string, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+	contents, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := make(map[string]string)
+	records := make(map[string]map[string]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, field := range fields[1:] {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) == 2 {
+					defaults[kv[0]] = kv[1]
+				}
+			}
+		case "/unset":
+			for _, key := range fields[1:] {
+				delete(defaults, key)
+			}
+		default:
+			attrs := make(map[string]string, len(defaults))
+			for key, value := range defaults {
+				attrs[key] = value
+			}
+			for _, field := range fields[1:] {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("malformed keyword %q in line %q", field, line)
+				}
+				attrs[kv[0]] = kv[1]
+			}
+			if attrs["type"] != "file" {
+				//size and digests are only meaningful for regular files
+				delete(attrs, "size")
+				delete(attrs, "md5digest")
+				delete(attrs, "sha256digest")
+			}
+			records[fields[0]] = attrs
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"sort"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//BuildPreview summarizes the package that a generator would build, as
+//returned by the Preview() methods of the generators in this library.
+type BuildPreview struct {
+	//FileCount is the number of files in the package, i.e. all nodes except
+	//for directories.
+	FileCount int
+	//InstalledSizeInBytes is the installed size of the package contents (see
+	//filesystem.Node.InstalledSizeInBytes()).
+	InstalledSizeInBytes int64
+	//TopLevelDirectories contains the sorted names of the directories
+	//directly below the root directory (e.g. "etc" and "usr").
+	TopLevelDirectories []string
+	//ConfigFiles contains the sorted relative paths of all files that the
+	//package manager will treat as configuration files (e.g. by keeping local
+	//modifications during upgrades).
+	ConfigFiles []string
+}
+
+//NewBuildPreview computes a BuildPreview for the given package. The package
+//should already have been prepared like in Build(), i.e. with PrepareBuild()
+//and InsertDocFiles(). The configFiles are specific to the package format and
+//must be computed by the generator.
+func NewBuildPreview(pkg *Package, configFiles []string) BuildPreview {
+	stats := pkg.FSRoot.Stats()
+	preview := BuildPreview{
+		FileCount:            stats.RegularFiles + stats.Symlinks + stats.Hardlinks,
+		InstalledSizeInBytes: stats.InstalledSizeInBytes,
+		ConfigFiles:          configFiles,
+	}
+	for name, node := range pkg.FSRoot.Entries {
+		if _, ok := node.(*filesystem.Directory); ok {
+			preview.TopLevelDirectories = append(preview.TopLevelDirectories, name)
+		}
+	}
+	sort.Strings(preview.TopLevelDirectories)
+	return preview
+}
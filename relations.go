@@ -0,0 +1,254 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//validateContradictoryRelations reports requirements that can never be
+//satisfied because the package conflicts with all matching versions of the
+//required package. If CheckConflictingProvides is enabled, it also reports
+//provided packages that the package conflicts with.
+func (pkg *Package) validateContradictoryRelations(ec *errorCollector) {
+	relTypes := []struct {
+		Name string
+		Rels []PackageRelation
+	}{
+		{"requires", pkg.Requires},
+		{"pre-depends", pkg.PreDepends},
+	}
+	if pkg.OptionalChecks&CheckConflictingProvides != 0 {
+		relTypes = append(relTypes, struct {
+			Name string
+			Rels []PackageRelation
+		}{"provides", pkg.Provides})
+	}
+
+	for _, relType := range relTypes {
+		for _, rel := range relType.Rels {
+			for _, conflict := range pkg.Conflicts {
+				if conflict.RelatedPackage != rel.RelatedPackage {
+					continue
+				}
+				//unversioned provides only match unversioned conflicts
+				if relType.Name == "provides" && len(rel.Constraints) == 0 && len(conflict.Constraints) > 0 {
+					continue
+				}
+				if versionRangeOf(conflict.Constraints).Contains(versionRangeOf(rel.Constraints)) {
+					ec.Addf("\"%s\" in %s contradicts \"%s\" in conflicts",
+						formatRelation(rel), relType.Name, formatRelation(conflict))
+				}
+			}
+		}
+	}
+}
+
+func formatRelation(rel PackageRelation) string {
+	result := rel.RelatedPackage
+	for _, c := range rel.Constraints {
+		result += " " + c.Relation + " " + c.Version
+	}
+	return result
+}
+
+//versionRange is the set of versions that satisfy a list of version
+//constraints.
+type versionRange struct {
+	HasMin, HasMax   bool
+	Min, Max         string
+	MinIncl, MaxIncl bool
+}
+
+func versionRangeOf(constraints []VersionConstraint) versionRange {
+	var r versionRange
+	for _, c := range constraints {
+		switch c.Relation {
+		case ">", ">=":
+			r.restrictMin(c.Version, c.Relation == ">=")
+		case "<", "<=":
+			r.restrictMax(c.Version, c.Relation == "<=")
+		case "=":
+			r.restrictMin(c.Version, true)
+			r.restrictMax(c.Version, true)
+		}
+	}
+	return r
+}
+
+func (r *versionRange) restrictMin(version string, inclusive bool) {
+	if r.HasMin {
+		cmp := compareVersions(version, r.Min)
+		if cmp < 0 || (cmp == 0 && inclusive) {
+			return
+		}
+	}
+	r.HasMin, r.Min, r.MinIncl = true, version, inclusive
+}
+
+func (r *versionRange) restrictMax(version string, inclusive bool) {
+	if r.HasMax {
+		cmp := compareVersions(version, r.Max)
+		if cmp > 0 || (cmp == 0 && inclusive) {
+			return
+		}
+	}
+	r.HasMax, r.Max, r.MaxIncl = true, version, inclusive
+}
+
+//IsEmpty returns whether no version satisfies this range.
+func (r versionRange) IsEmpty() bool {
+	if !r.HasMin || !r.HasMax {
+		return false
+	}
+	cmp := compareVersions(r.Min, r.Max)
+	return cmp > 0 || (cmp == 0 && !(r.MinIncl && r.MaxIncl))
+}
+
+//Contains returns whether every version in the other range is also in this
+//range.
+func (r versionRange) Contains(other versionRange) bool {
+	if other.IsEmpty() {
+		return true
+	}
+	if r.HasMin {
+		if !other.HasMin {
+			return false
+		}
+		cmp := compareVersions(other.Min, r.Min)
+		if cmp < 0 || (cmp == 0 && other.MinIncl && !r.MinIncl) {
+			return false
+		}
+	}
+	if r.HasMax {
+		if !other.HasMax {
+			return false
+		}
+		cmp := compareVersions(other.Max, r.Max)
+		if cmp > 0 || (cmp == 0 && other.MaxIncl && !r.MaxIncl) {
+			return false
+		}
+	}
+	return true
+}
+
+//compareVersions compares two version strings of the form
+//"[epoch:]version[-release]", and returns -1, 0 or 1 if the first version is
+//older than, equal to, or newer than the second one. The comparison follows
+//the algorithm of rpmvercmp (which is also used by pacman, and agrees with
+//dpkg for most practical purposes). The release is only compared if both
+//versions have one.
+func compareVersions(a, b string) int {
+	epochA, versionA, releaseA := splitVersion(a)
+	epochB, versionB, releaseB := splitVersion(b)
+	if epochA != epochB {
+		if epochA < epochB {
+			return -1
+		}
+		return 1
+	}
+	if cmp := compareVersionSegments(versionA, versionB); cmp != 0 {
+		return cmp
+	}
+	if releaseA == "" || releaseB == "" {
+		return 0
+	}
+	return compareVersionSegments(releaseA, releaseB)
+}
+
+func splitVersion(v string) (epoch uint64, version, release string) {
+	if idx := strings.Index(v, ":"); idx >= 0 {
+		if e, err := strconv.ParseUint(v[:idx], 10, 64); err == nil {
+			epoch = e
+			v = v[idx+1:]
+		}
+	}
+	if idx := strings.LastIndex(v, "-"); idx >= 0 {
+		return epoch, v[:idx], v[idx+1:]
+	}
+	return epoch, v, ""
+}
+
+func isVersionAlnum(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func compareVersionSegments(a, b string) int {
+	for a != "" || b != "" {
+		//skip separators (but not "~", which sorts before everything)
+		a = strings.TrimLeftFunc(a, func(r rune) bool { return r != '~' && !isVersionAlnum(r) })
+		b = strings.TrimLeftFunc(b, func(r rune) bool { return r != '~' && !isVersionAlnum(r) })
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		//compare the next segment, which consists either of digits or of letters
+		isNumeric := unicode.IsDigit(rune(a[0]))
+		isSegment := func(r rune) bool {
+			return isVersionAlnum(r) && unicode.IsDigit(r) == isNumeric
+		}
+		segA := a[:len(a)-len(strings.TrimLeftFunc(a, isSegment))]
+		segB := b[:len(b)-len(strings.TrimLeftFunc(b, isSegment))]
+		a, b = a[len(segA):], b[len(segB):]
+		if segB == "" {
+			//numeric segments are newer than alphabetic ones
+			if isNumeric {
+				return 1
+			}
+			return -1
+		}
+
+		if isNumeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) < len(segB) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if cmp := strings.Compare(segA, segB); cmp != 0 {
+			return cmp
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
@@ -21,9 +21,19 @@
 package rpm
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -38,6 +48,35 @@ import (
 //Generator is the build.Generator for RPM packages.
 type Generator struct {
 	Package *build.Package
+	//SizeLimits, if set, cause Build() to fail for oversized packages.
+	build.SizeLimits
+	//ExtraControlFiles are added to the package header as additional
+	//scriptlets, since RPM has no control area. Acceptable names are "pre",
+	//"post", "preun", "postun", "pretrans" and "posttrans" (like the sections
+	//in spec files), except for "post" and "postun" when the package has the
+	//corresponding actions. The interpreter is taken from a shebang line in
+	//the first line of the script (without arguments), and defaults to
+	///bin/sh. Modes are ignored.
+	build.ExtraControlFiles
+	//XZMemoryLimit, if not zero, limits the memory usage of the xz compressor
+	//to the given number of bytes, at the expense of the compression ratio.
+	XZMemoryLimit int
+	//RemapOwner, if not nil, chooses the owners and groups recorded in the
+	//payload and in the header (see filesystem.RemapFunc).
+	RemapOwner func(path string, md filesystem.NodeMetadata) filesystem.NodeMetadata
+	//BuildTime, if not zero, is recorded as the build time of the package (as
+	//a Unix timestamp). If zero, the SOURCE_DATE_EPOCH environment variable
+	//is used instead if set. BuildHost, if not empty, is recorded as the name
+	//of the build host. The host name of the build system is never recorded
+	//automatically, and a build time only if one of the above is given, since
+	//they would make the package irreproducible.
+	BuildTime int64
+	BuildHost string
+
+	controlFiles     map[string][]byte
+	checksums        map[string]string
+	installedSize    int64
+	uncompressedSize int64
 }
 
 //GeneratorFactory spawns Generator instances. It satisfies the build.GeneratorFactory type.
@@ -47,35 +86,216 @@ func GeneratorFactory(pkg *build.Package) build.Generator {
 
 //Source for this data: `grep arch_canon /usr/lib/rpm/rpmrc`
 var archMap = map[build.Architecture]string{
-	build.ArchitectureAny:     "noarch",
-	build.ArchitectureI386:    "i686",
-	build.ArchitectureX86_64:  "x86_64",
-	build.ArchitectureARMv5:   "armv5tl",
-	build.ArchitectureARMv6h:  "armv6hl",
-	build.ArchitectureARMv7h:  "armv7hl",
-	build.ArchitectureAArch64: "aarch64",
+	build.ArchitectureAny:      "noarch",
+	build.ArchitectureI386:     "i686",
+	build.ArchitectureX86_64:   "x86_64",
+	build.ArchitectureARMv5:    "armv5tl",
+	build.ArchitectureARMv6h:   "armv6hl",
+	build.ArchitectureARMv7h:   "armv7hl",
+	build.ArchitectureAArch64:  "aarch64",
+	build.ArchitectureARMv7:    "armv7l",
+	build.ArchitectureMIPS:     "mips",
+	build.ArchitectureMIPS64EL: "mips64el",
+	build.ArchitectureLoong64:  "loongarch64",
 }
 var archIDMap = map[build.Architecture]uint16{
-	build.ArchitectureAny:     0,
-	build.ArchitectureI386:    1,
-	build.ArchitectureX86_64:  1,
-	build.ArchitectureARMv5:   12,
-	build.ArchitectureARMv6h:  12,
-	build.ArchitectureARMv7h:  12,
-	build.ArchitectureAArch64: 12,
+	build.ArchitectureAny:      0,
+	build.ArchitectureI386:     1,
+	build.ArchitectureX86_64:   1,
+	build.ArchitectureARMv5:    12,
+	build.ArchitectureARMv6h:   12,
+	build.ArchitectureARMv7h:   12,
+	build.ArchitectureAArch64:  12,
+	build.ArchitectureARMv7:    12,
+	build.ArchitectureMIPS:     4,
+	build.ArchitectureMIPS64EL: 11,
+	build.ArchitectureLoong64:  23,
+}
+
+//GeneratedControlFiles returns the binary metadata sections of the package
+//("lead", "signature" and "header"), as generated by the last call to Build().
+//RPM does not have separate control files, so the header section contains all
+//metadata, including the install scripts. Before the first Build(), nil is
+//returned.
+func (g *Generator) GeneratedControlFiles() map[string][]byte {
+	return g.controlFiles
+}
+
+//Checksums returns the digests of the package file produced by the last
+//successful call to Build(), as computed by build.ComputeChecksums().
+func (g *Generator) Checksums() (map[string]string, error) {
+	if g.checksums == nil {
+		return nil, build.ErrNotBuilt
+	}
+	return g.checksums, nil
+}
+
+//BuildResult is like Build, but also returns the sizes of the package. The
+//UncompressedSize is the size of the uncompressed CPIO payload.
+func (g *Generator) BuildResult() (build.BuildResult, error) {
+	data, err := g.Build()
+	if err != nil {
+		return build.BuildResult{}, err
+	}
+	return build.BuildResult{
+		Bytes:               data,
+		RecommendedFileName: g.RecommendedFileName(),
+		CompressedSize:      int64(len(data)),
+		UncompressedSize:    g.uncompressedSize,
+		InstalledSize:       g.installedSize,
+	}, nil
 }
 
 //Validate implements the build.Generator interface.
 func (g *Generator) Validate() []error {
+	errs, _ := g.ValidateWithWarnings()
+	return errs
+}
+
+//ValidateWithWarnings is like Validate, but also returns warnings (see
+//build.Package.ValidateWithWarnings()).
+func (g *Generator) ValidateWithWarnings() (errs []error, warnings []error) {
 	//TODO, (cannot find a reliable cross-distro source of truth for the
 	//acceptable format of package names and versions)
-	return nil
+	errs, warnings = g.Package.ValidateCommonWithWarnings("RPM")
+	errs = append(errs, validatePrefixes(g.Package)...)
+	errs = append(errs, validateFileSizes(g.Package)...)
+	buildTime, err := g.buildTime()
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+	case buildTime < 0 || buildTime > math.MaxInt32:
+		errs = append(errs, fmt.Errorf("build time %d cannot be represented in an RPM package", buildTime))
+	}
+	if strings.ContainsAny(g.BuildHost, "\x00\r\n") {
+		errs = append(errs, fmt.Errorf("build host %q may not contain line breaks or NUL bytes", g.BuildHost))
+	}
+	errs = append(errs, g.ValidateControlFileNames("RPM", func(name string) bool {
+		_, ok := scriptTagsForControlFile[name]
+		return ok
+	})...)
+	errs = append(errs, g.validateControlFileInterpreters()...)
+
+	//the synopsis becomes the Summary, which frontends like `dnf search`
+	//truncate, so warn about long synopses even without CheckSynopsisLength
+	if g.Package.OptionalChecks&build.CheckSynopsisLength == 0 {
+		warnings = append(warnings, g.Package.ValidateSynopsisLength()...)
+	}
+	return append(errs, validateTriggers(g.Package)...), warnings
+}
+
+//buildTime returns the build time that is recorded in the package, or 0 if
+//none shall be recorded (see BuildTime).
+func (g *Generator) buildTime() (int64, error) {
+	if g.BuildTime != 0 {
+		return g.BuildTime, nil
+	}
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for SOURCE_DATE_EPOCH: %q", value)
+	}
+	return seconds, nil
+}
+
+//validateControlFileInterpreters reports scriptlets in ExtraControlFiles
+//whose shebang line does not name exactly one interpreter.
+func (g *Generator) validateControlFileInterpreters() []error {
+	var errs []error
+	for _, file := range g.ControlFiles {
+		interpreter := controlFileInterpreter(file)
+		switch {
+		case interpreter == "":
+			errs = append(errs, fmt.Errorf("Control file \"%s\" has an empty shebang line", file.Name))
+		case strings.ContainsAny(interpreter, " \t"):
+			errs = append(errs, fmt.Errorf("Control file \"%s\" has interpreter arguments in its shebang line (\"#!%s\"), which are not supported since the interpreter is recorded as a single path; set the options in the script instead (e.g. \"set -e\")", file.Name, interpreter))
+		}
+	}
+	return errs
+}
+
+//validateFileSizes checks that all sizes fit into the 32-bit integers that
+//the RPM header uses for them.
+func validateFileSizes(pkg *build.Package) []error {
+	var errs []error
+	pkg.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+		if _, ok := node.(*filesystem.Directory); ok {
+			return nil
+		}
+		if node.InstalledSizeInBytes() > math.MaxInt32 {
+			errs = append(errs, fmt.Errorf("file %s is too large for an RPM package (%d bytes)", absolutePath, node.InstalledSizeInBytes()))
+		}
+		return nil
+	})
+	if size := pkg.FSRoot.InstalledSizeInBytes(); size > math.MaxInt32 {
+		errs = append(errs, fmt.Errorf("installed size of %d bytes is too large for an RPM package", size))
+	}
+	return errs
+}
+
+//validateTriggers checks the Type and Target of all RPM triggers.
+func validateTriggers(pkg *build.Package) []error {
+	var errs []error
+	for _, trigger := range pkg.RPMTriggers {
+		if _, ok := rpmsenseForTriggerType[trigger.Type]; !ok {
+			errs = append(errs, fmt.Errorf("unknown RPM trigger type %d", trigger.Type))
+		}
+		if trigger.Target.RelatedPackage == "" {
+			errs = append(errs, errors.New("RPM trigger is missing a target package"))
+		}
+		for _, c := range trigger.Target.Constraints {
+			if _, ok := flagsForConstraintRelation[c.Relation]; !ok || c.Relation == "rpmlib" {
+				errs = append(errs, fmt.Errorf("relation %q is not acceptable for RPM trigger on %q", c.Relation, trigger.Target.RelatedPackage))
+			}
+		}
+	}
+	return errs
+}
+
+//validatePrefixes checks that all files of a relocatable package are
+//located below one of its prefixes.
+func validatePrefixes(pkg *build.Package) []error {
+	if len(pkg.Prefixes) == 0 {
+		return nil
+	}
+
+	var errs []error
+	prefixes := make([]string, 0, len(pkg.Prefixes))
+	for _, prefix := range pkg.Prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Errorf("Prefix \"%s\" is not an absolute path", prefix))
+			continue
+		}
+		prefixes = append(prefixes, path.Clean(prefix))
+	}
+
+	pkg.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+		//implicitly created directories are not included in the payload (see
+		//makePayload), so they do not need to be below a prefix
+		if n, ok := node.(*filesystem.Directory); ok && n.Implicit {
+			return nil
+		}
+		if absolutePath == "/" {
+			return nil
+		}
+		for _, prefix := range prefixes {
+			if absolutePath == prefix || strings.HasPrefix(absolutePath, prefix+"/") {
+				return nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("Path \"%s\" is not below any of the prefixes of this relocatable package", absolutePath))
+		return filepath.SkipDir
+	})
+	return errs
 }
 
 //RecommendedFileName implements the build.Generator interface.
 func (g *Generator) RecommendedFileName() string {
-	//this is called after Build(), so we can assume that package name,
-	//version, etc. were already validated
+	//this only uses the package name, version and architecture, so it can be
+	//called before Build(), but we assume that Validate() was called before
 	pkg := g.Package
 	return fmt.Sprintf("%s-%s.%s.rpm", pkg.Name, fullVersionString(pkg), archMap[pkg.Architecture])
 }
@@ -91,27 +311,165 @@ func fullVersionString(pkg *build.Package) string {
 	return fmt.Sprintf("%s-%d", versionString(pkg), pkg.Release)
 }
 
+//Preview returns a summary of the package that Build() would produce, without
+//building it. Validation errors and size limit violations are reported like
+//in Validate() and Build(). The ConfigFiles are those marked as
+//%config(noreplace). The Package is not modified.
+func (g *Generator) Preview() (build.BuildPreview, error) {
+	errs := g.Validate()
+	if len(errs) > 0 {
+		return build.BuildPreview{}, errors.Join(errs...)
+	}
+	pkg := g.Package.Clone()
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = pkg.InsertDocFiles(build.LicenseDirectory)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return build.BuildPreview{}, err
+	}
+	return build.NewBuildPreview(pkg, configFiles(pkg)), nil
+}
+
 //Build implements the build.Generator interface.
 func (g *Generator) Build() ([]byte, error) {
+	err := g.prepareBuild()
+	if err != nil {
+		return nil, err
+	}
 	pkg := g.Package
-	pkg.PrepareBuild()
 
 	//assemble CPIO-LZMA payload
-	payload, err := makePayload(pkg)
+	payload, err := makePayload(pkg, g.XZMemoryLimit, g.RemapOwner)
 	if err != nil {
 		return nil, err
 	}
+	g.uncompressedSize = int64(payload.UncompressedSize)
 
 	//produce header sections in reverse order (since most of them depend on
 	//what comes after them)
-	headerSection := makeHeaderSection(pkg, payload)
-	signatureSection := makeSignatureSection(headerSection, payload)
-	lead := newLead(pkg).ToBinary()
+	headerSection, err := makeHeaderSection(g, payload)
+	if err != nil {
+		return nil, err
+	}
+	md5digest := digestHeaderAndPayload(headerSection)
+	md5digest.Write(payload.Binary)
+	signatureSection := makeSignatureSection(headerSection, payload, md5digest.Sum(nil))
 
 	//combine everything with the correct alignment
+	result := append(g.combineSections(signatureSection, headerSection), payload.Binary...)
+	err = g.CheckCompressedSize(pkg, result)
+	if err != nil {
+		return nil, err
+	}
+	g.checksums = build.ComputeChecksums(result)
+	return result, nil
+}
+
+//BuildReader is like Build, but streams the package file through the
+//returned reader instead of holding it in memory (see build.NewBuildReader).
+//Errors from preparing the package are returned immediately, errors from
+//compressing it are returned by Read(). Checksums() and BuildResult() become
+//available once the reader has been read to the end.
+//
+//Since the header and signature sections (which precede the payload)
+//contain the size and digest of the payload, the payload is generated three
+//times: once uncompressed and once compressed to compute these, and once
+//more while streaming. BuildReader thus takes longer than Build.
+func (g *Generator) BuildReader() (io.ReadCloser, error) {
+	err := g.prepareBuild()
+	if err != nil {
+		return nil, err
+	}
+	pkg := g.Package
+
+	uncompressedSize, err := writeCPIO(io.Discard, pkg, g.RemapOwner)
+	if err != nil {
+		return nil, err
+	}
+	payload := &rpmPayload{UncompressedSize: uint32(uncompressedSize)}
+	headerSection, err := makeHeaderSection(g, payload)
+	if err != nil {
+		return nil, err
+	}
+	md5digest := digestHeaderAndPayload(headerSection)
+	var compressedSize byteCounter
+	_, err = writeCompressedPayload(io.MultiWriter(md5digest, &compressedSize), pkg, g.XZMemoryLimit, g.RemapOwner)
+	if err != nil {
+		return nil, err
+	}
+	payload.CompressedSize = uint32(compressedSize)
+	md5sum := md5digest.Sum(nil)
+	signatureSection := makeSignatureSection(headerSection, payload, md5sum)
+	prefix := g.combineSections(signatureSection, headerSection)
+
+	g.checksums = nil
+	return build.NewBuildReader(func(w io.Writer) error {
+		pw := g.NewPackageWriter(pkg, w)
+		_, err := pw.Write(prefix)
+		if err != nil {
+			return err
+		}
+		md5digest := digestHeaderAndPayload(headerSection)
+		_, err = writeCompressedPayload(io.MultiWriter(pw, md5digest), pkg, g.XZMemoryLimit, g.RemapOwner)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(md5digest.Sum(nil), md5sum) {
+			return fmt.Errorf("cannot build package %s: compressing the payload is not reproducible", pkg.Name)
+		}
+		g.uncompressedSize = uncompressedSize
+		g.checksums = pw.Checksums()
+		return nil
+	}), nil
+}
+
+//prepareBuild executes all steps of Build() before generating the payload.
+func (g *Generator) prepareBuild() error {
+	pkg := g.Package
+	err := pkg.PrepareBuild(archMap)
+	if err != nil {
+		return err
+	}
+	err = pkg.InsertDocFiles(build.LicenseDirectory)
+	if err != nil {
+		return err
+	}
+	err = g.CheckInstalledSize(pkg)
+	if err != nil {
+		return err
+	}
+	g.installedSize = pkg.FSRoot.InstalledSizeInBytes()
+	return nil
+}
+
+//combineSections records the lead, signature and header sections in
+//g.controlFiles, and concatenates them with the correct alignment. The
+//payload follows right after the result.
+func (g *Generator) combineSections(signatureSection, headerSection []byte) []byte {
+	lead := newLead(g.Package).ToBinary()
+	g.controlFiles = map[string][]byte{
+		"lead":      lead,
+		"signature": signatureSection,
+		"header":    headerSection,
+	}
 	combined1 := appendAlignedTo8Byte(lead, signatureSection)
-	combined2 := appendAlignedTo8Byte(combined1, headerSection)
-	return append(combined2, payload.Binary...), nil
+	return appendAlignedTo8Byte(combined1, headerSection)
+}
+
+//byteCounter is an io.Writer that discards everything written into it, but
+//counts the number of bytes.
+type byteCounter int64
+
+//Write implements the io.Writer interface.
+func (c *byteCounter) Write(buf []byte) (int, error) {
+	*c += byteCounter(len(buf))
+	return len(buf), nil
 }
 
 //According to [LSB, 25.2.2], "A Header structure shall be aligned to an 8 byte
@@ -249,6 +249,8 @@ const (
 	rpmtagRelease           = 1002 //type: STRING
 	rpmtagSummary           = 1004 //type: I18NSTRING
 	rpmtagDescription       = 1005 //type: I18NSTRING
+	rpmtagBuildTime         = 1006 //type: INT32
+	rpmtagBuildHost         = 1007 //type: STRING
 	rpmtagSize              = 1009 //type: INT32
 	rpmtagDistribution      = 1010 //type: STRING
 	rpmtagVendor            = 1011 //type: STRING
@@ -266,6 +268,7 @@ const (
 	rpmtagPayloadFormat     = 1124 //type: STRING
 	rpmtagPayloadCompressor = 1125 //type: STRING
 	rpmtagPayloadFlags      = 1126 //type: STRING
+	rpmtagPrefixes          = 1098 //type: STRING_ARRAY
 	rpmtagPreIn             = 1023 //type: STRING
 	rpmtagPostIn            = 1024 //type: STRING
 	rpmtagPreUn             = 1025 //type: STRING
@@ -274,6 +277,16 @@ const (
 	rpmtagPostInProg        = 1086 //type: STRING
 	rpmtagPreUnProg         = 1087 //type: STRING
 	rpmtagPostUnProg        = 1088 //type: STRING
+	rpmtagPreTrans          = 1151 //type: STRING
+	rpmtagPostTrans         = 1152 //type: STRING
+	rpmtagPreTransProg      = 1153 //type: STRING
+	rpmtagPostTransProg     = 1154 //type: STRING
+	rpmtagTriggerScripts    = 1065 //type: STRING_ARRAY
+	rpmtagTriggerName       = 1066 //type: STRING_ARRAY
+	rpmtagTriggerVersion    = 1067 //type: STRING_ARRAY
+	rpmtagTriggerFlags      = 1068 //type: INT32
+	rpmtagTriggerIndex      = 1069 //type: INT32
+	rpmtagTriggerScriptProg = 1092 //type: STRING_ARRAY
 	rpmtagOldFileNames      = 1027 //type: STRING_ARRAY
 	rpmtagFileSizes         = 1028 //type: INT32
 	rpmtagFileModes         = 1030 //type: INT16
@@ -323,15 +336,18 @@ const (
 //Note that "RPMSENSE" is copied from the spec, but is clearly a euphemism.
 //There is nothing in RPM that makes sense.
 const (
-	rpmsenseAny          = 0
-	rpmsenseLess         = 0x02
-	rpmsenseGreater      = 0x04
-	rpmsenseEqual        = 0x08
-	rpmsensePrereq       = 0x40
-	rpmsenseInterp       = 0x100
-	rpmsenseScriptPre    = 0x200
-	rpmsenseScriptPost   = 0x400
-	rpmsenseScriptPreUn  = 0x800
-	rpmsenseScriptPostUn = 0x1000
-	rpmsenseRpmlib       = 0x1000000
+	rpmsenseAny           = 0
+	rpmsenseLess          = 0x02
+	rpmsenseGreater       = 0x04
+	rpmsenseEqual         = 0x08
+	rpmsensePrereq        = 0x40
+	rpmsenseInterp        = 0x100
+	rpmsenseScriptPre     = 0x200
+	rpmsenseScriptPost    = 0x400
+	rpmsenseScriptPreUn   = 0x800
+	rpmsenseScriptPostUn  = 0x1000
+	rpmsenseTriggerIn     = 0x10000
+	rpmsenseTriggerUn     = 0x20000
+	rpmsenseTriggerPostUn = 0x40000
+	rpmsenseRpmlib        = 0x1000000
 )
@@ -22,6 +22,7 @@ package rpm
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	build "github.com/holocm/libpackagebuild"
@@ -29,19 +30,36 @@ import (
 )
 
 //makeHeaderSection produces the header section of an RPM header.
-func makeHeaderSection(pkg *build.Package, payload *rpmPayload) []byte {
+func makeHeaderSection(g *Generator, payload *rpmPayload) ([]byte, error) {
+	pkg := g.Package
 	h := &rpmHeader{}
 
 	addPackageInformationTags(h, pkg)
+	buildTime, err := g.buildTime()
+	if err != nil {
+		return nil, err
+	}
+	if buildTime != 0 {
+		h.AddInt32Value(rpmtagBuildTime, []int32{int32(buildTime)})
+	}
+	if g.BuildHost != "" {
+		h.AddStringValue(rpmtagBuildHost, g.BuildHost, false)
+	}
 	h.AddInt32Value(rpmtagArchiveSize, []int32{int32(payload.UncompressedSize)})
 
-	addInstallationTags(h, pkg)
+	err = addInstallationTags(h, g)
+	if err != nil {
+		return nil, err
+	}
 
-	addFileInformationTags(h, pkg)
+	err = addFileInformationTags(h, pkg, g.RemapOwner)
+	if err != nil {
+		return nil, err
+	}
 
 	addDependencyInformationTags(h, pkg)
 
-	return h.ToBinary(rpmtagHeaderImmutable)
+	return h.ToBinary(rpmtagHeaderImmutable), nil
 }
 
 //see [LSB,25.2.4.1]
@@ -50,17 +68,28 @@ func addPackageInformationTags(h *rpmHeader, pkg *build.Package) {
 	h.AddStringValue(rpmtagVersion, versionString(pkg), false)
 	h.AddStringValue(rpmtagRelease, fmt.Sprintf("%d", pkg.Release), false)
 
-	//summary == first line of description
-	descSplit := strings.SplitN(pkg.Description, "\n", 2)
-	h.AddStringValue(rpmtagSummary, descSplit[0], true)
-	h.AddStringValue(rpmtagDescription, pkg.Description, true)
+	//summary == first line of description (the description itself is the
+	//full text, like %description in a spec file)
+	h.AddStringValue(rpmtagSummary, pkg.DescriptionSynopsis(), true)
+	h.AddStringValue(rpmtagDescription, strings.TrimSpace(pkg.Description), true)
 	sizeInBytes := int32(pkg.FSRoot.InstalledSizeInBytes())
 	h.AddInt32Value(rpmtagSize, []int32{sizeInBytes})
 
 	h.AddStringValue(rpmtagLicense, "None", false)
 
-	if pkg.Author != "" {
-		h.AddStringValue(rpmtagPackager, pkg.Author, false)
+	if pkg.PackagerName() != "" {
+		h.AddStringValue(rpmtagPackager, pkg.PackagerName(), false)
+	}
+	//RPM has no field for the upstream author, so it takes the place of the
+	//Vendor if necessary
+	switch {
+	case pkg.Vendor != "":
+		h.AddStringValue(rpmtagVendor, pkg.Vendor, false)
+	case pkg.UpstreamAuthor() != "":
+		h.AddStringValue(rpmtagVendor, pkg.UpstreamAuthor(), false)
+	}
+	if pkg.Source != "" {
+		h.AddStringValue(rpmtagURL, pkg.Source, false)
 	}
 
 	//source for valid package groups:
@@ -70,6 +99,9 @@ func addPackageInformationTags(h *rpmHeader, pkg *build.Package) {
 	//  <https://fedoraproject.org/wiki/Packaging:Guidelines?rd=Packaging/Guidelines#Group_tag>
 	h.AddStringValue(rpmtagGroup, "System/Management", true)
 
+	//mark package as relocatable
+	h.AddStringArrayValue(rpmtagPrefixes, pkg.Prefixes)
+
 	h.AddStringValue(rpmtagOs, "linux", false)
 	h.AddStringValue(rpmtagArch, archMap[pkg.Architecture], false)
 
@@ -79,19 +111,160 @@ func addPackageInformationTags(h *rpmHeader, pkg *build.Package) {
 }
 
 //see [LSB,25.2.4.2]
-func addInstallationTags(h *rpmHeader, pkg *build.Package) {
-	if script := pkg.Script(build.SetupAction); script != "" {
-		h.AddStringValue(rpmtagPostIn, script, false)
-		h.AddStringValue(rpmtagPostInProg, "/bin/sh", false)
+func addInstallationTags(h *rpmHeader, g *Generator) error {
+	pkg := g.Package
+	err := addScriptTags(h, pkg, build.SetupAction, rpmtagPostIn, rpmtagPostInProg)
+	if err != nil {
+		return err
+	}
+	err = addScriptTags(h, pkg, build.CleanupAction, rpmtagPostUn, rpmtagPostUnProg)
+	if err != nil {
+		return err
+	}
+	for _, file := range g.ControlFiles {
+		tags := scriptTagsForControlFile[file.Name]
+		isGenerated := (file.Name == "post" && pkg.Script(build.SetupAction) != "") ||
+			(file.Name == "postun" && pkg.Script(build.CleanupAction) != "")
+		if isGenerated {
+			return fmt.Errorf("cannot add control file %s: script is already generated", file.Name)
+		}
+		h.AddStringValue(tags[0], string(file.Content), false)
+		h.AddStringValue(tags[1], controlFileInterpreter(file), false)
+	}
+	addTriggerTags(h, pkg)
+	return nil
+}
+
+//controlFileInterpreter returns the interpreter for a scriptlet from
+//ExtraControlFiles. Like in spec files, the interpreter can be selected with a
+//shebang line. Shebang lines with interpreter arguments (e.g. "#!/bin/sh -e")
+//are rejected by Validate(), since the interpreter is recorded as a single
+//path.
+func controlFileInterpreter(file build.ControlFile) string {
+	script := string(file.Content)
+	if !strings.HasPrefix(script, "#!") {
+		return "/bin/sh"
+	}
+	return strings.TrimSpace(strings.SplitN(script[2:], "\n", 2)[0])
+}
+
+//scriptTagsForControlFile maps the acceptable names for ExtraControlFiles
+//(which are the names of the corresponding sections in spec files) to the tags
+//of the script and its interpreter.
+var scriptTagsForControlFile = map[string][2]uint32{
+	"pre":       {rpmtagPreIn, rpmtagPreInProg},
+	"post":      {rpmtagPostIn, rpmtagPostInProg},
+	"preun":     {rpmtagPreUn, rpmtagPreUnProg},
+	"postun":    {rpmtagPostUn, rpmtagPostUnProg},
+	"pretrans":  {rpmtagPreTrans, rpmtagPreTransProg},
+	"posttrans": {rpmtagPostTrans, rpmtagPostTransProg},
+}
+
+//rpmsenseForTriggerType maps RPMTrigger.Type to the flag that goes into
+//rpmtagTriggerFlags.
+var rpmsenseForTriggerType = map[uint]int32{
+	build.RPMTriggerIn:     rpmsenseTriggerIn,
+	build.RPMTriggerUn:     rpmsenseTriggerUn,
+	build.RPMTriggerPostUn: rpmsenseTriggerPostUn,
+}
+
+func addTriggerTags(h *rpmHeader, pkg *build.Package) {
+	if len(pkg.RPMTriggers) == 0 {
+		return
+	}
+
+	//each trigger script can be activated by multiple (name, flags, version)
+	//tuples, which refer to the script through rpmtagTriggerIndex
+	var (
+		scripts  []string
+		progs    []string
+		names    []string
+		versions []string
+		flags    []int32
+		indexes  []int32
+	)
+	for idx, trigger := range pkg.RPMTriggers {
+		interpreter := trigger.Interpreter
+		if interpreter == "" {
+			interpreter = "/bin/sh"
+		}
+		scripts = append(scripts, trigger.Content)
+		progs = append(progs, interpreter)
+
+		typeFlag := rpmsenseForTriggerType[trigger.Type]
+		if len(trigger.Target.Constraints) == 0 {
+			names = append(names, trigger.Target.RelatedPackage)
+			versions = append(versions, "")
+			flags = append(flags, typeFlag)
+			indexes = append(indexes, int32(idx))
+		}
+		for _, cons := range trigger.Target.Constraints {
+			names = append(names, trigger.Target.RelatedPackage)
+			versions = append(versions, cons.Version)
+			flags = append(flags, typeFlag|flagsForConstraintRelation[cons.Relation])
+			indexes = append(indexes, int32(idx))
+		}
+	}
+
+	h.AddStringArrayValue(rpmtagTriggerScripts, scripts)
+	h.AddStringArrayValue(rpmtagTriggerScriptProg, progs)
+	h.AddStringArrayValue(rpmtagTriggerName, names)
+	h.AddStringArrayValue(rpmtagTriggerVersion, versions)
+	h.AddInt32Value(rpmtagTriggerFlags, flags)
+	h.AddInt32Value(rpmtagTriggerIndex, indexes)
+}
+
+func addScriptTags(h *rpmHeader, pkg *build.Package, actionType uint, scriptTag, progTag uint32) error {
+	script := pkg.Script(actionType)
+	if script == "" {
+		return nil
+	}
+	interpreter, err := pkg.ScriptInterpreter(actionType)
+	if err != nil {
+		return err
 	}
-	if script := pkg.Script(build.CleanupAction); script != "" {
-		h.AddStringValue(rpmtagPostUn, script, false)
-		h.AddStringValue(rpmtagPostUnProg, "/bin/sh", false)
+	if interpreter == "" {
+		interpreter = "/bin/sh"
 	}
+	h.AddStringValue(scriptTag, script, false)
+	h.AddStringValue(progTag, interpreter, false)
+	return nil
+}
+
+//docFileFlags returns the file flags for the files from pkg.DocFiles, indexed
+//by absolute path.
+func docFileFlags(pkg *build.Package) map[string]int32 {
+	result := make(map[string]int32, len(pkg.DocFiles))
+	for _, doc := range pkg.DocFiles {
+		flag := int32(rpmfileDoc)
+		if doc.License {
+			flag = rpmfileLicense
+		}
+		result["/"+pkg.DocFilePath(doc, build.LicenseDirectory)] = flag
+	}
+	return result
+}
+
+//configFiles returns the relative paths of all files that
+//addFileInformationTags marks as %config(noreplace), in the order of Walk()
+//(which is sorted).
+func configFiles(pkg *build.Package) []string {
+	docFlags := docFileFlags(pkg)
+	var result []string
+	pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
+		switch node.(type) {
+		case *filesystem.RegularFile, *filesystem.ReaderFile, *filesystem.Hardlink:
+			if _, isDoc := docFlags[path]; !isDoc {
+				result = append(result, strings.TrimPrefix(path, "/"))
+			}
+		}
+		return nil
+	})
+	return result
 }
 
 //see [LSB,25.2.4.3]
-func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
+func addFileInformationTags(h *rpmHeader, pkg *build.Package, remap filesystem.RemapFunc) error {
 	var (
 		sizes       []int32
 		modes       []int16
@@ -111,9 +284,19 @@ func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
 		inodeNumber int32
 	)
 
+	//regular files are marked as %config(noreplace), except for those from
+	//pkg.DocFiles which are marked as %doc or %license instead
+	docFlags := docFileFlags(pkg)
+	regularFileFlags := func(path string) int32 {
+		if flag, ok := docFlags[path]; ok {
+			return flag
+		}
+		return rpmfileNoReplace
+	}
+
 	//collect attributes for all files in the archive
 	//(NOTE: This traversal works in the same way as the one in MakePayload.)
-	pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
+	err := walkFSSorted(pkg, func(path string, node filesystem.Node) error {
 		//skip implicitly created directories (as rpmbuild-constructed CPIO
 		//archives apparently do)
 		if n, ok := node.(*filesystem.Directory); ok {
@@ -122,6 +305,19 @@ func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
 			}
 		}
 
+		uid, gid, err := pkg.FSRoot.ArchiveOwner(path, node, remap)
+		if err != nil {
+			return err
+		}
+
+		//hardlinks are stored as separate copies of their target (see MakePayload)
+		if link, ok := node.(*filesystem.Hardlink); ok {
+			node, err = pkg.FSRoot.ResolveHardlink(link)
+			if err != nil {
+				return err
+			}
+		}
+
 		//stupid stuff (which is an understatement because this whole section
 		//is completely redundant)
 		inodeNumber++ //make up inode numbers in the same way as rpmbuild does
@@ -145,6 +341,9 @@ func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
 		modes = append(modes, int16(node.FileModeForArchive(true)))
 		mtimes = append(mtimes, 0)
 
+		ownerNames = append(ownerNames, idToString(uid))
+		groupNames = append(groupNames, idToString(gid))
+
 		//type-dependent metadata
 		switch n := node.(type) {
 		case *filesystem.Directory:
@@ -152,26 +351,32 @@ func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
 			md5s = append(md5s, "")
 			linktos = append(linktos, "")
 			flags = append(flags, 0)
-			ownerNames = append(ownerNames, idToString(n.Metadata.UID()))
-			groupNames = append(groupNames, idToString(n.Metadata.GID()))
 		case *filesystem.RegularFile:
 			sizes = append(sizes, int32(len(n.Content)))
 			md5s = append(md5s, n.MD5Digest())
 			linktos = append(linktos, "")
-			flags = append(flags, rpmfileNoReplace)
-			ownerNames = append(ownerNames, idToString(n.Metadata.UID()))
-			groupNames = append(groupNames, idToString(n.Metadata.GID()))
+			flags = append(flags, regularFileFlags(path))
+		case *filesystem.ReaderFile:
+			md5Digest, _, err := n.Digests()
+			if err != nil {
+				return fmt.Errorf("cannot read %s: %s", path, err.Error())
+			}
+			sizes = append(sizes, int32(n.Size))
+			md5s = append(md5s, md5Digest)
+			linktos = append(linktos, "")
+			flags = append(flags, regularFileFlags(path))
 		case *filesystem.Symlink:
 			sizes = append(sizes, int32(len(n.Target)))
 			md5s = append(md5s, "")
 			linktos = append(linktos, n.Target)
 			flags = append(flags, 0)
-			ownerNames = append(ownerNames, "root")
-			groupNames = append(groupNames, "root")
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
 	h.AddInt32Value(rpmtagFileSizes, sizes)
 	h.AddInt16Value(rpmtagFileModes, modes)
@@ -188,6 +393,38 @@ func addFileInformationTags(h *rpmHeader, pkg *build.Package) {
 	h.AddInt32Value(rpmtagDirIndexes, dirIndexes)
 	h.AddStringArrayValue(rpmtagBasenames, basenames)
 	h.AddStringArrayValue(rpmtagDirNames, dirnames)
+	return nil
+}
+
+//walkFSSorted is like pkg.WalkFSWithAbsolutePaths, but yields the paths in
+//strictly lexicographical order. Walk() sorts the entries of each directory,
+//but descends into "foo" before visiting "foo-bar", whereas RPM expects the
+//file list to be sorted by full path (it uses binary search to find files in
+//there).
+func walkFSSorted(pkg *build.Package, callback func(path string, node filesystem.Node) error) error {
+	type entry struct {
+		Path string
+		Node filesystem.Node
+	}
+	var entries []entry
+	err := pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
+		entries = append(entries, entry{path, node})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	for _, e := range entries {
+		err = callback(e.Path, e.Node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //If `list` contains `value`, otherwise append `value` to `list`.
@@ -215,7 +452,8 @@ func idToString(id uint32) string {
 func addDependencyInformationTags(h *rpmHeader, pkg *build.Package) {
 	serializeRelations(h, pkg.Requires,
 		rpmtagRequireName, rpmtagRequireFlags, rpmtagRequireVersion)
-	serializeRelations(h, pkg.Provides,
+	provides := append(append([]build.PackageRelation(nil), pkg.Provides...), libraryProvides(pkg)...)
+	serializeRelations(h, provides,
 		rpmtagProvideName, rpmtagProvideFlags, rpmtagProvideVersion)
 	serializeRelations(h, pkg.Conflicts,
 		rpmtagConflictName, rpmtagConflictFlags, rpmtagConflictVersion)
@@ -254,6 +492,20 @@ var flagsForConstraintRelation = map[string]int32{
 	"rpmlib": rpmsenseRpmlib | rpmsenseLess | rpmsenseEqual,
 }
 
+//libraryProvides renders Package.ProvidedLibraries in the same way as
+//rpmbuild does for the shared libraries that it finds in a package, e.g.
+//"libfoo.so.1" on x86_64 as "libfoo.so.1()(64bit)".
+func libraryProvides(pkg *build.Package) []build.PackageRelation {
+	var result []build.PackageRelation
+	for _, soname := range pkg.ProvidedLibraries {
+		if pkg.Architecture.Is64Bit() {
+			soname += "()(64bit)"
+		}
+		result = append(result, build.PackageRelation{RelatedPackage: soname})
+	}
+	return result
+}
+
 func serializeRelations(h *rpmHeader, rels []build.PackageRelation, namesTag, flagsTag, versionsTag uint32) {
 	//for the Requires list, we need to add pseudo-dependencies to describe the
 	//structure of our package (because apparently a custom key-value database
@@ -0,0 +1,361 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package rpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	build "github.com/holocm/libpackagebuild"
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//decodedHeader is the result of decodeHeader().
+type decodedHeader struct {
+	Records map[uint32]rpmHeaderIndexRecord
+	Data    []byte
+}
+
+//decodeHeader parses the binary representation of an RPM header structure
+//as produced by rpmHeader.ToBinary().
+func decodeHeader(t *testing.T, buf []byte) decodedHeader {
+	t.Helper()
+	var hr headerRecord
+	r := bytes.NewReader(buf)
+	err := binary.Read(r, binary.BigEndian, &hr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if hr.Magic != [4]byte{0x8E, 0xAD, 0xE8, 0x01} {
+		t.Fatalf("invalid header magic %v", hr.Magic)
+	}
+	result := decodedHeader{Records: make(map[uint32]rpmHeaderIndexRecord)}
+	for idx := uint32(0); idx < hr.IndexRecordCount; idx++ {
+		var ir rpmHeaderIndexRecord
+		err := binary.Read(r, binary.BigEndian, &ir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result.Records[ir.Tag] = ir
+	}
+	dataStart := 16 + 16*int(hr.IndexRecordCount)
+	if len(buf) != dataStart+int(hr.DataSize) {
+		t.Fatalf("expected header of %d bytes, but got %d bytes", dataStart+int(hr.DataSize), len(buf))
+	}
+	result.Data = buf[dataStart:]
+	return result
+}
+
+func (h decodedHeader) record(t *testing.T, tag, typeID uint32) rpmHeaderIndexRecord {
+	t.Helper()
+	ir, ok := h.Records[tag]
+	if !ok {
+		t.Fatalf("missing tag %d", tag)
+	}
+	if ir.Type != typeID {
+		t.Fatalf("expected type %d for tag %d, but got %d", typeID, tag, ir.Type)
+	}
+	return ir
+}
+
+func (h decodedHeader) Int32Array(t *testing.T, tag uint32) []int32 {
+	t.Helper()
+	ir := h.record(t, tag, rpmInt32Type)
+	result := make([]int32, ir.Count)
+	err := binary.Read(bytes.NewReader(h.Data[ir.Offset:]), binary.BigEndian, result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return result
+}
+
+func (h decodedHeader) StringArray(t *testing.T, tag uint32) []string {
+	t.Helper()
+	ir := h.record(t, tag, rpmStringArrayType)
+	fields := strings.SplitN(string(h.Data[ir.Offset:]), "\x00", int(ir.Count)+1)
+	if len(fields) <= int(ir.Count) {
+		t.Fatalf("truncated string array for tag %d", tag)
+	}
+	return fields[:ir.Count]
+}
+
+//makeTestPackage builds a package whose Walk() order is not sorted by full
+//path, since "/usr/share/foo" is visited (with its contents) before
+//"/usr/share/foo-bar".
+func makeTestPackage(t *testing.T) *build.Package {
+	t.Helper()
+	pkg := &build.Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: build.ArchitectureAny,
+		FSRoot:       filesystem.NewDirectory(),
+	}
+	md := filesystem.NodeMetadata{Mode: 0644}
+	for _, path := range []string{"/usr/share/foo/b", "/usr/share/foo/a", "/usr/share/foo-bar", "/usr/share/foo.d/c", "/etc/foo.conf"} {
+		err := pkg.InsertFSNode(path, &filesystem.RegularFile{Content: path, Metadata: md})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := pkg.InsertFSNode("/usr/share/foo", filesystem.NewDirectory())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return pkg
+}
+
+func buildHeader(t *testing.T, g *Generator) decodedHeader {
+	t.Helper()
+	_, err := g.Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return decodeHeader(t, g.GeneratedControlFiles()["header"])
+}
+
+func TestFileListIsSorted(t *testing.T) {
+	h := buildHeader(t, &Generator{Package: makeTestPackage(t)})
+
+	basenames := h.StringArray(t, rpmtagBasenames)
+	dirnames := h.StringArray(t, rpmtagDirNames)
+	dirIndexes := h.Int32Array(t, rpmtagDirIndexes)
+	if len(dirIndexes) != len(basenames) {
+		t.Fatalf("got %d basenames, but %d dirindexes", len(basenames), len(dirIndexes))
+	}
+
+	var paths []string
+	for idx, basename := range basenames {
+		dirIdx := dirIndexes[idx]
+		if dirIdx < 0 || int(dirIdx) >= len(dirnames) {
+			t.Fatalf("dirindex %d of %q is out of range", dirIdx, basename)
+		}
+		dirname := dirnames[dirIdx]
+		if !strings.HasSuffix(dirname, "/") {
+			t.Errorf("dirname %q of %q does not end with a slash", dirname, basename)
+		}
+		//the root directory is recorded with basename "/" and dirname "/"
+		paths = append(paths, path.Join(dirname, basename))
+	}
+
+	//implicit directories are not listed (see addFileInformationTags)
+	expected := []string{
+		"/",
+		"/etc/foo.conf",
+		"/usr/share/foo",
+		"/usr/share/foo-bar",
+		"/usr/share/foo.d/c",
+		"/usr/share/foo/a",
+		"/usr/share/foo/b",
+	}
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected file list %q, but got %q", expected, paths)
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Errorf("file list is not sorted: %q", paths)
+	}
+
+	//the other per-file arrays must be parallel to the file list
+	for _, tag := range []uint32{rpmtagFileSizes, rpmtagFileMtimes, rpmtagFileFlags, rpmtagFileInodes} {
+		if count := h.Records[tag].Count; int(count) != len(paths) {
+			t.Errorf("expected %d entries for tag %d, but got %d", len(paths), tag, count)
+		}
+	}
+}
+
+func TestHeaderIsReproducible(t *testing.T) {
+	first := &Generator{Package: makeTestPackage(t)}
+	second := &Generator{Package: makeTestPackage(t)}
+	buildHeader(t, first)
+	buildHeader(t, second)
+	if !bytes.Equal(first.GeneratedControlFiles()["header"], second.GeneratedControlFiles()["header"]) {
+		t.Error("headers of identical packages differ")
+	}
+}
+
+func TestProvides(t *testing.T) {
+	testCases := []struct {
+		Architecture build.Architecture
+		Expected     []string
+	}{
+		{build.ArchitectureX86_64, []string{"mail-transport-agent", "libfoo.so.1()(64bit)"}},
+		{build.ArchitectureI386, []string{"mail-transport-agent", "libfoo.so.1"}},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage(t)
+		pkg.Architecture = tc.Architecture
+		pkg.Provides = []build.PackageRelation{{RelatedPackage: "mail-transport-agent"}}
+		pkg.ProvidedLibraries = []string{"libfoo.so.1"}
+		g := &Generator{Package: pkg}
+		if errs := g.Validate(); len(errs) > 0 {
+			t.Fatalf("unexpected validation errors: %q", errs)
+		}
+
+		h := buildHeader(t, g)
+		names := h.StringArray(t, rpmtagProvideName)
+		if strings.Join(names, "\n") != strings.Join(tc.Expected, "\n") {
+			t.Errorf("expected provides %q for architecture %d, but got %q", tc.Expected, tc.Architecture, names)
+		}
+		for idx, flag := range h.Int32Array(t, rpmtagProvideFlags) {
+			if flag != rpmsenseAny {
+				t.Errorf("expected no version for %q, but got flags %d", names[idx], flag)
+			}
+		}
+	}
+}
+
+func TestControlFileInterpreters(t *testing.T) {
+	testCases := []struct {
+		Script      string
+		Interpreter string
+		Error       string
+	}{
+		{"echo foo\n", "/bin/sh", ""},
+		{"#!/bin/bash\necho foo\n", "/bin/bash", ""},
+		{"#!/usr/bin/python3 \nprint('foo')\n", "/usr/bin/python3", ""},
+		{"#!/bin/bash -e\necho foo\n", "", `interpreter arguments in its shebang line ("#!/bin/bash -e")`},
+		{"#!\necho foo\n", "", "empty shebang line"},
+	}
+
+	for _, tc := range testCases {
+		g := &Generator{Package: makeTestPackage(t)}
+		g.AddControlFile("pre", []byte(tc.Script), 0755)
+		errs := g.Validate()
+		if tc.Error != "" {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), tc.Error) {
+				t.Errorf("expected error %q for %q, but got %q", tc.Error, tc.Script, errs)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Errorf("unexpected validation errors for %q: %q", tc.Script, errs)
+			continue
+		}
+
+		h := buildHeader(t, g)
+		ir := h.record(t, rpmtagPreInProg, rpmStringType)
+		interpreter := strings.SplitN(string(h.Data[ir.Offset:]), "\x00", 2)[0]
+		if interpreter != tc.Interpreter {
+			t.Errorf("expected interpreter %q for %q, but got %q", tc.Interpreter, tc.Script, interpreter)
+		}
+	}
+}
+
+func TestBuildTimeAndHost(t *testing.T) {
+	//neither the current time nor the build system's host name are recorded
+	//by default
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	h := buildHeader(t, &Generator{Package: makeTestPackage(t)})
+	for _, tag := range []uint32{rpmtagBuildTime, rpmtagBuildHost} {
+		if _, exists := h.Records[tag]; exists {
+			t.Errorf("expected no tag %d by default", tag)
+		}
+	}
+
+	//SOURCE_DATE_EPOCH is used as the default build time
+	t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	h = buildHeader(t, &Generator{Package: makeTestPackage(t)})
+	if value := h.Int32Array(t, rpmtagBuildTime); len(value) != 1 || value[0] != 1500000000 {
+		t.Errorf("expected build time 1500000000, but got %v", value)
+	}
+	h = buildHeader(t, &Generator{Package: makeTestPackage(t), BuildTime: 1600000000, BuildHost: "build.example.org"})
+	if value := h.Int32Array(t, rpmtagBuildTime); len(value) != 1 || value[0] != 1600000000 {
+		t.Errorf("expected build time 1600000000, but got %v", value)
+	}
+	ir := h.record(t, rpmtagBuildHost, rpmStringType)
+	if host := strings.SplitN(string(h.Data[ir.Offset:]), "\x00", 2)[0]; host != "build.example.org" {
+		t.Errorf("expected build host %q, but got %q", "build.example.org", host)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	errs := (&Generator{Package: makeTestPackage(t)}).Validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "invalid value for SOURCE_DATE_EPOCH") {
+		t.Errorf("expected error for invalid SOURCE_DATE_EPOCH, but got %q", errs)
+	}
+}
+
+func TestEmptyDirectoryIsExtracted(t *testing.T) {
+	//libarchive can read RPM packages (like rpm2cpio)
+	if _, err := exec.LookPath("bsdtar"); err != nil {
+		t.Skip("bsdtar is not available")
+	}
+	pkg := &build.Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: build.ArchitectureAny,
+		FSRoot:       filesystem.NewDirectory(),
+	}
+	err := pkg.InsertFSNode("/var/lib/foo", &filesystem.Directory{Entries: map[string]filesystem.Node{}, Metadata: filesystem.NodeMetadata{Mode: 0750}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := (&Generator{Package: pkg}).Build()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	extractDir := t.TempDir()
+	cmd := exec.Command("bsdtar", "-xf", "-", "-C", extractDir)
+	cmd.Stdin = bytes.NewReader(data)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("bsdtar failed: %s: %s", err.Error(), output)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(extractDir, "var/lib/foo"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) > 0 {
+		t.Errorf("expected /var/lib/foo to be empty, but found %d entries", len(entries))
+	}
+}
+
+func TestSynopsisLengthWarning(t *testing.T) {
+	for _, optionalChecks := range []build.OptionalCheck{0, build.CheckSynopsisLength} {
+		pkg := makeTestPackage(t)
+		pkg.OptionalChecks = optionalChecks
+		pkg.Description = strings.Repeat("x", 80) + "\nThis line is not part of the Summary."
+		errs, warnings := (&Generator{Package: pkg}).ValidateWithWarnings()
+		if len(errs) > 0 {
+			t.Errorf("unexpected validation errors: %q", errs)
+		}
+		expected := "Description synopsis is 80 characters long, but should not be longer than 79 characters"
+		if len(warnings) != 1 || warnings[0].Error() != expected {
+			t.Errorf("with OptionalChecks = %d: expected warning %q, but got %q", optionalChecks, expected, warnings)
+		}
+	}
+
+	pkg := makeTestPackage(t)
+	pkg.Description = strings.Repeat("x", 79) + "\n" + strings.Repeat("y", 200)
+	_, warnings := (&Generator{Package: pkg}).ValidateWithWarnings()
+	if len(warnings) > 0 {
+		t.Errorf("unexpected warnings for synopsis of acceptable length: %q", warnings)
+	}
+}
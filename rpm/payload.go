@@ -22,8 +22,9 @@ package rpm
 import (
 	"bytes"
 	"encoding/binary"
-	"os"
-	"os/exec"
+	"fmt"
+	"io"
+	"sync"
 
 	build "github.com/holocm/libpackagebuild"
 	"github.com/holocm/libpackagebuild/filesystem"
@@ -54,8 +55,53 @@ type cpioHeader struct {
 }
 
 //MakePayload generates the Payload for the given package.
-func makePayload(pkg *build.Package) (*rpmPayload, error) {
-	var buf bytes.Buffer
+func makePayload(pkg *build.Package, xzMemoryLimit int, remap filesystem.RemapFunc) (*rpmPayload, error) {
+	//the uncompressed archive is only needed until it has been compressed, so
+	//its buffer can be reused
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufferPool.Put(buf)
+	_, err := writeCPIO(buf, pkg, remap)
+	if err != nil {
+		return nil, err
+	}
+
+	//compress the archive with LZMA
+	uncompressed := buf.Bytes()
+	var out bytes.Buffer
+	err = filesystem.RunXZ(&out, bytes.NewReader(uncompressed), xzMemoryLimit, "--format=lzma")
+	compressed := out.Bytes()
+
+	return &rpmPayload{
+		Binary:           compressed,
+		CompressedSize:   uint32(len(compressed)),
+		UncompressedSize: uint32(len(uncompressed)),
+	}, err
+}
+
+//writeCompressedPayload writes the same payload as makePayload() into the
+//given writer, without holding it in memory. The size of the uncompressed
+//CPIO archive is returned.
+func writeCompressedPayload(w io.Writer, pkg *build.Package, xzMemoryLimit int, remap filesystem.RemapFunc) (int64, error) {
+	wc, err := filesystem.XZCompressor{MemoryLimit: xzMemoryLimit, Format: "lzma"}.Wrap(w)
+	if err != nil {
+		return 0, err
+	}
+	size, err := writeCPIO(wc, pkg, remap)
+	closeErr := wc.Close()
+	//when xz fails, writing into it fails as well, but the error from Close()
+	//is more useful
+	if closeErr != nil {
+		return 0, closeErr
+	}
+	return size, err
+}
+
+//writeCPIO writes the uncompressed CPIO archive for the given package into
+//the given writer, and returns its size. Owners are chosen by
+//filesystem.Directory.ArchiveOwner() with the given RemapFunc.
+func writeCPIO(w io.Writer, pkg *build.Package, remap filesystem.RemapFunc) (int64, error) {
+	buf := &cpioWriter{w: w}
 	inodeNumber := uint32(0)
 
 	//some fixed values that we can reuse
@@ -65,7 +111,7 @@ func makePayload(pkg *build.Package) (*rpmPayload, error) {
 
 	//assemble the CPIO archive
 	//(NOTE: This traversal works in the same way as the one in addFileInformationTags.)
-	pkg.WalkFSWithAbsolutePaths(func(path string, node filesystem.Node) error {
+	err := walkFSSorted(pkg, func(path string, node filesystem.Node) error {
 		//skip implicitly created directories (as rpmbuild-constructed CPIO
 		//archives apparently do)
 		if n, ok := node.(*filesystem.Directory); ok {
@@ -74,14 +120,29 @@ func makePayload(pkg *build.Package) (*rpmPayload, error) {
 			}
 		}
 
+		uid, gid, err := pkg.FSRoot.ArchiveOwner(path, node, remap)
+		if err != nil {
+			return err
+		}
+
+		//hardlinks are stored as separate copies of their target, which RPM
+		//installs as separate files
+		if link, ok := node.(*filesystem.Hardlink); ok {
+			node, err = pkg.FSRoot.ResolveHardlink(link)
+			if err != nil {
+				return err
+			}
+		}
+
 		inodeNumber++                            //make up inode numbers in the same way as rpmbuild does
 		name := append([]byte("."+path), '\000') //must be NUL-terminated!
 
 		header := cpioHeader{
-			Magic:       cpioMagic,
-			InodeNumber: cpioFormatInt(inodeNumber),
-			Mode:        cpioFormatInt(node.FileModeForArchive(true)),
-			//UID, GID depend on the node type; see below
+			Magic:            cpioMagic,
+			InodeNumber:      cpioFormatInt(inodeNumber),
+			Mode:             cpioFormatInt(node.FileModeForArchive(true)),
+			UID:              cpioFormatInt(uid),
+			GID:              cpioFormatInt(gid),
 			NumberOfLinks:    cpioOne,
 			ModificationTime: cpioZero, //fixed for reproducability
 			//FileSize depends on the node type; see below
@@ -94,32 +155,43 @@ func makePayload(pkg *build.Package) (*rpmPayload, error) {
 		}
 
 		var data []byte
+		var contents *filesystem.ReaderFile
 
 		switch n := node.(type) {
-		case *filesystem.Directory:
-			header.UID = cpioFormatInt(n.Metadata.UID())
-			header.GID = cpioFormatInt(n.Metadata.GID())
-			header.FileSize = cpioZero
 		case *filesystem.RegularFile:
-			header.UID = cpioFormatInt(n.Metadata.UID())
-			header.GID = cpioFormatInt(n.Metadata.GID())
 			data = []byte(n.Content)
+		case *filesystem.ReaderFile:
+			contents = n
 		case *filesystem.Symlink:
-			header.UID = cpioZero
-			header.GID = cpioZero
 			data = []byte(n.Target)
 		}
-		header.FileSize = cpioFormatInt(uint32(len(data)))
-		binary.Write(&buf, binary.BigEndian, &header)
-		cpioWriteData(&buf, name)
-		cpioWriteData(&buf, data)
+		if contents == nil {
+			header.FileSize = cpioFormatInt(uint32(len(data)))
+		} else {
+			header.FileSize = cpioFormatInt(uint32(contents.Size))
+		}
+		binary.Write(buf, binary.BigEndian, &header)
+		buf.WriteData(name)
+		if contents == nil {
+			buf.WriteData(data)
+			return buf.err
+		}
 
-		return nil
+		//stream the contents of ReaderFiles instead of reading them into memory
+		_, err = contents.WriteTo(buf)
+		if err != nil && buf.err == nil {
+			return fmt.Errorf("cannot read %s: %s", path, err.Error())
+		}
+		buf.WriteData(nil)
+		return buf.err
 	})
+	if err != nil {
+		return 0, err
+	}
 
 	//write trailer record to indicate the end of the CPIO archive
 	trailerName := []byte("TRAILER!!!\000")
-	binary.Write(&buf, binary.BigEndian, &cpioHeader{
+	binary.Write(buf, binary.BigEndian, &cpioHeader{
 		Magic:            cpioMagic,
 		InodeNumber:      cpioZero,
 		Mode:             cpioZero,
@@ -135,20 +207,14 @@ func makePayload(pkg *build.Package) (*rpmPayload, error) {
 		NameSize:         cpioFormatInt(uint32(len(trailerName))),
 		Checksum:         cpioZero,
 	})
-	cpioWriteData(&buf, trailerName)
-
-	//compress the archive with LZMA
-	uncompressed := buf.Bytes()
-	cmd := exec.Command("xz", "--format=lzma", "--compress")
-	cmd.Stdin = bytes.NewReader(uncompressed)
-	cmd.Stderr = os.Stderr
-	compressed, err := cmd.Output()
+	buf.WriteData(trailerName)
+	return buf.n, buf.err
+}
 
-	return &rpmPayload{
-		Binary:           compressed,
-		CompressedSize:   uint32(len(compressed)),
-		UncompressedSize: uint32(len(uncompressed)),
-	}, err
+//bufferPool holds buffers for uncompressed payloads, to avoid allocating a
+//new large buffer for each Build() when building many packages in a row.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
 var hexDigits = []byte("0123456789ABCDEF")
@@ -162,12 +228,33 @@ func cpioFormatInt(value uint32) [8]byte {
 	return str
 }
 
-func cpioWriteData(buf *bytes.Buffer, data []byte) {
-	buf.Write(data)
+//cpioWriter is the io.Writer used by writeCPIO. It tracks the offset in the
+//CPIO archive for computing paddings, and retains the first write error, so
+//that not every single write needs to be checked.
+type cpioWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+//Write implements the io.Writer interface.
+func (cw *cpioWriter) Write(buf []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(buf)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+//WriteData writes the given data, followed by padding.
+func (cw *cpioWriter) WriteData(data []byte) {
+	cw.Write(data)
 	//file names, contents, link targets need to end with padding to 4-byte
 	//alignment (note that we cannot compute the padding size from len(data)
 	//since the stream is not necessarily 4-byte-aligned before data)
-	for buf.Len()%4 != 0 {
-		buf.Write([]byte{'\000'})
+	for cw.n%4 != 0 && cw.err == nil {
+		cw.Write([]byte{'\000'})
 	}
 }
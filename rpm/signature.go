@@ -23,10 +23,13 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
+	"hash"
 )
 
-//makeSignatureSection produces the signature section of an RPM header.
-func makeSignatureSection(headerSection []byte, payload *rpmPayload) []byte {
+//makeSignatureSection produces the signature section of an RPM header. The
+//`md5sum` is the MD5 digest of the header section and the compressed payload
+//(see digestHeaderAndPayload).
+func makeSignatureSection(headerSection []byte, payload *rpmPayload, md5sum []byte) []byte {
 	h := &rpmHeader{}
 
 	//NOTE that some fields validate both header+payload, some only the
@@ -48,11 +51,16 @@ func makeSignatureSection(headerSection []byte, payload *rpmPayload) []byte {
 	h.AddStringValue(rpmsigtagSHA1, sha1sum, false)
 
 	//MD5 digest of header + payload section
-	md5digest := md5.New()
-	md5digest.Write(headerSection)
-	md5digest.Write(payload.Binary)
-	md5sum := md5digest.Sum(nil)
 	h.AddBinaryValue(rpmsigtagMD5, md5sum)
 
 	return h.ToBinary(rpmtagHeaderSignatures)
 }
+
+//digestHeaderAndPayload returns a hash that has already consumed the header
+//section. Writing the compressed payload into it yields the MD5 digest for
+//makeSignatureSection.
+func digestHeaderAndPayload(headerSection []byte) hash.Hash {
+	md5digest := md5.New()
+	md5digest.Write(headerSection)
+	return md5digest
+}
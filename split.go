@@ -0,0 +1,134 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+//SplitRule is used by Split() to describe a sub-package.
+type SplitRule struct {
+	//Name is the name of the sub-package, e.g. "foo-doc".
+	Name string
+	//Description is the description of the sub-package. If empty, the
+	//description of the original package is used.
+	Description string
+	//Patterns selects the nodes that are moved into the sub-package (see
+	//filesystem.MatchGlob for the syntax). When a directory matches, it is
+	//moved with everything below it.
+	Patterns []string
+	//Requires, Provides, Conflicts and Replaces contain the relations of the
+	//sub-package. They are not inherited from the original package.
+	Requires  []PackageRelation
+	Provides  []PackageRelation
+	Conflicts []PackageRelation
+	Replaces  []PackageRelation
+}
+
+//Split distributes the contents of a package over multiple packages. The
+//first returned package is a copy of the original package that retains all
+//nodes that do not match any rule. It is followed by one sub-package per rule,
+//in the order of the rules. When a node matches the patterns of multiple
+//rules, the first matching rule wins. Directories that become empty because
+//all their entries were moved are removed from the base package.
+//
+//The sub-packages inherit the version, architecture, author and source of the
+//original package, but not its relations or actions. The original package is
+//not modified.
+func Split(pkg *Package, rules []SplitRule) ([]*Package, error) {
+	seenNames := map[string]bool{pkg.Name: true}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, errors.New("split rule without package name")
+		}
+		if seenNames[rule.Name] {
+			return nil, fmt.Errorf("duplicate package name %q in split rules", rule.Name)
+		}
+		seenNames[rule.Name] = true
+		for _, pattern := range rule.Patterns {
+			_, err := filesystem.MatchGlob(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in split rule for %s: %s", pattern, rule.Name, err.Error())
+			}
+		}
+	}
+
+	base := pkg.Clone()
+	result := []*Package{base}
+	for _, rule := range rules {
+		//start with an empty copy of the root directory, to inherit its metadata
+		root := (&filesystem.Directory{
+			Metadata:     base.FSRoot.Metadata,
+			DirDefaults:  base.FSRoot.DirDefaults,
+			FileDefaults: base.FSRoot.FileDefaults,
+		}).Clone()
+
+		var err error
+		base.FSRoot.Filter(func(relPath string, node filesystem.Node) bool {
+			if err != nil || !matchesAny(rule.Patterns, relPath) {
+				return true
+			}
+			err = root.AddFile(relPath, node)
+			return false
+		}, true)
+		if err != nil {
+			return nil, fmt.Errorf("cannot split %s: %s", rule.Name, err.Error())
+		}
+
+		description := rule.Description
+		if description == "" {
+			description = pkg.Description
+		}
+		result = append(result, &Package{
+			Name:               rule.Name,
+			Version:            pkg.Version,
+			Release:            pkg.Release,
+			Epoch:              pkg.Epoch,
+			Description:        description,
+			Author:             pkg.Author,
+			Maintainer:         pkg.Maintainer,
+			Vendor:             pkg.Vendor,
+			Source:             pkg.Source,
+			Architecture:       pkg.Architecture,
+			ArchitectureInput:  pkg.ArchitectureInput,
+			Requires:           cloneRelations(rule.Requires),
+			Provides:           cloneRelations(rule.Provides),
+			Conflicts:          cloneRelations(rule.Conflicts),
+			Replaces:           cloneRelations(rule.Replaces),
+			FSRoot:             root,
+			ForceRootOwnership: pkg.ForceRootOwnership,
+			OptionalChecks:     pkg.OptionalChecks,
+			AllowedEmptyFiles:  pkg.AllowedEmptyFiles,
+		})
+	}
+	return result, nil
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filesystem.MatchGlob(pattern, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -19,7 +19,21 @@
 
 package build
 
-import "regexp"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
 
 //RegexSet is a collection of regular expressions for validating a package.
 //A RegexSet is typically constructed by a common.Generator for calling
@@ -30,8 +44,25 @@ type RegexSet struct {
 	RelatedName    string
 	RelatedVersion string
 	FormatName     string //used for error messages only
+	//MaxPathLength is the maximum length in bytes of an absolute path in the
+	//package. If zero, defaultMaxPathLength is used.
+	MaxPathLength int
+	//DefaultShell is the shell that the generator uses for scripts without an
+	//explicit Interpreter (used by CheckScriptSyntax). If empty, "sh" is used.
+	DefaultShell string
 }
 
+const (
+	//the default for RegexSet.MaxPathLength (PATH_MAX on Linux, minus one
+	//byte for the terminating NUL)
+	defaultMaxPathLength = 4095
+	//the maximum length of a single path element (NAME_MAX on Linux)
+	maxPathElementLength = 255
+	//the maximum number of symlinks that are followed when resolving a path
+	//(MAXSYMLINKS on Linux)
+	maxSymlinkHops = 40
+)
+
 type compiledRegexSet struct {
 	PackageName    *regexp.Regexp
 	PackageVersion *regexp.Regexp
@@ -46,7 +77,17 @@ type compiledRegexSet struct {
 //the given set of regexes, and returns a non-empty list of errors if
 //validation fails.
 func (pkg *Package) ValidateWith(r RegexSet, archMap map[Architecture]string) []error {
+	errs, _ := pkg.ValidateWithWarnings(r, archMap)
+	return errs
+}
+
+//ValidateWithWarnings is like ValidateWith, but also returns warnings, i.e.
+//findings that usually indicate a packaging mistake, but do not prevent the
+//package from being built (e.g. symlinks whose target does not exist in the
+//package, since it may be provided by another package).
+func (pkg *Package) ValidateWithWarnings(r RegexSet, archMap map[Architecture]string) (errs []error, warnings []error) {
 	ec := errorCollector{}
+	wc := errorCollector{}
 
 	cr := &compiledRegexSet{
 		PackageName:    regexp.MustCompile("^" + r.PackageName + "$"),
@@ -67,23 +108,342 @@ func (pkg *Package) ValidateWith(r RegexSet, archMap map[Architecture]string) []
 		ec.Addf("Package version \"%s\" is not acceptable for %s packages", pkg.Version, cr.FormatName)
 	}
 
-	if pkg.Release == 0 {
-		ec.Addf("Package release may not be zero (numbering of releases starts at 1)")
-	}
-
 	//check if architecture is supported by this generator
 	if _, ok := archMap[pkg.Architecture]; !ok {
 		ec.Addf("Architecture \"%s\" is not acceptable for %s packages", pkg.ArchitectureInput, cr.FormatName)
 	}
 
 	validatePackageRelations(cr, "requires", pkg.Requires, &ec)
+	validatePackageRelations(cr, "pre-depends", pkg.PreDepends, &ec)
 	validatePackageRelations(cr, "provides", pkg.Provides, &ec)
 	validatePackageRelations(cr, "conflicts", pkg.Conflicts, &ec)
 	validatePackageRelations(cr, "replaces", pkg.Replaces, &ec)
 
+	pkg.validateCommon(r, archMap, &ec, &wc)
+	return ec.Errors, wc.Errors
+}
+
+//ValidateCommon performs all the validations of ValidateWith() that do not
+//depend on format-specific regexes or architectures. This is already
+//included in ValidateWith(), and only needs to be called by generators that
+//do not use ValidateWith().
+func (pkg *Package) ValidateCommon(formatName string) []error {
+	errs, _ := pkg.ValidateCommonWithWarnings(formatName)
+	return errs
+}
+
+//ValidateCommonWithWarnings is like ValidateCommon, but also returns warnings
+//(see ValidateWithWarnings).
+func (pkg *Package) ValidateCommonWithWarnings(formatName string) (errs []error, warnings []error) {
+	ec := errorCollector{}
+	wc := errorCollector{}
+	pkg.validateCommon(RegexSet{FormatName: formatName}, nil, &ec, &wc)
+	return ec.Errors, wc.Errors
+}
+
+//validateCommon reports errors into `ec` and warnings into `wc`. Only the
+//FormatName, MaxPathLength and DefaultShell of the RegexSet are used. The
+//`archMap` is only used for rendering templates, and may be nil.
+func (pkg *Package) validateCommon(r RegexSet, archMap map[Architecture]string, ec, wc *errorCollector) {
+	formatName := r.FormatName
+	pkg.validateReleaseAndEpoch(ec)
+	if strings.ContainsAny(pkg.Source, "\r\n") {
+		ec.Addf("Package source \"%s\" may not contain line breaks", pkg.Source)
+	}
+	pkg.validateConstraintRelations(ec)
+	pkg.validateVersionedProvides(ec)
+	pkg.validateProvidedLibraries(ec)
+	pkg.validateContradictoryRelations(ec)
+	ec.Add(pkg.validateScriptInterpreters())
+	pkg.validateSymlinks(ec, wc)
+	pkg.validateHardlinks(ec)
+	pkg.validateDocFiles(ec)
+	maxPathLength := r.MaxPathLength
+	if maxPathLength == 0 {
+		maxPathLength = defaultMaxPathLength
+	}
+	pkg.validatePathLengths(formatName, maxPathLength, ec)
+
+	if pkg.OptionalChecks&CheckCaseInsensitivePaths != 0 {
+		pkg.validateCaseInsensitivePaths(ec)
+	}
+	if pkg.OptionalChecks&CheckScriptSyntax != 0 {
+		pkg.validateScriptSyntax(r.DefaultShell, ec, wc)
+	}
+	if pkg.OptionalChecks&CheckELFArchitecture != 0 {
+		pkg.validateELFArchitecture(ec)
+	}
+	if pkg.OptionalChecks&CheckFileModes != 0 {
+		pkg.validateFileModes(wc)
+	}
+	if pkg.OptionalChecks&CheckEmptyFiles != 0 {
+		pkg.validateEmptyFiles(archMap, wc)
+	}
+	if pkg.OptionalChecks&CheckSynopsisLength != 0 {
+		pkg.validateSynopsisLength(wc)
+	}
+}
+
+//validateSynopsisLength implements CheckSynopsisLength.
+func (pkg *Package) validateSynopsisLength(wc *errorCollector) {
+	length := utf8.RuneCountInString(pkg.DescriptionSynopsis())
+	if length > MaxSynopsisLength {
+		wc.Addf("Description synopsis is %d characters long, but should not be longer than %d characters", length, MaxSynopsisLength)
+	}
+}
+
+//ValidateSynopsisLength returns warnings for a DescriptionSynopsis() that is
+//longer than MaxSynopsisLength characters. This is already included in
+//ValidateWithWarnings() and ValidateCommonWithWarnings() if
+//CheckSynopsisLength is set, and can be used by generators for formats that
+//always need this check.
+func (pkg *Package) ValidateSynopsisLength() []error {
+	wc := errorCollector{}
+	pkg.validateSynopsisLength(&wc)
+	return wc.Errors
+}
+
+//validateConstraintRelations checks that all version constraints use one of
+//the known relation operators. Generators would otherwise render unknown
+//operators in a way that silently weakens (or drops) the constraint.
+func (pkg *Package) validateConstraintRelations(ec *errorCollector) {
+	relTypes := []struct {
+		Name string
+		Rels []PackageRelation
+	}{
+		{"requires", pkg.Requires},
+		{"pre-depends", pkg.PreDepends},
+		{"provides", pkg.Provides},
+		{"conflicts", pkg.Conflicts},
+		{"replaces", pkg.Replaces},
+	}
+	for _, relType := range relTypes {
+		for _, rel := range relType.Rels {
+			for _, c := range rel.Constraints {
+				switch c.Relation {
+				case "<", "<=", "=", ">=", ">":
+				default:
+					ec.Addf("Relation \"%s\" in \"%s %s %s\" is not acceptable (found in %s)",
+						c.Relation, rel.RelatedPackage, c.Relation, c.Version, relType.Name)
+				}
+			}
+		}
+	}
+}
+
+//validateProvidedLibraries checks that ProvidedLibraries contains versioned
+//sonames, which can be represented in all package formats.
+func (pkg *Package) validateProvidedLibraries(ec *errorCollector) {
+	if len(pkg.ProvidedLibraries) > 0 && pkg.Architecture == ArchitectureAny {
+		ec.Addf("Packages with provided libraries must have a specific architecture")
+	}
+	for _, soname := range pkg.ProvidedLibraries {
+		if _, _, ok := SplitSoname(soname); !ok {
+			ec.Addf("Provided library \"%s\" is not a versioned soname like \"libfoo.so.1\"", soname)
+		}
+	}
+}
+
+//validateVersionedProvides checks that provided packages have at most one
+//version, which must be given as an exact version ("="). This is the only form
+//that can be represented in all package formats.
+func (pkg *Package) validateVersionedProvides(ec *errorCollector) {
+	for _, rel := range pkg.Provides {
+		if len(rel.Constraints) > 1 {
+			ec.Addf("Provided package \"%s\" may not have more than one version", rel.RelatedPackage)
+			continue
+		}
+		for _, c := range rel.Constraints {
+			if c.Relation != "=" {
+				ec.Addf("Provided package \"%s\" must use the \"=\" relation to specify a version, not \"%s\"", rel.RelatedPackage, c.Relation)
+			}
+		}
+	}
+}
+
+//validateSymlinks checks that relative symlink targets do not escape the
+//package root. Symlink cycles within the package and targets that use a
+//non-directory as a directory are reported for all symlinks.
+//
+//Relative symlinks that do not point to something within the package are
+//reported as warnings (unless the symlink is marked as Dangling), since the
+//target may be provided by another package (e.g. "libfoo.so -> libfoo.so.1"
+//in a -dev package). Absolute symlink targets are not checked for existence
+//since they commonly refer to files outside the package (e.g. "/dev/null").
+func (pkg *Package) validateSymlinks(ec, wc *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	pkg.WalkFSWithRelativePaths(func(relPath string, node filesystem.Node) error {
+		link, ok := node.(*filesystem.Symlink)
+		if !ok || link.Target == "" {
+			return nil
+		}
+		if err := pkg.resolveSymlinks(relPath); err != nil {
+			ec.Addf("Symlink \"/%s\" points to \"%s\", but %s", relPath, link.Target, err.Error())
+			return nil
+		}
+		if strings.HasPrefix(link.Target, "/") {
+			return nil
+		}
+		resolved := path.Join(path.Dir(relPath), link.Target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			ec.Addf("Symlink \"/%s\" points to \"%s\" outside of the package", relPath, link.Target)
+			return nil
+		}
+		if !link.Dangling && !pkg.FSRoot.Contains(resolved) {
+			wc.Addf("Symlink \"/%s\" points to \"%s\" which does not exist in the package", relPath, link.Target)
+		}
+		return nil
+	})
+}
+
+//resolveSymlinks follows all symlinks in the given path (relative to the
+//package root) like the kernel would after the package has been installed.
+//Resolution stops at the first name that does not exist in the package, since
+//it may be provided by some other package. An error is returned for symlink
+//cycles, and when a file that is not a directory is used as a directory.
+func (pkg *Package) resolveSymlinks(relPath string) error {
+	var resolved []string
+	queue := strings.Split(relPath, "/")
+	hops := 0
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		currentPath := strings.Join(append(resolved, name), "/")
+		switch n := pkg.FSRoot.Lookup(currentPath).(type) {
+		case nil:
+			return nil
+		case *filesystem.Directory:
+			resolved = append(resolved, name)
+		case *filesystem.Symlink:
+			hops++
+			if hops > maxSymlinkHops {
+				return errors.New("resolving it leads into a symlink cycle")
+			}
+			if strings.HasPrefix(n.Target, "/") {
+				resolved = nil
+			}
+			queue = append(strings.Split(n.Target, "/"), queue...)
+		default:
+			if len(queue) > 0 {
+				return fmt.Errorf("\"/%s\" is not a directory", currentPath)
+			}
+			resolved = append(resolved, name)
+		}
+	}
+	return nil
+}
+
+//validateHardlinks checks that hardlinks point to regular files within the
+//package that come before them in the order of Walk(), since archive formats
+//can only refer back to entries that were already written.
+func (pkg *Package) validateHardlinks(ec *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	pkg.WalkFSWithRelativePaths(func(relPath string, node filesystem.Node) error {
+		link, ok := node.(*filesystem.Hardlink)
+		if !ok {
+			seen[relPath] = true
+			return nil
+		}
+		_, err := pkg.FSRoot.ResolveHardlink(link)
+		if err != nil {
+			ec.Addf("Hardlink \"/%s\" is invalid: %s", relPath, err.Error())
+			return nil
+		}
+		if target := path.Clean("/" + link.Target)[1:]; !seen[target] {
+			ec.Addf("Hardlink \"/%s\" points to \"/%s\" which comes after it in the package", relPath, target)
+		}
+		return nil
+	})
+}
+
+//validateReleaseAndEpoch checks that Release and Epoch are within the bounds
+//supported by all package formats.
+func (pkg *Package) validateReleaseAndEpoch(ec *errorCollector) {
+	if pkg.Release == 0 {
+		ec.Addf("Package release may not be zero (numbering of releases starts at 1)")
+	}
+	//package managers parse these into 32-bit signed integers
+	if pkg.Release > math.MaxInt32 {
+		ec.Addf("Package release %d is too large (maximum is %d)", pkg.Release, math.MaxInt32)
+	}
+	//(Epoch needs no lower bound since it is unsigned, and 0 is the default)
+	if pkg.Epoch > math.MaxInt32 {
+		ec.Addf("Package epoch %d is too large (maximum is %d)", pkg.Epoch, math.MaxInt32)
+	}
+}
+
+//ValidateReleaseAndEpoch checks that Release and Epoch are within the bounds
+//supported by all package formats. This is already included in
+//ValidateWith() and ValidateCommon().
+func (pkg *Package) ValidateReleaseAndEpoch() []error {
+	ec := errorCollector{}
+	pkg.validateReleaseAndEpoch(&ec)
 	return ec.Errors
 }
 
+func (pkg *Package) validateScriptInterpreters() error {
+	for _, actionType := range []uint{SetupAction, CleanupAction} {
+		_, err := pkg.ScriptInterpreter(actionType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//validateScriptSyntax runs the script for each action type through `$SHELL -n`,
+//where $SHELL is the explicit Interpreter or else the given default shell.
+//Scripts for non-shell interpreters are not checked. If the shell is not
+//available, the check is skipped with a warning.
+func (pkg *Package) validateScriptSyntax(defaultShell string, ec, wc *errorCollector) {
+	actionNames := map[uint]string{
+		SetupAction:   "setup",
+		CleanupAction: "cleanup",
+	}
+	for _, actionType := range []uint{SetupAction, CleanupAction} {
+		script := pkg.Script(actionType)
+		interpreter, err := pkg.ScriptInterpreter(actionType)
+		if script == "" || err != nil || !IsShellInterpreter(interpreter) {
+			continue //errors are reported by validateScriptInterpreters()
+		}
+		if interpreter == "" {
+			interpreter = defaultShell
+		}
+		if interpreter == "" {
+			interpreter = "sh"
+		}
+		shell, err := exec.LookPath(interpreter)
+		if err != nil {
+			wc.Addf("Cannot check syntax of %s script: %s is not available", actionNames[actionType], interpreter)
+			continue
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.Command(shell, "-n")
+		cmd.Stdin = strings.NewReader(script)
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		if err != nil {
+			ec.Addf("Syntax error in %s script: %s", actionNames[actionType], strings.TrimSpace(stderr.String()))
+		}
+	}
+}
+
 func validatePackageRelations(r *compiledRegexSet, relType string, rels []PackageRelation, ec *errorCollector) {
 	for _, rel := range rels {
 		if !r.RelatedName.MatchString(rel.RelatedPackage) {
@@ -98,3 +458,135 @@ func validatePackageRelations(r *compiledRegexSet, relType string, rels []Packag
 		}
 	}
 }
+
+//validatePathLengths reports paths that are too long to be extracted.
+func (pkg *Package) validatePathLengths(formatName string, maxPathLength int, ec *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	pkg.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+		if len(absolutePath) > maxPathLength {
+			ec.Addf("Path \"%s\" is %d bytes long, but %s packages allow at most %d bytes",
+				absolutePath, len(absolutePath), formatName, maxPathLength,
+			)
+			return filepath.SkipDir //do not report everything below this directory as well
+		}
+		name := path.Base(absolutePath)
+		if len(name) > maxPathElementLength {
+			ec.Addf("Path \"%s\" contains an element that is %d bytes long, but at most %d bytes are allowed",
+				absolutePath, len(name), maxPathElementLength,
+			)
+		}
+		return nil
+	})
+}
+
+//validateCaseInsensitivePaths reports paths that differ only in case. Only
+//the topmost conflict is reported, e.g. for "usr/Foo/bar" and "usr/foo/bar",
+//the paths "usr/Foo" and "usr/foo" are reported.
+func (pkg *Package) validateCaseInsensitivePaths(ec *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	seen := make(map[string]string)
+	pkg.WalkFSWithAbsolutePaths(func(absolutePath string, node filesystem.Node) error {
+		key := strings.ToLower(absolutePath)
+		other, exists := seen[key]
+		if !exists {
+			seen[key] = absolutePath
+			return nil
+		}
+		if path.Dir(other) == path.Dir(absolutePath) {
+			ec.Addf("Paths \"%s\" and \"%s\" differ only in case", other, absolutePath)
+		}
+		return nil
+	})
+}
+
+//scriptDirsInEtc contains the directories below /etc whose files are
+//conventionally executable (see CheckNonExecutableConfig).
+var scriptDirsInEtc = []string{
+	"etc/init.d/**",
+	"etc/rc.d/**",
+	"etc/cron.hourly/**",
+	"etc/cron.daily/**",
+	"etc/cron.weekly/**",
+	"etc/cron.monthly/**",
+}
+
+//validateFileModes implements CheckExecutableBinaries,
+//CheckNonExecutableConfig and CheckDirectoryModes. Findings are reported into
+//the given collector for warnings.
+func (pkg *Package) validateFileModes(wc *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	checks := pkg.OptionalChecks
+	pkg.WalkFSWithRelativePaths(func(relPath string, node filesystem.Node) error {
+		var mode os.FileMode
+		switch n := node.(type) {
+		case *filesystem.Directory:
+			mode = n.Metadata.Mode
+			//every class (owner/group/other) that can read the directory should
+			//also be able to enter it, i.e. each "r" bit needs the matching "x" bit
+			readableAsSearchable := (mode & 0444) >> 2
+			if checks&CheckDirectoryModes != 0 && readableAsSearchable&^mode != 0 {
+				wc.Addf("Directory \"/%s\" has mode %o, which is readable, but not searchable", relPath, mode)
+			}
+			return nil
+		case *filesystem.RegularFile:
+			mode = n.Metadata.Mode
+		case *filesystem.ReaderFile:
+			mode = n.Metadata.Mode
+		default:
+			return nil //hardlinks share the mode of their target, which is checked instead
+		}
+
+		isExecutable := mode&0111 != 0
+		switch path.Dir(relPath) {
+		case "bin", "sbin", "usr/bin", "usr/sbin":
+			if checks&CheckExecutableBinaries != 0 && !isExecutable {
+				wc.Addf("File \"/%s\" has mode %o, but files in /%s should be executable", relPath, mode, path.Dir(relPath))
+			}
+		}
+		if checks&CheckNonExecutableConfig != 0 && isExecutable && strings.HasPrefix(relPath, "etc/") {
+			isScript := false
+			for _, pattern := range scriptDirsInEtc {
+				if ok, _ := filesystem.MatchGlob(pattern, relPath); ok {
+					isScript = true
+					break
+				}
+			}
+			if !isScript {
+				wc.Addf("File \"/%s\" has mode %o, but files in /etc should not be executable", relPath, mode)
+			}
+		}
+		return nil
+	})
+}
+
+//validateEmptyFiles warns about regular files without content (see
+//CheckEmptyFiles). Templates are rendered first since an empty template can
+//render into a non-empty file and vice versa. Templates that cannot be
+//rendered are skipped here, since PrepareBuild() reports them.
+func (pkg *Package) validateEmptyFiles(archMap map[Architecture]string, wc *errorCollector) {
+	if pkg.FSRoot == nil {
+		return
+	}
+	pkg.WalkFSWithRelativePaths(func(relPath string, node filesystem.Node) error {
+		var isEmpty bool
+		switch n := node.(type) {
+		case *filesystem.RegularFile:
+			isEmpty = n.Content == ""
+		case *filesystem.ReaderFile:
+			isEmpty = n.Size == 0
+		case *filesystem.TemplateFile:
+			file, err := n.Render(pkg.templateData(n, archMap))
+			isEmpty = err == nil && file.Content == ""
+		}
+		if isEmpty && !matchesAny(DefaultAllowedEmptyFiles, relPath) && !matchesAny(pkg.AllowedEmptyFiles, relPath) {
+			wc.Addf("File \"/%s\" is empty (add it to AllowedEmptyFiles if this is intended)", relPath)
+		}
+		return nil
+	})
+}
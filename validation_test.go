@@ -0,0 +1,117 @@
+/*******************************************************************************
+*
+* Copyright 2018 Stefan Majewsky <majewsky@gmx.net>
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package build
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/holocm/libpackagebuild/filesystem"
+)
+
+func makeTestPackage() *Package {
+	return &Package{
+		Name:         "foo",
+		Version:      "1.0",
+		Release:      1,
+		Architecture: ArchitectureX86_64,
+		FSRoot:       filesystem.NewDirectory(),
+	}
+}
+
+//expectErrors checks that `errs` contains exactly one error for each of the
+//`expected` substrings, in that order.
+func expectErrors(t *testing.T, desc string, errs []error, expected ...string) {
+	t.Helper()
+	if len(errs) != len(expected) {
+		t.Errorf("%s: expected %d errors, but got %q", desc, len(expected), errs)
+		return
+	}
+	for idx, err := range errs {
+		if !strings.Contains(err.Error(), expected[idx]) {
+			t.Errorf("%s: expected error to contain %q, but got: %s", desc, expected[idx], err.Error())
+		}
+	}
+}
+
+func TestValidateProvidedLibraries(t *testing.T) {
+	testCases := []struct {
+		Architecture Architecture
+		Sonames      []string
+		Expected     []string
+	}{
+		{ArchitectureX86_64, []string{"libfoo.so.1", "libfoo-bar.so.1.2.3"}, nil},
+		{ArchitectureAny, []string{"libfoo.so.1"}, []string{"must have a specific architecture"}},
+		{ArchitectureX86_64, []string{"libfoo.so"}, []string{`"libfoo.so" is not a versioned soname`}},
+		{ArchitectureX86_64, []string{"/usr/lib/libfoo.so.1"}, []string{`"/usr/lib/libfoo.so.1" is not a versioned soname`}},
+		{ArchitectureX86_64, []string{"mail-transport-agent"}, []string{`"mail-transport-agent" is not a versioned soname`}},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage()
+		pkg.Architecture = tc.Architecture
+		pkg.ProvidedLibraries = tc.Sonames
+		expectErrors(t, strings.Join(tc.Sonames, ","), pkg.ValidateCommon("test"), tc.Expected...)
+	}
+}
+
+func TestValidateReleaseAndEpoch(t *testing.T) {
+	testCases := []struct {
+		Release  uint
+		Epoch    uint
+		Expected []string
+	}{
+		{0, 0, []string{"Package release may not be zero"}},
+		{1, 0, nil},
+		{math.MaxInt32, 0, nil},
+		{math.MaxInt32 + 1, 0, []string{"Package release 2147483648 is too large (maximum is 2147483647)"}},
+		{1, math.MaxInt32, nil},
+		{1, math.MaxInt32 + 1, []string{"Package epoch 2147483648 is too large (maximum is 2147483647)"}},
+	}
+
+	for _, tc := range testCases {
+		pkg := makeTestPackage()
+		pkg.Release = tc.Release
+		pkg.Epoch = tc.Epoch
+		desc := fmt.Sprintf("release %d, epoch %d", tc.Release, tc.Epoch)
+		expectErrors(t, desc, pkg.ValidateReleaseAndEpoch(), tc.Expected...)
+		//the same check is part of the common validation
+		expectErrors(t, desc, pkg.ValidateCommon("test"), tc.Expected...)
+	}
+}
+
+func TestValidateConstraintRelations(t *testing.T) {
+	for _, relation := range []string{"<", "<=", "=", ">=", ">"} {
+		pkg := makeTestPackage()
+		pkg.Conflicts = []PackageRelation{{RelatedPackage: "bar", Constraints: []VersionConstraint{{Relation: relation, Version: "2.0"}}}}
+		expectErrors(t, relation, pkg.ValidateCommon("test"))
+	}
+
+	//unknown operators (including those from other formats, like Debian's
+	//"<<") are rejected instead of being passed through
+	for _, relation := range []string{"<<", ">>", "=>", "==", "!=", ""} {
+		pkg := makeTestPackage()
+		pkg.Replaces = []PackageRelation{{RelatedPackage: "bar", Constraints: []VersionConstraint{{Relation: relation, Version: "2.0"}}}}
+		expectErrors(t, relation, pkg.ValidateCommon("test"),
+			fmt.Sprintf(`Relation "%s" in "bar %s 2.0" is not acceptable (found in replaces)`, relation, relation))
+	}
+}